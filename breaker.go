@@ -0,0 +1,137 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+var errBreakerOpen = errors.New("dvara: circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+// circuitBreaker stops dials to a member that keeps failing. It opens after
+// FailureThreshold dials failed in a row, and dials are refused while it is
+// open. Once OpenTimeout passed it is half open and lets a single trial dial
+// through, which closes it if it succeeds and opens it again if it fails.
+type circuitBreaker struct {
+	// Name is the member the breaker is for, used in logs.
+	Name string
+
+	// FailureThreshold is the number of dials failing in a row that opens the
+	// breaker. Zero means it never opens.
+	FailureThreshold uint
+
+	// OpenTimeout is how long the breaker stays open before a trial dial.
+	OpenTimeout time.Duration
+
+	// Stats is optional and counts the transitions.
+	Stats stats.Client
+
+	// Clock allows for testing timing related functionality. Do not specify this
+	// in production code.
+	Clock clock.Clock
+
+	mu       sync.Mutex
+	state    breakerState
+	failures uint
+	opened   time.Time
+	trial    bool
+}
+
+func (b *circuitBreaker) now() time.Time {
+	if b.Clock == nil {
+		return time.Now()
+	}
+	return b.Clock.Now()
+}
+
+// Ready tells us if the breaker lets clients through. It fails while the
+// breaker is open and no trial dial is due yet.
+func (b *circuitBreaker) Ready() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && b.now().Sub(b.opened) < b.OpenTimeout {
+		return errBreakerOpen
+	}
+	return nil
+}
+
+// Allow tells us if a dial may go ahead. Once the breaker is half open only
+// the trial dial is allowed until it reports back.
+func (b *circuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.opened) < b.OpenTimeout {
+			return errBreakerOpen
+		}
+		b.transition(breakerHalfOpen)
+		b.trial = true
+	case breakerHalfOpen:
+		if b.trial {
+			return errBreakerOpen
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+// Success reports a dial that worked.
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trial = false
+	if b.state != breakerClosed {
+		b.transition(breakerClosed)
+	}
+}
+
+// Failure reports a dial that failed.
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	switch b.state {
+	case breakerClosed:
+		if b.FailureThreshold == 0 || b.failures < b.FailureThreshold {
+			return
+		}
+	case breakerOpen:
+		return
+	}
+	b.opened = b.now()
+	b.transition(breakerOpen)
+}
+
+func (b *circuitBreaker) transition(state breakerState) {
+	corelog.LogInfoMessage(fmt.Sprintf("circuit breaker for %s %s after %d failures", b.Name, state, b.failures))
+	stats.BumpSum(b.Stats, "breaker."+state.String(), 1)
+	b.state = state
+}
@@ -0,0 +1,79 @@
+package dvara
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+)
+
+func TestBreakerOpens(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	transitions := map[string]int{}
+	b := &circuitBreaker{
+		FailureThreshold: 2,
+		OpenTimeout:      time.Second,
+		Clock:            klock,
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				transitions[key]++
+			},
+		},
+	}
+
+	// one failure is not enough
+	ensure.Nil(t, b.Allow())
+	b.Failure()
+	ensure.Nil(t, b.Ready())
+	ensure.Nil(t, b.Allow())
+	b.Failure()
+
+	// open until the timeout passed
+	ensure.DeepEqual(t, b.Ready(), errBreakerOpen)
+	ensure.DeepEqual(t, b.Allow(), errBreakerOpen)
+	klock.Add(b.OpenTimeout)
+	ensure.Nil(t, b.Ready())
+
+	// half open lets only the trial through, which closes it
+	ensure.Nil(t, b.Allow())
+	ensure.DeepEqual(t, b.Allow(), errBreakerOpen)
+	b.Success()
+	ensure.Nil(t, b.Allow())
+	ensure.DeepEqual(t, transitions, map[string]int{
+		"breaker.open":      1,
+		"breaker.half_open": 1,
+		"breaker.closed":    1,
+	})
+}
+
+func TestBreakerTrialFails(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	b := &circuitBreaker{
+		FailureThreshold: 1,
+		OpenTimeout:      time.Second,
+		Clock:            klock,
+	}
+	b.Failure()
+	klock.Add(b.OpenTimeout)
+	ensure.Nil(t, b.Allow())
+	b.Failure()
+
+	// open again for another timeout
+	ensure.DeepEqual(t, b.Allow(), errBreakerOpen)
+	klock.Add(b.OpenTimeout)
+	ensure.Nil(t, b.Allow())
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	t.Parallel()
+	b := &circuitBreaker{}
+	for i := 0; i < 10; i++ {
+		b.Failure()
+	}
+	ensure.Nil(t, b.Ready())
+	ensure.Nil(t, b.Allow())
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -29,12 +34,28 @@ func Main() error {
 	listenAddr := flag.String("listen", "127.0.0.1", "address for listening, for example, 127.0.0.1 for reachable only from the same machine, or 0.0.0.0 for reachable from other machines")
 	maxConnections := flag.Uint("max_connections", 100, "maximum number of connections per mongo")
 	maxPerClientConnections := flag.Uint("max_per_client_connections", 100, "maximum number of connections from a single client")
+	minIdleConnections := flag.Uint("min_idle_connections", 0, "number of idle connections per mongo kept when idle ones are closed")
 	messageTimeout := flag.Duration("message_timeout", 2*time.Minute, "timeout for one message to be proxied")
 	password := flag.String("password", "", "mongodb password")
 	portEnd := flag.Int("port_end", 6010, "end of port range")
 	portStart := flag.Int("port_start", 6000, "start of port range")
 	serverClosePoolSize := flag.Uint("server_close_pool_size", 1, "number of goroutines that will handle closing server connections.")
 	serverIdleTimeout := flag.Duration("server_idle_timeout", 60*time.Minute, "duration after which a server connection will be considered idle")
+	adaptiveLimitMin := flag.Uint("adaptive_limit_min", 0, "least number of server connections per mongo used at once when adapting it to latency, 0 to always use max_connections")
+	adaptiveLimitLatency := flag.Duration("adaptive_limit_latency", 100*time.Millisecond, "how long a message may take before the number of server connections used at once is cut")
+	adaptiveLimitBackoff := flag.Float64("adaptive_limit_backoff", 0.9, "factor the number of server connections used at once is cut by")
+	maxConcurrentDials := flag.Uint("max_concurrent_dials", 0, "maximum number of server connections being dialed to each mongo at once, 0 for no limit")
+	serverDialTimeout := flag.Duration("server_dial_timeout", time.Second, "timeout for dialing a server connection")
+	serverDialAttempts := flag.Uint("server_dial_attempts", 7, "number of times dialing a server connection is tried")
+	serverDialBackoff := flag.Duration("server_dial_backoff", 50*time.Millisecond, "wait before dialing a server connection again, doubled after every failed try")
+	serverDialBackoffJitter := flag.Duration("server_dial_backoff_jitter", 0, "most every wait before dialing again is randomly lengthened by")
+	breakerFailureThreshold := flag.Uint("breaker_failure_threshold", 0, "number of failed dials in a row after which clients get an error right away, 0 to never")
+	breakerOpenTimeout := flag.Duration("breaker_open_timeout", 5*time.Second, "how long clients get an error right away before dialing is tried again")
+	serverWarmInterval := flag.Duration("server_warm_interval", 0, "how often a server connection is dialed in the background while there are fewer than min_idle_connections idle ones, 0 to only dial on demand")
+	serverValidateIdle := flag.Duration("server_validate_idle", 0, "idle time after which a server connection is pinged before it is used, 0 to never ping")
+	serverMaxLifetime := flag.Duration("server_max_lifetime", 0, "duration after which a server connection is closed instead of reused, 0 for no limit")
+	serverMaxLifetimeJitter := flag.Duration("server_max_lifetime_jitter", 0, "most the lifetime of a server connection is randomly shortened by")
+	serverMaxUses := flag.Uint("server_max_uses", 0, "number of uses after which a server connection is closed instead of reused, 0 for no limit")
 	username := flag.String("username", "", "mongo db username")
 	metricsAddress := flag.String("metrics", "127.0.0.1:8125", "UDP address to send metrics to datadog, default is 127.0.0.1:8125")
 	replicaName := flag.String("replica_name", "", "Replica name, used in metrics and logging, default is empty")
@@ -46,8 +67,28 @@ func Main() error {
 	mechanism := flag.String("mechanism", "", "Login mechanism")
 	sslSkipVerify := flag.Bool("ssl_skip_verify", false, "Skip SSL hostname verification")
 	logQueries := flag.Bool("log_queries", false, "Log all queries")
+	maxWireVersion := flag.Int("max_wire_version", dvara.DefaultMaxWireVersion, "highest wire version advertised to clients")
+	maxMessageLength := flag.Int("max_message_length", 0, "longest message accepted from clients, 0 for the backend's maxMessageSizeBytes")
+	storeForward := flag.Bool("store_forward", false, "read requests before getting a server connection and send replies after releasing it, so slow clients don't hold server connections")
+	storeForwardMaxMessage := flag.Int64("store_forward_max_message", 0, "most bytes a request, and separately its replies, are stored in, larger ones are streamed, 0 for no limit")
+	storeForwardMaxMemory := flag.Int64("store_forward_max_memory", 0, "most bytes all stored requests and replies are stored in, others are streamed, 0 for no limit")
+	bodyReadTimeout := flag.Duration("body_read_timeout", 30*time.Second, "timeout for a client to send the rest of a message after its header")
+	maxPoolWaiting := flag.Uint("max_pool_waiting", 0, "maximum number of clients waiting for a server connection per mongo, 0 for no limit")
+	poolAcquireTimeout := flag.Duration("pool_acquire_timeout", 0, "timeout for a client to get a server connection, 0 for message_timeout")
+	fairQueueBy := flag.String("fair_queue_by", "", "what clients waiting for a server connection are queued fairly by: ip, tls or app, empty for first come first served")
+	fairQueueWeights := flag.String("fair_queue_weights", "", "semicolon separated list of client=weight, the share of server connections a waiting client gets")
+	var priorityClasses priorityClassFlag
+	flag.Var(&priorityClasses, "priority_class", "priority class of clients as name:share:match|match, where a match is ip=CIDR, tls=SUBJECT or app=NAME, repeat for more classes, highest first")
+	priorityShedAfter := flag.Duration("priority_shed_after", 0, "how long clients may wait for a server connection before those of the lowest priority class get an error, 0 to never")
+	var listenerGroups listenerGroupFlag
+	flag.Var(&listenerGroups, "listener_group", "listener group with its own proxies and server connections as name:port_start-port_end:setting=value,setting=value, where a setting is one of max_connections, min_idle_connections, max_pool_waiting, max_per_client_connections, pool_acquire_timeout, server_idle_timeout, client_idle_timeout, message_timeout or read_only, unset ones are those of the flags, repeat for more groups, health checks use the first")
+	snapshotAddr := flag.String("snapshot_addr", "", "address to serve the state of the server connection pools of every mongo on as JSON, empty for none")
 
 	flag.Parse()
+	weights, err := parseWeights(*fairQueueWeights)
+	if err != nil {
+		return err
+	}
 	statsClient := NewDataDogStatsDClient(*metricsAddress, "replica:"+*replicaName)
 
 	// Actual logger
@@ -81,16 +122,45 @@ func Main() error {
 		ListenAddr:              *listenAddr,
 		MaxConnections:          *maxConnections,
 		MaxPerClientConnections: *maxPerClientConnections,
+		MinIdleConnections:      *minIdleConnections,
 		MessageTimeout:          *messageTimeout,
 		PortEnd:                 *portEnd,
 		PortStart:               *portStart,
 		ServerClosePoolSize:     *serverClosePoolSize,
 		ServerIdleTimeout:       *serverIdleTimeout,
+		AdaptiveLimitMin:        *adaptiveLimitMin,
+		AdaptiveLimitLatency:    *adaptiveLimitLatency,
+		AdaptiveLimitBackoff:    *adaptiveLimitBackoff,
+		MaxConcurrentDials:      *maxConcurrentDials,
+		ServerDialTimeout:       *serverDialTimeout,
+		ServerDialAttempts:      *serverDialAttempts,
+		ServerDialBackoff:       *serverDialBackoff,
+		ServerDialBackoffJitter: *serverDialBackoffJitter,
+		BreakerFailureThreshold: *breakerFailureThreshold,
+		BreakerOpenTimeout:      *breakerOpenTimeout,
+		ServerWarmInterval:      *serverWarmInterval,
+		ServerValidateIdle:      *serverValidateIdle,
+		ServerMaxLifetime:       *serverMaxLifetime,
+		ServerMaxLifetimeJitter: *serverMaxLifetimeJitter,
+		ServerMaxUses:           *serverMaxUses,
 		Cred:                    cred,
 		Name:                    *replicaSetName,
 		TLSConfig:               sslConfig.tlsConfig,
 		BackendTLSConfig:        sslConfig.mongoTLSConfig,
 		HealthCheckTLSConfig:    healthCheckTLSConfig,
+		MaxWireVersion:          *maxWireVersion,
+		MaxMessageLength:        *maxMessageLength,
+		BodyReadTimeout:         *bodyReadTimeout,
+		StoreForward:            *storeForward,
+		StoreForwardMaxMessage:  *storeForwardMaxMessage,
+		StoreForwardMaxMemory:   *storeForwardMaxMemory,
+		MaxPoolWaiting:          *maxPoolWaiting,
+		PoolAcquireTimeout:      *poolAcquireTimeout,
+		FairQueueBy:             *fairQueueBy,
+		FairQueueWeights:        weights,
+		PriorityClasses:         priorityClasses,
+		PriorityShedAfter:       *priorityShedAfter,
+		ListenerGroups:          listenerGroups,
 	}
 	stateManager := dvara.NewStateManager(&replicaSet)
 
@@ -114,7 +184,7 @@ func Main() error {
 	log := Logger{}
 
 	var graph inject.Graph
-	err := graph.Provide(
+	err = graph.Provide(
 		&inject.Object{Value: &replicaSet},
 		&inject.Object{Value: &statsClient},
 		&inject.Object{Value: &extensionStackInstance},
@@ -142,9 +212,177 @@ func Main() error {
 	go stateManager.KeepSynchronized(syncChan)
 	go hc.HealthCheck(&replicaSet, syncChan)
 
+	if *snapshotAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(*snapshotAddr, stateManager); err != nil {
+				corelog.LogErrorMessage(fmt.Sprintf("failed to serve snapshots on %s: %s", *snapshotAddr, err))
+			}
+		}()
+	}
+
 	ch := make(chan os.Signal, 2)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
 	<-ch
 	signal.Stop(ch)
 	return nil
 }
+
+// parseWeights parses a semicolon separated list of client=weight. Clients
+// are split from their weight at the last "=", as TLS subjects contain them.
+func parseWeights(s string) (map[string]uint, error) {
+	weights := make(map[string]uint)
+	for _, pair := range strings.Split(s, ";") {
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid client weight %q", pair)
+		}
+		weight, err := strconv.ParseUint(pair[i+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client weight %q: %s", pair, err)
+		}
+		weights[pair[:i]] = uint(weight)
+	}
+	return weights, nil
+}
+
+// priorityClassFlag collects the priority classes given with repeated
+// -priority_class flags.
+type priorityClassFlag []dvara.PriorityClass
+
+func (f *priorityClassFlag) String() string {
+	var names []string
+	for _, class := range *f {
+		names = append(names, class.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *priorityClassFlag) Set(s string) error {
+	class, err := parsePriorityClass(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, class)
+	return nil
+}
+
+// parsePriorityClass parses a priority class as name:share:match|match, where
+// a match is ip=CIDR, tls=SUBJECT or app=NAME. Matches are split at the first
+// "=", as TLS subjects contain them.
+func parsePriorityClass(s string) (dvara.PriorityClass, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return dvara.PriorityClass{}, fmt.Errorf("invalid priority class %q", s)
+	}
+	share, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return dvara.PriorityClass{}, fmt.Errorf("invalid priority class %q: %s", s, err)
+	}
+	class := dvara.PriorityClass{Name: parts[0], Share: share}
+	for _, match := range strings.Split(parts[2], "|") {
+		if match == "" {
+			continue
+		}
+		i := strings.Index(match, "=")
+		if i < 0 {
+			return dvara.PriorityClass{}, fmt.Errorf("invalid priority class match %q", match)
+		}
+		switch value := match[i+1:]; match[:i] {
+		case "ip":
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return dvara.PriorityClass{}, fmt.Errorf("invalid priority class match %q: %s", match, err)
+			}
+			class.Networks = append(class.Networks, network)
+		case "tls":
+			class.TLSSubjects = append(class.TLSSubjects, value)
+		case "app":
+			class.AppNames = append(class.AppNames, value)
+		default:
+			return dvara.PriorityClass{}, fmt.Errorf("invalid priority class match %q", match)
+		}
+	}
+	return class, nil
+}
+
+// listenerGroupFlag collects the listener groups given with repeated
+// -listener_group flags.
+type listenerGroupFlag []dvara.ListenerGroup
+
+func (f *listenerGroupFlag) String() string {
+	var names []string
+	for _, group := range *f {
+		names = append(names, group.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *listenerGroupFlag) Set(s string) error {
+	group, err := parseListenerGroup(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, group)
+	return nil
+}
+
+// parseListenerGroup parses a listener group as
+// name:port_start-port_end:setting=value,setting=value.
+func parseListenerGroup(s string) (dvara.ListenerGroup, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) < 2 || parts[0] == "" {
+		return dvara.ListenerGroup{}, fmt.Errorf("invalid listener group %q", s)
+	}
+	group := dvara.ListenerGroup{Name: parts[0]}
+	if _, err := fmt.Sscanf(parts[1], "%d-%d", &group.PortStart, &group.PortEnd); err != nil {
+		return dvara.ListenerGroup{}, fmt.Errorf("invalid listener group %q: %s", s, err)
+	}
+	if len(parts) == 2 {
+		return group, nil
+	}
+	for _, setting := range strings.Split(parts[2], ",") {
+		i := strings.Index(setting, "=")
+		if i < 0 {
+			return dvara.ListenerGroup{}, fmt.Errorf("invalid listener group setting %q", setting)
+		}
+		if err := setListenerGroup(&group, setting[:i], setting[i+1:]); err != nil {
+			return dvara.ListenerGroup{}, fmt.Errorf("invalid listener group setting %q: %s", setting, err)
+		}
+	}
+	return group, nil
+}
+
+func setListenerGroup(group *dvara.ListenerGroup, name, value string) error {
+	var err error
+	switch name {
+	case "max_connections":
+		group.MaxConnections, err = parseUint(value)
+	case "min_idle_connections":
+		group.MinIdleConnections, err = parseUint(value)
+	case "max_pool_waiting":
+		group.MaxPoolWaiting, err = parseUint(value)
+	case "max_per_client_connections":
+		group.MaxPerClientConnections, err = parseUint(value)
+	case "pool_acquire_timeout":
+		group.PoolAcquireTimeout, err = time.ParseDuration(value)
+	case "server_idle_timeout":
+		group.ServerIdleTimeout, err = time.ParseDuration(value)
+	case "client_idle_timeout":
+		group.ClientIdleTimeout, err = time.ParseDuration(value)
+	case "message_timeout":
+		group.MessageTimeout, err = time.ParseDuration(value)
+	case "read_only":
+		group.ReadOnly, err = strconv.ParseBool(value)
+	default:
+		err = errors.New("unknown setting")
+	}
+	return err
+}
+
+func parseUint(s string) (uint, error) {
+	v, err := strconv.ParseUint(s, 10, 32)
+	return uint(v), err
+}
@@ -0,0 +1,214 @@
+package dvara
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// writeCommands are the commands that modify data, keyed by their lower case
+// name.
+var writeCommands = map[string]bool{
+	"insert":        true,
+	"update":        true,
+	"delete":        true,
+	"findandmodify": true,
+}
+
+// Command is the command carried by a message, parsed once and shared by the
+// rewriters, policies and extensions. Legacy op codes are described by the
+// command they are equivalent to, a plain OpQuery is a find.
+type Command struct {
+	// Database is the database the command runs against.
+	Database string
+
+	// Name is the name of the command, the first key of its arguments.
+	Name string
+
+	// Namespace is the "database.collection" the command operates on, it is
+	// empty for commands that don't operate on a collection.
+	Namespace string
+
+	// Args holds the command document, unwrapped from $query. For a plain
+	// OpQuery it is the query and for legacy writes it is empty.
+	Args bson.D
+
+	// The generic command fields, if present.
+	ReadPreference bson.D
+	LSID           interface{}
+	TxnNumber      *int64
+	WriteConcern   bson.D
+	Comment        interface{}
+}
+
+// Is tells us if this is the named command. Command names are case
+// insensitive.
+func (c *Command) Is(name string) bool {
+	return strings.EqualFold(c.Name, name)
+}
+
+// IsWrite tells us if the command modifies data.
+func (c *Command) IsWrite() bool {
+	return writeCommands[strings.ToLower(c.Name)]
+}
+
+// InTransaction tells us if the command is part of a multi-document
+// transaction.
+func (c *Command) InTransaction() bool {
+	return c.TxnNumber != nil && hasKey(c.Args, "autocommit")
+}
+
+// AppName returns the application name sent by the driver, if this is its
+// handshake.
+func (c *Command) AppName() string {
+	if !c.Is("isMaster") && !c.Is("hello") {
+		return ""
+	}
+	client, _ := c.Args.Map()["client"].(bson.D)
+	application, _ := client.Map()["application"].(bson.D)
+	name, _ := application.Map()["name"].(string)
+	return name
+}
+
+// parseCommand parses the command of a message. It returns nil for op codes
+// that don't carry one.
+func parseCommand(m *ProxiedMessage) (*Command, error) {
+	switch m.header.OpCode {
+	case OpQuery:
+		return parseQueryCommand(m)
+	case OpCommand:
+		name, err := m.GetCommandName()
+		if err != nil {
+			return nil, err
+		}
+		q, err := m.GetQuery()
+		if err != nil {
+			return nil, err
+		}
+		metadata, err := m.GetCommandMetadata()
+		if err != nil {
+			return nil, err
+		}
+		var meta struct {
+			ReadPreference bson.D `bson:"$readPreference"`
+		}
+		if err := bson.Unmarshal(metadata, &meta); err != nil {
+			return nil, err
+		}
+		db, _ := splitNamespace(m.fullCollectionName)
+		c := &Command{Database: db, Name: name, Args: *q, ReadPreference: meta.ReadPreference}
+		c.setFields()
+		return c, nil
+	case OpMsg:
+		q, err := m.GetQuery()
+		if err != nil {
+			return nil, err
+		}
+		db, _ := splitNamespace(m.fullCollectionName)
+		c := &Command{Database: db, Args: *q}
+		c.setFields()
+		return c, nil
+	case OpInsert, OpUpdate, OpDelete, OpGetMore:
+		ns, err := m.GetFullCollectionName()
+		if err != nil {
+			return nil, err
+		}
+		db, collection := splitNamespace(ns)
+		c := &Command{Database: db, Namespace: db + "." + collection}
+		switch m.header.OpCode {
+		case OpInsert:
+			c.Name = "insert"
+		case OpUpdate:
+			c.Name = "update"
+		case OpDelete:
+			c.Name = "delete"
+		case OpGetMore:
+			c.Name = "getMore"
+		}
+		return c, nil
+	case OpKillCursors:
+		// the cursor ids don't tell us the namespace
+		return &Command{Name: "killCursors"}, nil
+	}
+	return nil, nil
+}
+
+// parseQueryCommand parses an OpQuery, which is either a command against the
+// $cmd collection or a query.
+func parseQueryCommand(m *ProxiedMessage) (*Command, error) {
+	ns, err := m.GetFullCollectionName()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := m.GetQueryDoc()
+	if err != nil {
+		return nil, err
+	}
+	query, modifiers, err := unwrapQuery(doc)
+	if err != nil {
+		return nil, err
+	}
+	var args bson.D
+	if err := bson.Unmarshal(query.Data, &args); err != nil {
+		return nil, err
+	}
+
+	db, collection := splitNamespace(ns)
+	c := &Command{Database: db, Args: args}
+	if v, ok := lookupRaw(modifiers, "$readPreference"); ok {
+		if err := v.Unmarshal(&c.ReadPreference); err != nil {
+			return nil, err
+		}
+	}
+	if collection == "$cmd" {
+		c.setFields()
+		return c, nil
+	}
+
+	c.Name = "find"
+	c.Namespace = db + "." + collection
+	if v, ok := lookupRaw(modifiers, "$comment"); ok {
+		if err := v.Unmarshal(&c.Comment); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// setFields sets the name, namespace and generic fields from the arguments of
+// a command.
+func (c *Command) setFields() {
+	if len(c.Args) == 0 {
+		return
+	}
+	if c.Name == "" {
+		c.Name = c.Args[0].Name
+	}
+	collection, _ := c.Args[0].Value.(string)
+	for _, e := range c.Args {
+		switch e.Name {
+		case "collection":
+			// getMore names the collection separately
+			if c.Is("getMore") {
+				collection, _ = e.Value.(string)
+			}
+		case "$readPreference":
+			if c.ReadPreference == nil {
+				c.ReadPreference, _ = e.Value.(bson.D)
+			}
+		case "lsid":
+			c.LSID = e.Value
+		case "txnNumber":
+			if n, ok := e.Value.(int64); ok {
+				c.TxnNumber = &n
+			}
+		case "writeConcern":
+			c.WriteConcern, _ = e.Value.(bson.D)
+		case "comment":
+			c.Comment = e.Value
+		}
+	}
+	if collection != "" && c.Database != "" {
+		c.Namespace = c.Database + "." + collection
+	}
+}
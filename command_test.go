@@ -0,0 +1,222 @@
+package dvara
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func readCommand(t *testing.T, raw []byte) *Command {
+	r := bytes.NewReader(raw)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lastError LastError
+	message := NewProxiedMessage(h, fakeReadWriter{Reader: r}, fakeReadWriter{}, &lastError)
+	command, err := message.GetCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := message.GetCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != command {
+		t.Fatal("command was parsed more than once")
+	}
+	return command
+}
+
+func TestParseCommand(t *testing.T) {
+	t.Parallel()
+	lsid := bson.D{{Name: "id", Value: "x"}}
+	majority := bson.D{{Name: "w", Value: "majority"}}
+	secondary := bson.D{{Name: "mode", Value: "secondary"}}
+	txnNumber := int64(3)
+	cases := []struct {
+		Name     string
+		Raw      []byte
+		Expected Command
+	}{
+		{
+			Name: "wrapped query command",
+			Raw: fakeLegacyQuery(0, "admin.$cmd", 0, -1, bson.D{
+				{Name: "$query", Value: bson.D{{Name: "isMaster", Value: 1}}},
+				{Name: "$readPreference", Value: secondary},
+			}, nil),
+			Expected: Command{
+				Database:       "admin",
+				Name:           "isMaster",
+				Args:           bson.D{{Name: "isMaster", Value: 1}},
+				ReadPreference: secondary,
+			},
+		},
+		{
+			Name: "query command",
+			Raw: fakeLegacyQuery(0, "test.$cmd", 0, -1, bson.D{
+				{Name: "count", Value: "foo"},
+				{Name: "comment", Value: "hi"},
+			}, nil),
+			Expected: Command{
+				Database:  "test",
+				Name:      "count",
+				Namespace: "test.foo",
+				Args:      bson.D{{Name: "count", Value: "foo"}, {Name: "comment", Value: "hi"}},
+				Comment:   "hi",
+			},
+		},
+		{
+			Name: "query",
+			Raw: fakeLegacyQuery(0, "test.foo", 0, 0, bson.D{
+				{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}},
+				{Name: "$comment", Value: "hi"},
+			}, nil),
+			Expected: Command{
+				Database:  "test",
+				Name:      "find",
+				Namespace: "test.foo",
+				Args:      bson.D{{Name: "a", Value: 1}},
+				Comment:   "hi",
+			},
+		},
+		{
+			Name: "msg",
+			Raw: fakeMsg(&opMsg{sections: []MsgSection{{
+				Kind: SectionBody,
+				Documents: [][]byte{mustMarshal(bson.D{
+					{Name: "update", Value: "foo"},
+					{Name: "lsid", Value: lsid},
+					{Name: "txnNumber", Value: txnNumber},
+					{Name: "writeConcern", Value: majority},
+					{Name: "$db", Value: "test"},
+				})},
+			}}}),
+			Expected: Command{
+				Database:  "test",
+				Name:      "update",
+				Namespace: "test.foo",
+				Args: bson.D{
+					{Name: "update", Value: "foo"},
+					{Name: "lsid", Value: lsid},
+					{Name: "txnNumber", Value: txnNumber},
+					{Name: "writeConcern", Value: majority},
+					{Name: "$db", Value: "test"},
+				},
+				LSID:         lsid,
+				TxnNumber:    &txnNumber,
+				WriteConcern: majority,
+			},
+		},
+		{
+			Name: "command",
+			Raw: fakeCommand(
+				"test", "find",
+				bson.D{{Name: "find", Value: "foo"}},
+				bson.D{{Name: "$readPreference", Value: secondary}},
+			),
+			Expected: Command{
+				Database:       "test",
+				Name:           "find",
+				Namespace:      "test.foo",
+				Args:           bson.D{{Name: "find", Value: "foo"}},
+				ReadPreference: secondary,
+			},
+		},
+		{
+			Name: "legacy insert",
+			Raw:  fakeLegacyWrite(OpInsert, 0, "test.foo", mustMarshal(bson.M{"_id": 1})),
+			Expected: Command{
+				Database:  "test",
+				Name:      "insert",
+				Namespace: "test.foo",
+			},
+		},
+	}
+	for _, c := range cases {
+		command := readCommand(t, c.Raw)
+		if !reflect.DeepEqual(*command, c.Expected) {
+			t.Fatalf("for %s expected %+v but got %+v", c.Name, c.Expected, *command)
+		}
+	}
+}
+
+func TestCommandIsWrite(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name  string
+		Write bool
+	}{
+		{"insert", true},
+		{"findAndModify", true},
+		{"findandmodify", true},
+		{"find", false},
+		{"isMaster", false},
+	}
+	for _, c := range cases {
+		if (&Command{Name: c.Name}).IsWrite() != c.Write {
+			t.Fatalf("for %s expected %v", c.Name, c.Write)
+		}
+	}
+}
+
+func TestProxyQueryWrappedIsMaster(t *testing.T) {
+	t.Parallel()
+	p := &ProxyQuery{
+		IsMasterResponseRewriter: &IsMasterResponseRewriter{
+			ProxyMapper: fakeProxyMapper{m: map[string]string{"a": "1"}},
+			ReplyRW:     &ReplyRW{},
+		},
+	}
+	request := fakeLegacyQuery(querySlaveOk, "admin.$cmd", 0, -1, bson.D{
+		{Name: "$query", Value: bson.D{{Name: "isMaster", Value: 1}}},
+		{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondaryPreferred"}}},
+	}, nil)
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client, server bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(
+		h,
+		fakeReadWriter{Reader: r, Writer: &client},
+		fakeReadWriter{Reader: fakeSingleDocReply(bson.M{"me": "a"}), Writer: &server},
+		&lastError,
+	)
+	if err := p.Proxy(&message); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(request, server.Bytes()) {
+		t.Fatal("did not forward expected request")
+	}
+	var out bson.M
+	if _, _, _, err := (&ReplyRW{}).ReadOne(&client, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["me"] != "1" {
+		t.Fatalf("did not rewrite wrapped isMaster, got %v", out)
+	}
+}
+
+func TestCommandAppName(t *testing.T) {
+	t.Parallel()
+	client := bson.D{{Name: "application", Value: bson.D{{Name: "name", Value: "web"}}}}
+	cases := []struct {
+		Command Command
+		AppName string
+	}{
+		{Command{Name: "hello", Args: bson.D{{Name: "hello", Value: 1}, {Name: "client", Value: client}}}, "web"},
+		{Command{Name: "isMaster", Args: bson.D{{Name: "isMaster", Value: 1}, {Name: "client", Value: client}}}, "web"},
+		{Command{Name: "isMaster", Args: bson.D{{Name: "isMaster", Value: 1}}}, ""},
+		{Command{Name: "find", Args: bson.D{{Name: "find", Value: "foo"}, {Name: "client", Value: client}}}, ""},
+	}
+	for _, c := range cases {
+		if name := c.Command.AppName(); name != c.AppName {
+			t.Fatalf("for %s expected %q but got %q", c.Command.Name, c.AppName, name)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package dvara
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Look at https://github.com/mongodb/specifications/blob/master/source/compression/OP_COMPRESSED.rst
+// for the OP_COMPRESSED format.
+
+// Compressor identifies the algorithm used to compress an OpCompressed
+// message.
+type Compressor byte
+
+// The compressors known to the wire protocol.
+const (
+	CompressorNoop   = Compressor(0)
+	CompressorSnappy = Compressor(1)
+	CompressorZlib   = Compressor(2)
+	CompressorZstd   = Compressor(3)
+)
+
+// String returns the name used for the compressor in the handshake.
+func (c Compressor) String() string {
+	switch c {
+	default:
+		return "unknown"
+	case CompressorNoop:
+		return "noop"
+	case CompressorSnappy:
+		return "snappy"
+	case CompressorZlib:
+		return "zlib"
+	case CompressorZstd:
+		return "zstd"
+	}
+}
+
+// compressedPrefixLen is the size of the fields between the header and the
+// compressed message: the original op code, the uncompressed size and the
+// compressor id.
+const compressedPrefixLen = 9
+
+var (
+	errCompressedTooShort = errors.New("dvara: OP_COMPRESSED too short")
+	errCompressedSize     = errors.New("dvara: OP_COMPRESSED uncompressed size mismatch")
+
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdErr     error
+)
+
+// supportedCompressor returns the Compressor for the given handshake name if
+// dvara supports it.
+func supportedCompressor(name string) (Compressor, bool) {
+	for _, c := range []Compressor{CompressorSnappy, CompressorZlib, CompressorZstd} {
+		if c.String() == name {
+			return c, true
+		}
+	}
+	return CompressorNoop, false
+}
+
+func initZstd() {
+	zstdEncoder, zstdErr = zstd.NewWriter(nil)
+}
+
+// compress compresses b with the given compressor.
+func compress(c Compressor, b []byte) ([]byte, error) {
+	switch c {
+	case CompressorNoop:
+		return b, nil
+	case CompressorSnappy:
+		return snappy.Encode(nil, b), nil
+	case CompressorZlib:
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressorZstd:
+		if zstdOnce.Do(initZstd); zstdErr != nil {
+			return nil, zstdErr
+		}
+		return zstdEncoder.EncodeAll(b, nil), nil
+	}
+	return nil, fmt.Errorf("dvara: unsupported compressor %d", c)
+}
+
+// decompress decompresses b with the given compressor. The result must be
+// exactly size bytes, and no longer than the limits allow.
+func decompress(c Compressor, b []byte, size int, limits *wireLimits) ([]byte, error) {
+	var out []byte
+	var err error
+	switch c {
+	default:
+		return nil, fmt.Errorf("dvara: unsupported compressor %d", c)
+	case CompressorNoop:
+		out = b
+	case CompressorSnappy:
+		var n int
+		if n, err = snappy.DecodedLen(b); err != nil {
+			return nil, err
+		}
+		if n != size {
+			return nil, errCompressedSize
+		}
+		out, err = snappy.Decode(nil, b)
+	case CompressorZlib:
+		var r io.ReadCloser
+		if r, err = zlib.NewReader(bytes.NewReader(b)); err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out = make([]byte, size)
+		if _, err = io.ReadFull(r, out); err != nil {
+			return nil, err
+		}
+		// there must be nothing left once we have read size bytes
+		if n, _ := io.CopyN(ioutil.Discard, r, 1); n != 0 {
+			return nil, errCompressedSize
+		}
+	case CompressorZstd:
+		// the frame may claim any size, it is decoded no further than one byte
+		// past what the message says, nor buffered beyond the longest message
+		var r *zstd.Decoder
+		if r, err = zstd.NewReader(
+			bytes.NewReader(b),
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(limits.messageLength())),
+		); err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out = make([]byte, size)
+		if _, err = io.ReadFull(r, out); err != nil {
+			return nil, err
+		}
+		if n, _ := io.CopyN(ioutil.Discard, r, 1); n != 0 {
+			return nil, errCompressedSize
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != size {
+		return nil, errCompressedSize
+	}
+	return out, nil
+}
+
+// compressMessage returns the wire representation of an OpCompressed message
+// wrapping the given message.
+func compressMessage(c Compressor, h *messageHeader, body []byte) ([]byte, error) {
+	data, err := compress(c, body)
+	if err != nil {
+		return nil, err
+	}
+	ch := messageHeader{
+		MessageLength: int32(headerLen + compressedPrefixLen + len(data)),
+		RequestID:     h.RequestID,
+		ResponseTo:    h.ResponseTo,
+		OpCode:        OpCompressed,
+	}
+	b := make([]byte, 0, ch.MessageLength)
+	b = append(b, ch.ToWire()...)
+	b = addInt32(b, int32(h.OpCode))
+	b = addInt32(b, int32(len(body)))
+	b = append(b, byte(c))
+	return append(b, data...), nil
+}
+
+// decompressMessage takes the header and body of an OpCompressed message and
+// returns the header and body of the original message along with the
+// compressor that was used. The original message must be within the limits.
+func decompressMessage(h *messageHeader, body []byte, limits *wireLimits) (*messageHeader, []byte, Compressor, error) {
+	if len(body) < compressedPrefixLen {
+		return nil, nil, CompressorNoop, errCompressedTooShort
+	}
+	size := getInt32(body, 4)
+	if size < 0 {
+		return nil, nil, CompressorNoop, errCompressedSize
+	}
+	if size > limits.messageLength()-headerLen {
+		return nil, nil, CompressorNoop, errMessageTooLong
+	}
+	c := Compressor(body[8])
+	original, err := decompress(c, body[compressedPrefixLen:], int(size), limits)
+	if err != nil {
+		return nil, nil, CompressorNoop, err
+	}
+	oh := &messageHeader{
+		MessageLength: headerLen + size,
+		RequestID:     h.RequestID,
+		ResponseTo:    h.ResponseTo,
+		OpCode:        OpCode(getInt32(body, 0)),
+	}
+	return oh, original, c, nil
+}
+
+// compressedConn wraps a client connection for the duration of a single
+// OpCompressed request. Reads return the decompressed request body, and
+// writes are buffered so that Flush can send the replies compressed with the
+// compressor the client used.
+type compressedConn struct {
+	net.Conn
+	compressor Compressor
+	request    *bytes.Reader
+	replies    bytes.Buffer
+}
+
+// readCompressed reads the rest of an OpCompressed message from the client
+// and returns the header of the original message along with a connection to
+// read its body from.
+func readCompressed(c net.Conn, h *messageHeader, limits *wireLimits) (*messageHeader, *compressedConn, error) {
+	size := h.MessageLength - headerLen
+	if size < 0 {
+		return nil, nil, errMessageLength
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(c, body); err != nil {
+		return nil, nil, err
+	}
+	oh, original, compressor, err := decompressMessage(h, body, limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	cc := &compressedConn{
+		Conn:       c,
+		compressor: compressor,
+		request:    bytes.NewReader(original),
+	}
+	return oh, cc, nil
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	return c.request.Read(b)
+}
+
+func (c *compressedConn) Write(b []byte) (int, error) {
+	return c.replies.Write(b)
+}
+
+// Flush compresses the buffered replies and writes them to the client.
+func (c *compressedConn) Flush() error {
+	for c.replies.Len() > 0 {
+		h, err := readHeader(&c.replies)
+		if err != nil {
+			return err
+		}
+		size := int(h.MessageLength - headerLen)
+		if size < 0 || size > c.replies.Len() {
+			return errMessageLength
+		}
+		b, err := compressMessage(c.compressor, h, c.replies.Next(size))
+		if err != nil {
+			return err
+		}
+		if _, err := c.Conn.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package dvara
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCompressorStrings(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Compressor Compressor
+		String     string
+	}{
+		{CompressorNoop, "noop"},
+		{CompressorSnappy, "snappy"},
+		{CompressorZlib, "zlib"},
+		{CompressorZstd, "zstd"},
+		{Compressor(42), "unknown"},
+	}
+	for _, c := range cases {
+		if c.Compressor.String() != c.String {
+			t.Fatalf("for compressor %d expected %s but got %s", c.Compressor, c.String, c.Compressor)
+		}
+	}
+}
+
+func TestCompressMessageRoundTrip(t *testing.T) {
+	t.Parallel()
+	body := append([]byte{0, 0, 0, 0, 0}, mustMarshal(bson.M{"find": "foo", "$db": "test"})...)
+	h := &messageHeader{
+		MessageLength: int32(headerLen + len(body)),
+		RequestID:     42,
+		OpCode:        OpMsg,
+	}
+	for _, c := range []Compressor{CompressorNoop, CompressorSnappy, CompressorZlib, CompressorZstd} {
+		b, err := compressMessage(c, h, body)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		r := bytes.NewReader(b)
+		ch, err := readHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch.OpCode != OpCompressed || int(ch.MessageLength) != len(b) {
+			t.Fatalf("%s: did not get expected header, got %s", c, ch)
+		}
+		oh, cc, err := readCompressed(fakeReadWriter{Reader: r}, ch, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		if *oh != *h {
+			t.Fatalf("%s: did not get original header, got %s", c, oh)
+		}
+		if cc.compressor != c {
+			t.Fatalf("%s: did not get expected compressor, got %s", c, cc.compressor)
+		}
+		var out bytes.Buffer
+		if _, err := out.ReadFrom(cc); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, out.Bytes()) {
+			t.Fatalf("%s: did not get original body, got %v", c, out.Bytes())
+		}
+	}
+}
+
+func TestDecompressMessageErrors(t *testing.T) {
+	t.Parallel()
+	h := &messageHeader{OpCode: OpCompressed}
+	cases := []struct {
+		Name  string
+		Body  []byte
+		Error string
+	}{
+		{
+			Name:  "too short",
+			Body:  []byte{0xd4, 0x07, 0, 0},
+			Error: errCompressedTooShort.Error(),
+		},
+		{
+			Name:  "unknown compressor",
+			Body:  []byte{0xd4, 0x07, 0, 0, 1, 0, 0, 0, 9, 1},
+			Error: "dvara: unsupported compressor 9",
+		},
+		{
+			Name:  "size mismatch",
+			Body:  []byte{0xd4, 0x07, 0, 0, 2, 0, 0, 0, 0, 1},
+			Error: errCompressedSize.Error(),
+		},
+		{
+			Name:  "too long",
+			Body:  []byte{0xd4, 0x07, 0, 0, 0, 0, 0, 0x7f, 0},
+			Error: errMessageTooLong.Error(),
+		},
+		{
+			Name:  "negative size",
+			Body:  []byte{0xd4, 0x07, 0, 0, 0, 0, 0, 0x80, 0},
+			Error: errCompressedSize.Error(),
+		},
+	}
+	for _, c := range cases {
+		_, _, _, err := decompressMessage(h, c.Body, nil)
+		if err == nil || err.Error() != c.Error {
+			t.Errorf("did not get expected error for case %s, instead got %v", c.Name, err)
+		}
+	}
+}
+
+// TestDecompressBomb isn't parallel, other tests would count towards the
+// memory it allocates.
+func TestDecompressBomb(t *testing.T) {
+	// frames that expand far beyond the size the message declares
+	big := make([]byte, 64<<20)
+	for _, c := range []Compressor{CompressorZlib, CompressorZstd} {
+		b, err := compress(c, big)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := decompress(c, b, 100, nil); err != errCompressedSize {
+			t.Fatalf("%s: did not get expected error, got %v", c, err)
+		}
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+			t.Fatalf("%s: allocated %d bytes to decompress 100", c, alloc)
+		}
+	}
+}
+
+func TestCompressedConnFlush(t *testing.T) {
+	t.Parallel()
+	var client bytes.Buffer
+	cc := &compressedConn{
+		Conn:       fakeReadWriter{Writer: &client},
+		compressor: CompressorSnappy,
+	}
+
+	// replies are written in pieces, as they are when proxied
+	reply := fakeMsg(&opMsg{
+		sections: []MsgSection{
+			{Kind: SectionBody, Documents: [][]byte{mustMarshal(bson.M{"ok": 1})}},
+		},
+	})
+	for _, b := range [][]byte{reply[:headerLen], reply[headerLen:], reply} {
+		if _, err := cc.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if client.Len() != 0 {
+		t.Fatal("replies were not buffered")
+	}
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		h, err := readHeader(&client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := client.Next(int(h.MessageLength - headerLen))
+		oh, original, c, err := decompressMessage(h, body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != CompressorSnappy || oh.OpCode != OpMsg {
+			t.Fatalf("did not get expected reply, got %s with %s", oh, c)
+		}
+		if !bytes.Equal(reply, append(oh.ToWire(), original...)) {
+			t.Fatal("did not get original reply back")
+		}
+	}
+	if client.Len() != 0 {
+		t.Fatalf("unexpected trailing bytes %v", client.Bytes())
+	}
+}
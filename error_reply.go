@@ -0,0 +1,153 @@
+package dvara
+
+import (
+	"context"
+	"net"
+)
+
+// The server error codes the proxy answers with when it can't proxy a message.
+const (
+	errCodeHostUnreachable    = 6
+	errCodeUnauthorized       = 13
+	errCodeNetworkTimeout     = 89
+	errCodeShutdownInProgress = 91
+	errCodeOperationFailed    = 96
+	errCodeExceededTimeLimit  = 262
+)
+
+// The error labels that tell drivers an operation may be retried.
+const (
+	retryableWriteError            = "RetryableWriteError"
+	transientTransactionError      = "TransientTransactionError"
+	unknownTransactionCommitResult = "UnknownTransactionCommitResult"
+)
+
+// proxyError is an error the proxy answers a message with in place of the
+// server.
+type proxyError struct {
+	code      int
+	msg       string
+	retryable bool
+}
+
+func (e *proxyError) Error() string {
+	return e.msg
+}
+
+var (
+	errTooManyClientConnections = &proxyError{
+		code: errCodeOperationFailed,
+		msg:  "too many connections from client",
+	}
+	errProxyShutdown = &proxyError{
+		code:      errCodeShutdownInProgress,
+		msg:       "proxy is shutting down",
+		retryable: true,
+	}
+	errPoolExhaustedReply = &proxyError{
+		code:      errCodeExceededTimeLimit,
+		msg:       "pool exhausted",
+		retryable: true,
+	}
+	errPoolShedReply = &proxyError{
+		code:      errCodeExceededTimeLimit,
+		msg:       "pool overloaded, lower priority clients shed",
+		retryable: true,
+	}
+	errBackendUnreachable = &proxyError{
+		code:      errCodeHostUnreachable,
+		msg:       "backend unreachable",
+		retryable: true,
+	}
+	errBackendUnavailable = &proxyError{
+		code:      errCodeHostUnreachable,
+		msg:       "backend unavailable, circuit breaker open",
+		retryable: true,
+	}
+	errBackendTimeout = &proxyError{
+		code:      errCodeNetworkTimeout,
+		msg:       "backend timed out",
+		retryable: true,
+	}
+)
+
+// backendError returns the error to answer a message with when getting a
+// server connection, or proxying the message over it, failed.
+func backendError(err error) *proxyError {
+	switch err {
+	case errPoolClosed:
+		return errProxyShutdown
+	case errPoolExhausted, context.DeadlineExceeded:
+		return errPoolExhaustedReply
+	case errPoolShed:
+		return errPoolShedReply
+	case errBreakerOpen:
+		return errBackendUnavailable
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return errBackendTimeout
+	}
+	return errBackendUnreachable
+}
+
+// vetoError returns the error to answer a message vetoed by an extension with.
+func vetoError(err error) *proxyError {
+	return &proxyError{code: errCodeUnauthorized, msg: err.Error()}
+}
+
+// labels returns the error labels for a reply to the given command, which may
+// be nil if it wasn't parsed. Only writes are labeled retryable. A transaction
+// may only be rerun if the command never reached the server, a commit that
+// may have is labeled with an unknown result instead.
+func (e *proxyError) labels(command *Command, forwarded bool) []string {
+	if !e.retryable || command == nil {
+		return nil
+	}
+	var labels []string
+	commit := command.Is("commitTransaction")
+	if command.IsWrite() || commit || command.Is("abortTransaction") {
+		labels = append(labels, retryableWriteError)
+	}
+	switch {
+	case commit:
+		labels = append(labels, unknownTransactionCommitResult)
+	case command.InTransaction() && !forwarded && !command.Is("abortTransaction"):
+		labels = append(labels, transientTransactionError)
+	}
+	return labels
+}
+
+// requestConn tracks the client side of a message while it is proxied, to
+// tell if the client can still be sent an error reply when proxying fails.
+type requestConn struct {
+	net.Conn
+	read    int64
+	written int64
+	err     error
+}
+
+func (c *requestConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read += int64(n)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *requestConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written += int64(n)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// Flush flushes the replies buffered by the connection it wraps, if any.
+func (c *requestConn) Flush() error {
+	if f, ok := c.Conn.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package dvara
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestBackendError(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Error    error
+		Expected *proxyError
+	}{
+		{errPoolClosed, errProxyShutdown},
+		{errPoolExhausted, errPoolExhaustedReply},
+		{context.DeadlineExceeded, errPoolExhaustedReply},
+		{errPoolShed, errPoolShedReply},
+		{errBreakerOpen, errBackendUnavailable},
+		{timeoutError{}, errBackendTimeout},
+		{&net.OpError{Op: "dial", Err: errors.New("refused")}, errBackendUnreachable},
+		{errors.New("could not connect"), errBackendUnreachable},
+	}
+	for _, c := range cases {
+		if actual := backendError(c.Error); actual != c.Expected {
+			t.Fatalf("for %v expected %v but got %v", c.Error, c.Expected, actual)
+		}
+	}
+}
+
+func TestProxyErrorLabels(t *testing.T) {
+	t.Parallel()
+	txnNumber := int64(1)
+	inTransaction := func(name string) *Command {
+		return &Command{
+			Name:      name,
+			Args:      bson.D{{Name: name, Value: "foo"}, {Name: "autocommit", Value: false}},
+			TxnNumber: &txnNumber,
+		}
+	}
+	cases := []struct {
+		Error     *proxyError
+		Command   *Command
+		Forwarded bool
+		Expected  []string
+	}{
+		{errTooManyClientConnections, inTransaction("insert"), false, nil},
+		{errBackendUnreachable, nil, false, nil},
+		{errBackendUnreachable, &Command{Name: "find"}, false, nil},
+		{errBackendUnreachable, &Command{Name: "insert"}, true, []string{retryableWriteError}},
+		{errBackendUnreachable, inTransaction("find"), false, []string{transientTransactionError}},
+		{errBackendUnreachable, inTransaction("insert"), false, []string{retryableWriteError, transientTransactionError}},
+		{errBackendTimeout, inTransaction("insert"), true, []string{retryableWriteError}},
+		{errBackendTimeout, inTransaction("commitTransaction"), true, []string{retryableWriteError, unknownTransactionCommitResult}},
+		{errPoolExhaustedReply, inTransaction("commitTransaction"), false, []string{retryableWriteError, unknownTransactionCommitResult}},
+		{errBackendTimeout, inTransaction("abortTransaction"), false, []string{retryableWriteError}},
+	}
+	for _, c := range cases {
+		if actual := c.Error.labels(c.Command, c.Forwarded); !reflect.DeepEqual(actual, c.Expected) {
+			t.Fatalf("for %v %+v expected %v but got %v", c.Error, c.Command, c.Expected, actual)
+		}
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name     string
+		Request  []byte
+		Flags    int32
+		Expected bson.M
+	}{
+		{
+			Name:     "query command",
+			Request:  fakeLegacyQuery(0, "admin.$cmd", 0, -1, bson.M{"isMaster": 1}, nil),
+			Expected: bson.M{"ok": 0, "errmsg": "backend unreachable", "code": 6, "errorLabels": []interface{}{"RetryableWriteError"}},
+		},
+		{
+			Name:     "query",
+			Request:  fakeLegacyQuery(0, "test.foo", 0, 0, bson.M{"a": 1}, nil),
+			Flags:    replyQueryFailure,
+			Expected: bson.M{"$err": "backend unreachable", "code": 6},
+		},
+		{
+			Name:     "command",
+			Request:  fakeCommand("test", "ping", bson.M{"ping": 1}, bson.M{}),
+			Expected: bson.M{"ok": 0, "errmsg": "backend unreachable", "code": 6, "errorLabels": []interface{}{"RetryableWriteError"}},
+		},
+		{
+			Name: "msg",
+			Request: fakeMsg(&opMsg{sections: []MsgSection{{
+				Kind:      SectionBody,
+				Documents: [][]byte{mustMarshal(bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})},
+			}}}),
+			Expected: bson.M{"ok": 0, "errmsg": "backend unreachable", "code": 6, "errorLabels": []interface{}{"RetryableWriteError"}},
+		},
+	}
+	for _, c := range cases {
+		r := bytes.NewReader(c.Request)
+		h, err := readHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var client bytes.Buffer
+		var lastError LastError
+		message := NewProxiedMessage(h, fakeReadWriter{Reader: r, Writer: &client}, fakeReadWriter{}, &lastError)
+		if err := message.ReplyError(errCodeHostUnreachable, "backend unreachable", retryableWriteError); err != nil {
+			t.Fatal(err)
+		}
+		if r.Len() != 0 {
+			t.Fatalf("for %s did not read the entire request", c.Name)
+		}
+
+		var out bson.M
+		rh, prefix, _, err := (&ReplyRW{}).ReadOne(&client, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rh.ResponseTo != h.RequestID {
+			t.Fatalf("for %s did not get expected header, got %s", c.Name, rh)
+		}
+		if rh.OpCode == OpReply && getInt32(prefix, 0) != c.Flags {
+			t.Fatalf("for %s did not get expected flags, got %d", c.Name, getInt32(prefix, 0))
+		}
+		if !reflect.DeepEqual(out, c.Expected) {
+			t.Fatalf("for %s expected %v but got %v", c.Name, c.Expected, out)
+		}
+	}
+}
+
+func TestReplyErrorNoReply(t *testing.T) {
+	t.Parallel()
+	request := fakeMsg(&opMsg{
+		flags: MsgMoreToCome,
+		sections: []MsgSection{{
+			Kind:      SectionBody,
+			Documents: [][]byte{mustMarshal(bson.D{{Name: "insert", Value: "foo"}, {Name: "$db", Value: "test"}})},
+		}},
+	})
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lastError LastError
+	message := NewProxiedMessage(h, fakeReadWriter{Reader: r}, fakeReadWriter{}, &lastError)
+	if err := message.ReplyError(errCodeHostUnreachable, "backend unreachable"); err != errNoReply {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+}
+
+func TestProxyReplyError(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{}, Group: ListenerGroup{MessageTimeout: time.Second}}
+
+	// part of the message was read, and possibly forwarded, before proxying it
+	// failed
+	request := fakeCommand("test", "ping", bson.M{"ping": 1}, bson.M{})
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client bytes.Buffer
+	rc := &requestConn{Conn: fakeReadWriter{Reader: r, Writer: &client}}
+	var lastError LastError
+	message := NewProxiedMessage(h, rc, fakeReadWriter{}, &lastError)
+	if _, err := message.GetCommandName(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Read(make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if !p.replyError(rc, &message, errBackendUnreachable) {
+		t.Fatal("did not reply")
+	}
+	if r.Len() != 0 {
+		t.Fatal("did not read the entire request")
+	}
+	var out bson.M
+	if _, _, _, err := (&ReplyRW{}).ReadOne(&client, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["code"] != errCodeHostUnreachable {
+		t.Fatalf("did not get expected reply, got %v", out)
+	}
+
+	// a reply was already partially written
+	rc.err = nil
+	if p.replyError(rc, &message, errBackendUnreachable) {
+		t.Fatal("replied after a reply was written")
+	}
+}
+
+func TestProxyReplyErrorTransaction(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{}, Group: ListenerGroup{MessageTimeout: time.Second}}
+	request := fakeMsg(&opMsg{sections: []MsgSection{{
+		Kind: SectionBody,
+		Documents: [][]byte{mustMarshal(bson.D{
+			{Name: "insert", Value: "foo"},
+			{Name: "txnNumber", Value: int64(1)},
+			{Name: "autocommit", Value: false},
+			{Name: "$db", Value: "test"},
+		})},
+	}}})
+
+	// the transaction may only be rerun if the insert never reached the server
+	cases := []struct {
+		Server   net.Conn
+		Expected []interface{}
+	}{
+		{nil, []interface{}{retryableWriteError, transientTransactionError}},
+		{fakeReadWriter{}, []interface{}{retryableWriteError}},
+	}
+	for _, c := range cases {
+		r := bytes.NewReader(request)
+		h, err := readHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var client bytes.Buffer
+		rc := &requestConn{Conn: fakeReadWriter{Reader: r, Writer: &client}}
+		var lastError LastError
+		message := NewProxiedMessage(h, rc, c.Server, &lastError)
+		if _, err := message.GetCommand(); err != nil {
+			t.Fatal(err)
+		}
+		if !p.replyError(rc, &message, errBackendTimeout) {
+			t.Fatal("did not reply")
+		}
+		_, _, out := readMsgReply(t, client.Bytes())
+		if !reflect.DeepEqual(out["errorLabels"], c.Expected) {
+			t.Fatalf("expected labels %v but got %v", c.Expected, out["errorLabels"])
+		}
+	}
+}
+
+func TestProxyReplyErrorLegacyWrite(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{}, Group: ListenerGroup{MessageTimeout: time.Second}}
+	request := fakeLegacyWrite(OpInsert, 0, "test.foo", mustMarshal(bson.M{"_id": 1}))
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client bytes.Buffer
+	rc := &requestConn{Conn: fakeReadWriter{Reader: r, Writer: &client}}
+	var lastError LastError
+	message := NewProxiedMessage(h, rc, fakeReadWriter{}, &lastError)
+	if !p.replyError(rc, &message, errBackendUnreachable) {
+		t.Fatal("did not handle error")
+	}
+	if r.Len() != 0 || client.Len() != 0 {
+		t.Fatal("did not read the entire request without replying")
+	}
+	if !lastError.Exists() {
+		t.Fatal("did not cache the error for getLastError")
+	}
+}
@@ -92,7 +92,8 @@ func (r *ReplicaSet) HandleFailure() {
 func (r *ReplicaSet) runCheck(errChan chan<- error) {
 	// dvara opens a port per member of replica set, we don't expect to run more than 5 members in replica set
   addrs := []string{}
-  for i := r.PortStart; i <= r.PortEnd; i++ {
+  g := r.listenerGroups()[0]
+  for i := g.PortStart; i <= g.PortEnd; i++ {
     addrs = append(addrs, fmt.Sprintf("127.0.0.1:%d", i))
   }
 	err := checkReplSetStatus(addrs, r.Name, r.HealthCheckTLSConfig)
@@ -0,0 +1,580 @@
+package dvara
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The flags of the legacy write op codes.
+const (
+	insertContinueOnError = int32(1 << 0)
+	updateUpsert          = int32(1 << 0)
+	updateMulti           = int32(1 << 1)
+	deleteSingleRemove    = int32(1 << 0)
+)
+
+// The flags of OpQuery.
+const (
+	queryTailable        = int32(1 << 1)
+	querySlaveOk         = int32(1 << 2)
+	queryNoCursorTimeout = int32(1 << 4)
+	queryAwaitData       = int32(1 << 5)
+	queryExhaust         = int32(1 << 6)
+	queryPartial         = int32(1 << 7)
+)
+
+// The response flags of OpReply.
+const (
+	replyCursorNotFound = int32(1 << 0)
+	replyQueryFailure   = int32(1 << 1)
+)
+
+// cursorNotFoundCode is the error code of a getMore for an unknown cursor.
+const cursorNotFoundCode = 43
+
+// The BSON element kinds needed to build raw values.
+const (
+	bsonDocumentKind = 0x03
+	bsonBooleanKind  = 0x08
+)
+
+var (
+	errLegacyUpdate      = errors.New("dvara: OP_UPDATE needs a selector and an update document")
+	errLegacyDelete      = errors.New("dvara: OP_DELETE needs a selector document")
+	errLegacyGetMore     = errors.New("dvara: OP_GETMORE too short")
+	errLegacyKillCursors = errors.New("dvara: OP_KILL_CURSORS too short")
+
+	// queryModifiers maps the OpQuery modifiers to the find command fields.
+	queryModifiers = map[string]string{
+		"$orderby":     "sort",
+		"$hint":        "hint",
+		"$comment":     "comment",
+		"$maxTimeMS":   "maxTimeMS",
+		"$max":         "max",
+		"$min":         "min",
+		"$returnKey":   "returnKey",
+		"$showDiskLoc": "showRecordId",
+	}
+
+	// secondaryPreferred is the read preference implied by the slaveOk flag.
+	secondaryPreferred = bson.D{{Name: "mode", Value: "secondaryPreferred"}}
+
+	// noLastError is what getLastError returns when there was no error.
+	noLastError = bson.D{
+		{Name: "n", Value: 0},
+		{Name: "err", Value: nil},
+		{Name: "ok", Value: 1},
+	}
+)
+
+type writeError struct {
+	Index  int    `bson:"index"`
+	Code   int    `bson:"code"`
+	ErrMsg string `bson:"errmsg"`
+}
+
+type upsertedID struct {
+	Index int         `bson:"index"`
+	ID    interface{} `bson:"_id"`
+}
+
+type writeCommandResponse struct {
+	Ok                float64      `bson:"ok"`
+	ErrMsg            string       `bson:"errmsg"`
+	Code              int          `bson:"code"`
+	N                 int          `bson:"n"`
+	Upserted          []upsertedID `bson:"upserted"`
+	WriteErrors       []writeError `bson:"writeErrors"`
+	WriteConcernError *writeError  `bson:"writeConcernError"`
+}
+
+// lastError returns the document getLastError would have returned after the
+// legacy write with the given op code.
+func (r *writeCommandResponse) lastError(op OpCode) bson.D {
+	// getLastError never counted inserted documents.
+	n := r.N
+	if op == OpInsert {
+		n = 0
+	}
+	d := bson.D{{Name: "n", Value: n}}
+
+	var e *writeError
+	switch {
+	case r.Ok == 0:
+		e = &writeError{Code: r.Code, ErrMsg: r.ErrMsg}
+	case len(r.WriteErrors) > 0:
+		e = &r.WriteErrors[0]
+	case r.WriteConcernError != nil:
+		e = r.WriteConcernError
+	}
+	if e != nil {
+		d = append(d, bson.DocElem{Name: "err", Value: e.ErrMsg}, bson.DocElem{Name: "code", Value: e.Code})
+	} else {
+		d = append(d, bson.DocElem{Name: "err", Value: nil})
+	}
+
+	if op == OpUpdate {
+		d = append(d, bson.DocElem{Name: "updatedExisting", Value: n > 0 && len(r.Upserted) == 0})
+		if len(r.Upserted) > 0 {
+			d = append(d, bson.DocElem{Name: "upserted", Value: r.Upserted[0].ID})
+		}
+	}
+	return append(d, bson.DocElem{Name: "ok", Value: 1})
+}
+
+type cursorResponse struct {
+	Ok     float64 `bson:"ok"`
+	ErrMsg string  `bson:"errmsg"`
+	Code   int     `bson:"code"`
+	Cursor struct {
+		ID         int64      `bson:"id"`
+		NS         string     `bson:"ns"`
+		FirstBatch []bson.Raw `bson:"firstBatch"`
+		NextBatch  []bson.Raw `bson:"nextBatch"`
+	} `bson:"cursor"`
+}
+
+// documents returns the documents of the batch in the response.
+func (r *cursorResponse) documents() [][]byte {
+	batch := r.Cursor.FirstBatch
+	if batch == nil {
+		batch = r.Cursor.NextBatch
+	}
+	docs := make([][]byte, len(batch))
+	for i, doc := range batch {
+		docs[i] = doc.Data
+	}
+	return docs
+}
+
+// legacyCursor is a cursor a client opened with a translated OpQuery.
+type legacyCursor struct {
+	ns       string
+	returned int32
+}
+
+// legacyCursors holds the cursors opened by one client. OpGetMore needs the
+// number of documents returned so far and OpKillCursors needs the namespace,
+// neither of which the commands provide.
+type legacyCursors map[int64]*legacyCursor
+
+// advance records that n more documents were returned for the cursor and
+// returns the number returned before. A cursor id of zero means the cursor
+// was exhausted.
+func (c legacyCursors) advance(id, next int64, ns string, n int32) int32 {
+	var startingFrom int32
+	if cursor, ok := c[id]; ok {
+		startingFrom = cursor.returned
+		ns = cursor.ns
+		delete(c, id)
+	}
+	if next != 0 && c != nil {
+		c[next] = &legacyCursor{ns: ns, returned: startingFrom + n}
+	}
+	return startingFrom
+}
+
+// LegacyOpTranslator translates legacy op codes into the equivalent commands
+// for servers that no longer support them.
+type LegacyOpTranslator struct {
+}
+
+// TranslateWrite sends an OpInsert, OpUpdate or OpDelete to the server as the
+// equivalent write command, and caches the result for the following
+// getLastError.
+func (t *LegacyOpTranslator) TranslateWrite(m *ProxiedMessage) error {
+	fullCollectionName, err := m.GetFullCollectionName()
+	if err != nil {
+		return err
+	}
+	// the int32 before the collection name, flags for an insert and zero
+	// otherwise
+	first := getInt32(m.parts[1], 0)
+	rest, err := m.readRemaining()
+	if err != nil {
+		return err
+	}
+
+	db, collection := splitNamespace(fullCollectionName)
+	var cmd bson.D
+	var statements MsgSection
+	switch m.header.OpCode {
+	case OpInsert:
+		docs, err := splitDocuments(rest)
+		if err != nil {
+			return err
+		}
+		cmd = bson.D{
+			{Name: "insert", Value: collection},
+			{Name: "ordered", Value: first&insertContinueOnError == 0},
+		}
+		statements = MsgSection{Kind: SectionDocumentSequence, Identifier: "documents", Documents: docs}
+	case OpUpdate:
+		if len(rest) < 4 {
+			return errLegacyUpdate
+		}
+		flags := getInt32(rest, 0)
+		docs, err := splitDocuments(rest[4:])
+		if err != nil {
+			return err
+		}
+		if len(docs) != 2 {
+			return errLegacyUpdate
+		}
+		update, err := bson.Marshal(bson.D{
+			{Name: "q", Value: bson.Raw{Kind: bsonDocumentKind, Data: docs[0]}},
+			{Name: "u", Value: bson.Raw{Kind: bsonDocumentKind, Data: docs[1]}},
+			{Name: "upsert", Value: flags&updateUpsert != 0},
+			{Name: "multi", Value: flags&updateMulti != 0},
+		})
+		if err != nil {
+			return err
+		}
+		cmd = bson.D{
+			{Name: "update", Value: collection},
+			{Name: "ordered", Value: true},
+		}
+		statements = MsgSection{Kind: SectionDocumentSequence, Identifier: "updates", Documents: [][]byte{update}}
+	case OpDelete:
+		if len(rest) < 4 {
+			return errLegacyDelete
+		}
+		flags := getInt32(rest, 0)
+		docs, err := splitDocuments(rest[4:])
+		if err != nil {
+			return err
+		}
+		if len(docs) != 1 {
+			return errLegacyDelete
+		}
+		limit := 0
+		if flags&deleteSingleRemove != 0 {
+			limit = 1
+		}
+		del, err := bson.Marshal(bson.D{
+			{Name: "q", Value: bson.Raw{Kind: bsonDocumentKind, Data: docs[0]}},
+			{Name: "limit", Value: limit},
+		})
+		if err != nil {
+			return err
+		}
+		cmd = bson.D{
+			{Name: "delete", Value: collection},
+			{Name: "ordered", Value: true},
+		}
+		statements = MsgSection{Kind: SectionDocumentSequence, Identifier: "deletes", Documents: [][]byte{del}}
+	default:
+		return errors.New("dvara: " + m.header.OpCode.String() + " is not a legacy write")
+	}
+
+	var res writeCommandResponse
+	if err := runCommand(m, db, cmd, &res, statements); err != nil {
+		return err
+	}
+	if err := m.lastError.setReply(0, res.lastError(m.header.OpCode)); err != nil {
+		return err
+	}
+	corelog.LogInfoMessage("caching translated getLastError response: %s", m.lastError.rest.Bytes())
+	return nil
+}
+
+// TranslateQuery sends an OpQuery to the server as the equivalent find or
+// command and replies to the client with an OpReply.
+func (t *LegacyOpTranslator) TranslateQuery(m *ProxiedMessage) error {
+	queryDoc, err := m.GetQueryDoc()
+	if err != nil {
+		return err
+	}
+	// parts are the header, flags, collection name, skip and return counts
+	// followed by the query
+	flags := getInt32(m.parts[1], 0)
+	skip := getInt32(m.parts[3], 0)
+	toReturn := getInt32(m.parts[3], 4)
+	projection, err := m.readRemaining()
+	if err != nil {
+		return err
+	}
+
+	query, modifiers, err := unwrapQuery(queryDoc)
+	if err != nil {
+		return err
+	}
+	var readPreference interface{}
+	if v, ok := lookupRaw(modifiers, "$readPreference"); ok {
+		readPreference = v
+	} else if flags&querySlaveOk != 0 {
+		readPreference = secondaryPreferred
+	}
+
+	db, collection := splitNamespace(m.fullCollectionName)
+	if collection == "$cmd" {
+		var cmd bson.RawD
+		if err := bson.Unmarshal(query.Data, &cmd); err != nil {
+			return err
+		}
+		body := make(bson.D, 0, len(cmd)+1)
+		for _, e := range cmd {
+			body = append(body, bson.DocElem{Name: e.Name, Value: e.Value})
+		}
+		if readPreference != nil {
+			body = append(body, bson.DocElem{Name: "$readPreference", Value: readPreference})
+		}
+		var res bson.Raw
+		if err := runCommand(m, db, body, &res); err != nil {
+			return err
+		}
+		return writeReply(m, 0, 0, 0, [][]byte{res.Data})
+	}
+
+	cmd := bson.D{
+		{Name: "find", Value: collection},
+		{Name: "filter", Value: query},
+	}
+	for _, e := range modifiers {
+		if field, ok := queryModifiers[e.Name]; ok {
+			cmd = append(cmd, bson.DocElem{Name: field, Value: e.Value})
+		}
+	}
+	if len(projection) > 0 {
+		if _, err := sliceDocument(projection); err != nil {
+			return err
+		}
+		cmd = append(cmd, bson.DocElem{Name: "projection", Value: bson.Raw{Kind: bsonDocumentKind, Data: projection}})
+	}
+	if skip > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "skip", Value: skip})
+	}
+	switch {
+	case toReturn < 0:
+		cmd = append(cmd, bson.DocElem{Name: "limit", Value: -toReturn}, bson.DocElem{Name: "singleBatch", Value: true})
+	case toReturn == 1:
+		cmd = append(cmd, bson.DocElem{Name: "limit", Value: 1}, bson.DocElem{Name: "singleBatch", Value: true})
+	case toReturn > 1:
+		cmd = append(cmd, bson.DocElem{Name: "batchSize", Value: toReturn})
+	}
+	for _, f := range []struct {
+		flag int32
+		name string
+	}{
+		{queryTailable, "tailable"},
+		{queryNoCursorTimeout, "noCursorTimeout"},
+		{queryAwaitData, "awaitData"},
+		{queryPartial, "allowPartialResults"},
+	} {
+		if flags&f.flag != 0 {
+			cmd = append(cmd, bson.DocElem{Name: f.name, Value: true})
+		}
+	}
+
+	// An explained query replies with the explain output as the only document.
+	if explain, ok := lookupRaw(modifiers, "$explain"); ok && !(explain.Kind == bsonBooleanKind && explain.Data[0] == 0) {
+		cmd = bson.D{{Name: "explain", Value: cmd}}
+		if readPreference != nil {
+			cmd = append(cmd, bson.DocElem{Name: "$readPreference", Value: readPreference})
+		}
+		var res bson.Raw
+		if err := runCommand(m, db, cmd, &res); err != nil {
+			return err
+		}
+		return writeReply(m, 0, 0, 0, [][]byte{res.Data})
+	}
+
+	if readPreference != nil {
+		cmd = append(cmd, bson.DocElem{Name: "$readPreference", Value: readPreference})
+	}
+	var res cursorResponse
+	if err := runCommand(m, db, cmd, &res); err != nil {
+		return err
+	}
+	if res.Ok == 0 {
+		return writeQueryFailure(m, &res)
+	}
+	docs := res.documents()
+	ns := db + "." + collection
+	m.cursors.advance(0, res.Cursor.ID, ns, int32(len(docs)))
+	return writeReply(m, 0, res.Cursor.ID, 0, docs)
+}
+
+// TranslateGetMore sends an OpGetMore to the server as a getMore command and
+// replies to the client with an OpReply.
+func (t *LegacyOpTranslator) TranslateGetMore(m *ProxiedMessage) error {
+	fullCollectionName, err := m.GetFullCollectionName()
+	if err != nil {
+		return err
+	}
+	rest, err := m.readRemaining()
+	if err != nil {
+		return err
+	}
+	if len(rest) != 12 {
+		return errLegacyGetMore
+	}
+	toReturn := getInt32(rest, 0)
+	id := getInt64(rest, 4)
+
+	db, collection := splitNamespace(fullCollectionName)
+	cmd := bson.D{
+		{Name: "getMore", Value: id},
+		{Name: "collection", Value: collection},
+	}
+	if toReturn > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "batchSize", Value: toReturn})
+	}
+	var res cursorResponse
+	if err := runCommand(m, db, cmd, &res); err != nil {
+		return err
+	}
+	if res.Ok == 0 {
+		delete(m.cursors, id)
+		if res.Code == cursorNotFoundCode {
+			return writeReply(m, replyCursorNotFound, 0, 0, nil)
+		}
+		return writeQueryFailure(m, &res)
+	}
+	docs := res.documents()
+	startingFrom := m.cursors.advance(id, res.Cursor.ID, db+"."+collection, int32(len(docs)))
+	return writeReply(m, 0, res.Cursor.ID, startingFrom, docs)
+}
+
+// TranslateKillCursors sends an OpKillCursors to the server as killCursors
+// commands, one for each namespace. Cursors the client did not open with a
+// translated OpQuery have no known namespace and are left to time out.
+func (t *LegacyOpTranslator) TranslateKillCursors(m *ProxiedMessage) error {
+	size := int(m.header.MessageLength - headerLen)
+	if size < 8 {
+		return errLegacyKillCursors
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(m.client, body); err != nil {
+		corelog.LogError("error", err)
+		return err
+	}
+	n := int(getInt32(body, 4))
+	if n < 0 || len(body) != 8+8*n {
+		return errLegacyKillCursors
+	}
+
+	var namespaces []string
+	byNamespace := make(map[string][]int64)
+	for i := 0; i < n; i++ {
+		id := getInt64(body, 8+8*i)
+		cursor, ok := m.cursors[id]
+		if !ok {
+			corelog.LogInfoMessage(fmt.Sprintf("not killing unknown cursor %d", id))
+			continue
+		}
+		if _, ok := byNamespace[cursor.ns]; !ok {
+			namespaces = append(namespaces, cursor.ns)
+		}
+		byNamespace[cursor.ns] = append(byNamespace[cursor.ns], id)
+		delete(m.cursors, id)
+	}
+	for _, ns := range namespaces {
+		db, collection := splitNamespace([]byte(ns))
+		cmd := bson.D{
+			{Name: "killCursors", Value: collection},
+			{Name: "cursors", Value: byNamespace[ns]},
+		}
+		var res bson.M
+		if err := runCommand(m, db, cmd, &res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unwrapQuery returns the query of an OpQuery along with its modifiers if it
+// is wrapped in $query.
+func unwrapQuery(doc []byte) (bson.Raw, bson.RawD, error) {
+	var d bson.RawD
+	if err := bson.Unmarshal(doc, &d); err != nil {
+		return bson.Raw{}, nil, err
+	}
+	for i, e := range d {
+		if e.Name == "$query" {
+			modifiers := append(d[:i:i], d[i+1:]...)
+			return e.Value, modifiers, nil
+		}
+	}
+	return bson.Raw{Kind: bsonDocumentKind, Data: doc}, nil, nil
+}
+
+// lookupRaw returns the value of the named element in d.
+func lookupRaw(d bson.RawD, name string) (bson.Raw, bool) {
+	for _, e := range d {
+		if e.Name == name {
+			return e.Value, true
+		}
+	}
+	return bson.Raw{}, false
+}
+
+// writeReply writes an OpReply in response to the message to the client.
+func writeReply(m *ProxiedMessage, flags int32, cursorID int64, startingFrom int32, docs [][]byte) error {
+	b := addInt32(nil, flags)
+	b = addInt64(b, cursorID)
+	b = addInt32(b, startingFrom)
+	b = addInt32(b, int32(len(docs)))
+	for _, doc := range docs {
+		b = append(b, doc...)
+	}
+	h := messageHeader{
+		MessageLength: int32(headerLen + len(b)),
+		RequestID:     m.header.RequestID,
+		ResponseTo:    m.header.RequestID,
+		OpCode:        OpReply,
+	}
+	if _, err := m.client.Write(append(h.ToWire(), b...)); err != nil {
+		corelog.LogError("error", err)
+		return err
+	}
+	return nil
+}
+
+// writeQueryFailure replies to the client with the error of a failed command.
+func writeQueryFailure(m *ProxiedMessage, res *cursorResponse) error {
+	doc, err := bson.Marshal(bson.D{
+		{Name: "$err", Value: res.ErrMsg},
+		{Name: "code", Value: res.Code},
+	})
+	if err != nil {
+		return err
+	}
+	return writeReply(m, replyQueryFailure, 0, 0, [][]byte{doc})
+}
+
+// runCommand runs a command against the server of the message as an OpMsg and
+// unmarshals the reply into result. The message's request id is reused.
+func runCommand(m *ProxiedMessage, db string, cmd bson.D, result interface{}, sequences ...MsgSection) error {
+	body, err := bson.Marshal(append(cmd, bson.DocElem{Name: "$db", Value: db}))
+	if err != nil {
+		return err
+	}
+	msg := &opMsg{sections: append([]MsgSection{{Kind: SectionBody, Documents: [][]byte{body}}}, sequences...)}
+	if err := writeMsg(m.server, m.header.RequestID, msg); err != nil {
+		corelog.LogError("error", err)
+		return err
+	}
+	_, reply, err := readMsg(m.server)
+	if err != nil {
+		corelog.LogError("error", err)
+		return err
+	}
+	return bson.Unmarshal(reply.body(), result)
+}
+
+// splitNamespace splits a null terminated full collection name into the
+// database and collection names.
+func splitNamespace(fullCollectionName []byte) (string, string) {
+	ns := string(bytes.TrimSuffix(fullCollectionName, []byte{x00}))
+	if i := strings.IndexByte(ns, '.'); i >= 0 {
+		return ns[:i], ns[i+1:]
+	}
+	return ns, ""
+}
@@ -0,0 +1,468 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func fakeLegacyWrite(op OpCode, first int32, ns string, rest []byte) []byte {
+	body := addInt32(nil, first)
+	body = addCString(body, ns)
+	body = append(body, rest...)
+	h := messageHeader{
+		OpCode:        op,
+		MessageLength: int32(headerLen + len(body)),
+		RequestID:     9,
+	}
+	return append(h.ToWire(), body...)
+}
+
+func translateWrite(t *testing.T, request []byte, reply io.Reader) (*opMsg, bson.M) {
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(
+		h,
+		fakeReadWriter{Reader: r},
+		fakeReadWriter{Reader: reply, Writer: &server},
+		&lastError,
+	)
+	var translator LegacyOpTranslator
+	if err := translator.TranslateWrite(&message); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("did not read the entire request, %d bytes left", r.Len())
+	}
+
+	sh, msg, err := readMsg(&server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.RequestID != 9 {
+		t.Fatalf("did not reuse request id, got %d", sh.RequestID)
+	}
+	if !lastError.Exists() || lastError.header.OpCode != OpReply {
+		t.Fatal("did not cache getLastError reply")
+	}
+	b := lastError.rest.Bytes()
+	if getInt32(b, 16) != 1 {
+		t.Fatalf("expected one document, got %d", getInt32(b, 16))
+	}
+	var le bson.M
+	if err := bson.Unmarshal(b[opReplyPrefixLen:], &le); err != nil {
+		t.Fatal(err)
+	}
+	return msg, le
+}
+
+func TestTranslateInsert(t *testing.T) {
+	t.Parallel()
+	docs := append(mustMarshal(bson.M{"_id": 1}), mustMarshal(bson.M{"_id": 2})...)
+	request := fakeLegacyWrite(OpInsert, insertContinueOnError, "test.foo", docs)
+	msg, le := translateWrite(t, request, fakeMsgReply(0, bson.M{"ok": 1, "n": 2}))
+
+	var cmd bson.D
+	if err := bson.Unmarshal(msg.body(), &cmd); err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{
+		{Name: "insert", Value: "foo"},
+		{Name: "ordered", Value: false},
+		{Name: "$db", Value: "test"},
+	}
+	if !reflect.DeepEqual(cmd, expected) {
+		t.Fatalf("did not get expected command, got %v", cmd)
+	}
+	if len(msg.sections) != 2 || msg.sections[1].Identifier != "documents" || len(msg.sections[1].Documents) != 2 {
+		t.Fatalf("did not get expected documents, got %v", msg.sections)
+	}
+	if le["n"] != 0 || le["err"] != nil || le["ok"] != 1 {
+		t.Fatalf("did not get expected getLastError, got %v", le)
+	}
+}
+
+func TestTranslateUpdate(t *testing.T) {
+	t.Parallel()
+	rest := addInt32(nil, updateUpsert)
+	rest = append(rest, mustMarshal(bson.M{"_id": 1})...)
+	rest = append(rest, mustMarshal(bson.M{"$set": bson.M{"a": 1}})...)
+	request := fakeLegacyWrite(OpUpdate, 0, "test.foo", rest)
+	reply := bson.M{
+		"ok":       1,
+		"n":        1,
+		"upserted": []bson.M{{"index": 0, "_id": 1}},
+	}
+	msg, le := translateWrite(t, request, fakeMsgReply(0, reply))
+
+	if len(msg.sections) != 2 || msg.sections[1].Identifier != "updates" {
+		t.Fatalf("did not get expected updates, got %v", msg.sections)
+	}
+	var update struct {
+		Q      bson.M `bson:"q"`
+		U      bson.M `bson:"u"`
+		Upsert bool   `bson:"upsert"`
+		Multi  bool   `bson:"multi"`
+	}
+	if err := bson.Unmarshal(msg.sections[1].Documents[0], &update); err != nil {
+		t.Fatal(err)
+	}
+	if update.Q["_id"] != 1 || update.U["$set"] == nil || !update.Upsert || update.Multi {
+		t.Fatalf("did not get expected update, got %+v", update)
+	}
+	if le["n"] != 1 || le["updatedExisting"] != false || le["upserted"] != 1 {
+		t.Fatalf("did not get expected getLastError, got %v", le)
+	}
+}
+
+func TestTranslateDeleteWriteError(t *testing.T) {
+	t.Parallel()
+	rest := addInt32(nil, deleteSingleRemove)
+	rest = append(rest, mustMarshal(bson.M{"a": 1})...)
+	request := fakeLegacyWrite(OpDelete, 0, "test.foo.bar", rest)
+	reply := bson.M{
+		"ok":          1,
+		"n":           0,
+		"writeErrors": []bson.M{{"index": 0, "code": 11000, "errmsg": "boom"}},
+	}
+	msg, le := translateWrite(t, request, fakeMsgReply(0, reply))
+
+	var cmd struct {
+		Delete string `bson:"delete"`
+		DB     string `bson:"$db"`
+	}
+	if err := bson.Unmarshal(msg.body(), &cmd); err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Delete != "foo.bar" || cmd.DB != "test" {
+		t.Fatalf("did not get expected command, got %+v", cmd)
+	}
+	var del struct {
+		Limit int `bson:"limit"`
+	}
+	if err := bson.Unmarshal(msg.sections[1].Documents[0], &del); err != nil {
+		t.Fatal(err)
+	}
+	if msg.sections[1].Identifier != "deletes" || del.Limit != 1 {
+		t.Fatalf("did not get expected deletes, got %v", msg.sections)
+	}
+	if le["err"] != "boom" || le["code"] != 11000 {
+		t.Fatalf("did not get expected getLastError, got %v", le)
+	}
+}
+
+func TestTranslateUpdateMissingDocument(t *testing.T) {
+	t.Parallel()
+	rest := append(addInt32(nil, 0), mustMarshal(bson.M{"_id": 1})...)
+	request := fakeLegacyWrite(OpUpdate, 0, "test.foo", rest)
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lastError LastError
+	message := NewProxiedMessage(h, fakeReadWriter{Reader: r}, fakeReadWriter{}, &lastError)
+	var translator LegacyOpTranslator
+	if err := translator.TranslateWrite(&message); err != errLegacyUpdate {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+}
+
+func fakeLegacyQuery(flags int32, ns string, skip, toReturn int32, query interface{}, projection interface{}) []byte {
+	body := addInt32(nil, flags)
+	body = addCString(body, ns)
+	body = addInt32(body, skip)
+	body = addInt32(body, toReturn)
+	body = append(body, mustMarshal(query)...)
+	if projection != nil {
+		body = append(body, mustMarshal(projection)...)
+	}
+	h := messageHeader{
+		OpCode:        OpQuery,
+		MessageLength: int32(headerLen + len(body)),
+		RequestID:     9,
+	}
+	return append(h.ToWire(), body...)
+}
+
+type legacyReply struct {
+	Flags        int32
+	CursorID     int64
+	StartingFrom int32
+	Documents    []bson.M
+}
+
+func readLegacyReply(t *testing.T, b []byte) legacyReply {
+	h, err := readHeader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.OpCode != OpReply || h.ResponseTo != 9 || int(h.MessageLength) != len(b) {
+		t.Fatalf("did not get expected reply header, got %s", h)
+	}
+	b = b[headerLen:]
+	r := legacyReply{
+		Flags:        getInt32(b, 0),
+		CursorID:     getInt64(b, 4),
+		StartingFrom: getInt32(b, 12),
+	}
+	docs, err := splitDocuments(b[opReplyPrefixLen:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != int(getInt32(b, 16)) {
+		t.Fatalf("expected %d documents, got %d", getInt32(b, 16), len(docs))
+	}
+	for _, doc := range docs {
+		var d bson.M
+		if err := bson.Unmarshal(doc, &d); err != nil {
+			t.Fatal(err)
+		}
+		r.Documents = append(r.Documents, d)
+	}
+	return r
+}
+
+type translate func(*LegacyOpTranslator, *ProxiedMessage) error
+
+func translateRead(t *testing.T, f translate, cursors legacyCursors, request []byte, reply io.Reader) (bson.D, *bytes.Buffer) {
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client, server bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(
+		h,
+		fakeReadWriter{Reader: r, Writer: &client},
+		fakeReadWriter{Reader: reply, Writer: &server},
+		&lastError,
+	)
+	message.cursors = cursors
+	if err := f(&LegacyOpTranslator{}, &message); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("did not read the entire request, %d bytes left", r.Len())
+	}
+	if server.Len() == 0 {
+		return nil, &client
+	}
+	_, msg, err := readMsg(&server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmd bson.D
+	if err := bson.Unmarshal(msg.body(), &cmd); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, &client
+}
+
+func TestTranslateQuery(t *testing.T) {
+	t.Parallel()
+	query := bson.D{
+		{Name: "$query", Value: bson.M{"a": 1}},
+		{Name: "$orderby", Value: bson.M{"b": -1}},
+		{Name: "$snapshot", Value: true},
+	}
+	request := fakeLegacyQuery(querySlaveOk|queryNoCursorTimeout, "test.foo", 5, 2, query, bson.M{"a": 1})
+	reply := bson.M{
+		"ok": 1,
+		"cursor": bson.M{
+			"id":         int64(42),
+			"ns":         "test.foo",
+			"firstBatch": []bson.M{{"a": 1}, {"a": 2}},
+		},
+	}
+	cursors := make(legacyCursors)
+	cmd, client := translateRead(t, (*LegacyOpTranslator).TranslateQuery, cursors, request, fakeMsgReply(0, reply))
+
+	expected := bson.D{
+		{Name: "find", Value: "foo"},
+		{Name: "filter", Value: bson.D{{Name: "a", Value: 1}}},
+		{Name: "sort", Value: bson.D{{Name: "b", Value: -1}}},
+		{Name: "projection", Value: bson.D{{Name: "a", Value: 1}}},
+		{Name: "skip", Value: 5},
+		{Name: "batchSize", Value: 2},
+		{Name: "noCursorTimeout", Value: true},
+		{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondaryPreferred"}}},
+		{Name: "$db", Value: "test"},
+	}
+	if !reflect.DeepEqual(cmd, expected) {
+		t.Fatalf("did not get expected command, got %v", cmd)
+	}
+	r := readLegacyReply(t, client.Bytes())
+	if r.Flags != 0 || r.CursorID != 42 || r.StartingFrom != 0 || len(r.Documents) != 2 {
+		t.Fatalf("did not get expected reply, got %+v", r)
+	}
+	if c := cursors[42]; c == nil || c.ns != "test.foo" || c.returned != 2 {
+		t.Fatalf("did not track cursor, got %v", cursors)
+	}
+}
+
+func TestTranslateQueryLimit(t *testing.T) {
+	t.Parallel()
+	request := fakeLegacyQuery(0, "test.foo", 0, -3, bson.M{"a": 1}, nil)
+	reply := bson.M{
+		"ok":     1,
+		"cursor": bson.M{"id": int64(0), "ns": "test.foo", "firstBatch": []bson.M{{"a": 1}}},
+	}
+	cursors := make(legacyCursors)
+	cmd, client := translateRead(t, (*LegacyOpTranslator).TranslateQuery, cursors, request, fakeMsgReply(0, reply))
+
+	expected := bson.D{
+		{Name: "find", Value: "foo"},
+		{Name: "filter", Value: bson.D{{Name: "a", Value: 1}}},
+		{Name: "limit", Value: 3},
+		{Name: "singleBatch", Value: true},
+		{Name: "$db", Value: "test"},
+	}
+	if !reflect.DeepEqual(cmd, expected) {
+		t.Fatalf("did not get expected command, got %v", cmd)
+	}
+	r := readLegacyReply(t, client.Bytes())
+	if r.CursorID != 0 || len(r.Documents) != 1 || len(cursors) != 0 {
+		t.Fatalf("did not get expected reply, got %+v", r)
+	}
+}
+
+func TestTranslateQueryFailure(t *testing.T) {
+	t.Parallel()
+	request := fakeLegacyQuery(0, "test.foo", 0, 0, bson.M{"$where": 1}, nil)
+	reply := bson.M{"ok": 0, "errmsg": "bad query", "code": 2}
+	_, client := translateRead(t, (*LegacyOpTranslator).TranslateQuery, nil, request, fakeMsgReply(0, reply))
+
+	r := readLegacyReply(t, client.Bytes())
+	if r.Flags != replyQueryFailure || len(r.Documents) != 1 {
+		t.Fatalf("did not get expected reply, got %+v", r)
+	}
+	if r.Documents[0]["$err"] != "bad query" || r.Documents[0]["code"] != 2 {
+		t.Fatalf("did not get expected error, got %v", r.Documents[0])
+	}
+}
+
+func TestTranslateQueryCommand(t *testing.T) {
+	t.Parallel()
+	query := bson.D{
+		{Name: "$query", Value: bson.D{{Name: "count", Value: "foo"}}},
+		{Name: "$readPreference", Value: bson.M{"mode": "nearest"}},
+	}
+	request := fakeLegacyQuery(0, "test.$cmd", 0, -1, query, nil)
+	cmd, client := translateRead(t, (*LegacyOpTranslator).TranslateQuery, nil, request, fakeMsgReply(0, bson.M{"ok": 1, "n": 7}))
+
+	expected := bson.D{
+		{Name: "count", Value: "foo"},
+		{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "nearest"}}},
+		{Name: "$db", Value: "test"},
+	}
+	if !reflect.DeepEqual(cmd, expected) {
+		t.Fatalf("did not get expected command, got %v", cmd)
+	}
+	r := readLegacyReply(t, client.Bytes())
+	if r.Flags != 0 || r.CursorID != 0 || len(r.Documents) != 1 || r.Documents[0]["n"] != 7 {
+		t.Fatalf("did not get expected reply, got %+v", r)
+	}
+}
+
+func fakeGetMore(ns string, toReturn int32, id int64) []byte {
+	body := addInt32(nil, 0)
+	body = addCString(body, ns)
+	body = addInt32(body, toReturn)
+	body = addInt64(body, id)
+	h := messageHeader{
+		OpCode:        OpGetMore,
+		MessageLength: int32(headerLen + len(body)),
+		RequestID:     9,
+	}
+	return append(h.ToWire(), body...)
+}
+
+func TestTranslateGetMore(t *testing.T) {
+	t.Parallel()
+	cursors := legacyCursors{42: {ns: "test.foo", returned: 2}}
+	reply := bson.M{
+		"ok":     1,
+		"cursor": bson.M{"id": int64(42), "ns": "test.foo", "nextBatch": []bson.M{{"a": 3}, {"a": 4}, {"a": 5}}},
+	}
+	cmd, client := translateRead(t, (*LegacyOpTranslator).TranslateGetMore, cursors, fakeGetMore("test.foo", 3, 42), fakeMsgReply(0, reply))
+
+	expected := bson.D{
+		{Name: "getMore", Value: int64(42)},
+		{Name: "collection", Value: "foo"},
+		{Name: "batchSize", Value: 3},
+		{Name: "$db", Value: "test"},
+	}
+	if !reflect.DeepEqual(cmd, expected) {
+		t.Fatalf("did not get expected command, got %v", cmd)
+	}
+	r := readLegacyReply(t, client.Bytes())
+	if r.CursorID != 42 || r.StartingFrom != 2 || len(r.Documents) != 3 {
+		t.Fatalf("did not get expected reply, got %+v", r)
+	}
+	if cursors[42].returned != 5 {
+		t.Fatalf("did not advance cursor, got %d", cursors[42].returned)
+	}
+
+	// the last batch closes the cursor
+	reply = bson.M{
+		"ok":     1,
+		"cursor": bson.M{"id": int64(0), "ns": "test.foo", "nextBatch": []bson.M{{"a": 6}}},
+	}
+	_, client = translateRead(t, (*LegacyOpTranslator).TranslateGetMore, cursors, fakeGetMore("test.foo", 0, 42), fakeMsgReply(0, reply))
+	r = readLegacyReply(t, client.Bytes())
+	if r.CursorID != 0 || r.StartingFrom != 5 || len(r.Documents) != 1 || len(cursors) != 0 {
+		t.Fatalf("did not get expected reply, got %+v", r)
+	}
+}
+
+func TestTranslateGetMoreCursorNotFound(t *testing.T) {
+	t.Parallel()
+	cursors := legacyCursors{42: {ns: "test.foo", returned: 2}}
+	reply := bson.M{"ok": 0, "errmsg": "cursor id 42 not found", "code": cursorNotFoundCode}
+	_, client := translateRead(t, (*LegacyOpTranslator).TranslateGetMore, cursors, fakeGetMore("test.foo", 0, 42), fakeMsgReply(0, reply))
+
+	r := readLegacyReply(t, client.Bytes())
+	if r.Flags != replyCursorNotFound || len(r.Documents) != 0 || len(cursors) != 0 {
+		t.Fatalf("did not get expected reply, got %+v", r)
+	}
+}
+
+func TestTranslateKillCursors(t *testing.T) {
+	t.Parallel()
+	body := addInt32(nil, 0)
+	body = addInt32(body, 2)
+	body = addInt64(body, 42)
+	body = addInt64(body, 43)
+	h := messageHeader{
+		OpCode:        OpKillCursors,
+		MessageLength: int32(headerLen + len(body)),
+		RequestID:     9,
+	}
+	request := append(h.ToWire(), body...)
+
+	// 43 was not opened through a translated query and is skipped
+	cursors := legacyCursors{42: {ns: "test.foo.bar", returned: 2}}
+	cmd, client := translateRead(t, (*LegacyOpTranslator).TranslateKillCursors, cursors, request, fakeMsgReply(0, bson.M{"ok": 1}))
+
+	expected := bson.D{
+		{Name: "killCursors", Value: "foo.bar"},
+		{Name: "cursors", Value: []interface{}{int64(42)}},
+		{Name: "$db", Value: "test"},
+	}
+	if !reflect.DeepEqual(cmd, expected) {
+		t.Fatalf("did not get expected command, got %v", cmd)
+	}
+	if client.Len() != 0 || len(cursors) != 0 {
+		t.Fatal("killCursors must not reply to the client")
+	}
+}
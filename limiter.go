@@ -0,0 +1,149 @@
+package dvara
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// aimdLimiter adapts how many server connections may be used at once to the
+// latency of the member. Every message that is proxied in time adds to the
+// limit, so it grows by about one for every limit messages, and every message
+// that is too slow or timed out cuts it by the Backoff factor.
+type aimdLimiter struct {
+	// Min and Max bound the limit.
+	Min uint
+	Max uint
+
+	// Latency is how long a message may take before it counts as too slow.
+	Latency time.Duration
+
+	// Backoff is the factor the limit is cut by.
+	Backoff float64
+
+	// SetLimit is called with the new limit when it changes.
+	SetLimit func(uint)
+
+	mu    sync.Mutex
+	limit float64
+}
+
+// Limit returns the current limit.
+func (l *aimdLimiter) Limit() uint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current()
+}
+
+func (l *aimdLimiter) current() uint {
+	if l.limit == 0 {
+		return l.Max
+	}
+	return uint(l.limit)
+}
+
+// Sample adds a proxied message to the limit. It does nothing on a nil
+// limiter, so callers don't need to care if it is enabled.
+func (l *aimdLimiter) Sample(latency time.Duration, timeout bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	before := l.current()
+	if l.limit == 0 {
+		l.limit = float64(l.Max)
+	}
+	if timeout || latency > l.Latency {
+		// never below one, a limit of zero means no limit to the pool
+		l.limit = math.Max(math.Max(float64(l.Min), 1), l.limit*l.Backoff)
+	} else {
+		l.limit = math.Min(float64(l.Max), l.limit+1/l.limit)
+	}
+
+	// set while we hold the lock, so limits are set in order
+	if after := l.current(); after != before {
+		l.SetLimit(after)
+	}
+}
+
+// latencyConn wraps a server connection to measure how long the server takes
+// to reply, from when the request was written until the first bytes of the
+// reply arrive. Reading the request from the client doesn't count.
+type latencyConn struct {
+	net.Conn
+	written time.Time
+	latency time.Duration
+	timeout bool
+	read    bool
+}
+
+func (c *latencyConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written = time.Now()
+	return n, err
+}
+
+func (c *latencyConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.read && !c.written.IsZero() {
+		c.read = true
+		c.latency = time.Since(c.written)
+		ne, ok := err.(net.Error)
+		c.timeout = ok && ne.Timeout()
+	}
+	return n, err
+}
+
+// sample adds the latency of the reply to the limiter. It does nothing on a
+// nil latencyConn, or if no reply was read.
+func (c *latencyConn) sample(l *aimdLimiter) {
+	if c == nil || !c.read {
+		return
+	}
+	l.Sample(c.latency, c.timeout)
+}
+
+// awaitsServer tells us if the server may hold the reply to a message on
+// purpose, which says nothing of its latency: an awaitable hello, the getMore
+// of an awaitData cursor, an exhaust stream or anything with maxAwaitTimeMS.
+// A legacy OpGetMore can't be told apart from that of an awaitData cursor.
+func awaitsServer(message *ProxiedMessage) (bool, error) {
+	switch message.header.OpCode {
+	default:
+		return false, nil
+	case OpGetMore:
+		return true, nil
+	case OpMsg:
+		flags, err := message.GetMsgFlags()
+		if err != nil {
+			return false, err
+		}
+		if flags&MsgExhaustAllowed != 0 {
+			return true, nil
+		}
+	case OpQuery:
+		if _, err := message.GetParts(); err != nil {
+			return false, err
+		}
+		if getInt32(message.parts[1], 0)&queryExhaust != 0 {
+			return true, nil
+		}
+	case OpCommand:
+	}
+	command, err := message.GetCommand()
+	if err != nil || command == nil {
+		return false, err
+	}
+	switch {
+	case hasKey(command.Args, "maxAwaitTimeMS"):
+		return true, nil
+	case command.Is("hello") || command.Is("isMaster"):
+		return hasKey(command.Args, "topologyVersion"), nil
+	case command.Is("getMore"):
+		// only the getMore of an awaitData cursor may have maxTimeMS
+		return hasKey(command.Args, "maxTimeMS"), nil
+	}
+	return false, nil
+}
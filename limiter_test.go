@@ -0,0 +1,218 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAIMDLimiter(t *testing.T) {
+	t.Parallel()
+	var limits []uint
+	l := &aimdLimiter{
+		Min:     2,
+		Max:     4,
+		Latency: time.Second,
+		Backoff: 0.5,
+		SetLimit: func(limit uint) {
+			limits = append(limits, limit)
+		},
+	}
+	if l.Limit() != 4 {
+		t.Fatalf("expected to start at %d, got %d", 4, l.Limit())
+	}
+
+	// cut by timeouts and slow messages, but not below Min
+	l.Sample(time.Millisecond, true)
+	l.Sample(2*time.Second, false)
+	l.Sample(2*time.Second, false)
+	if l.Limit() != 2 {
+		t.Fatalf("expected limit %d, got %d", 2, l.Limit())
+	}
+
+	// grows by about one for every limit messages in time, up to Max
+	for i := 0; i < 10; i++ {
+		l.Sample(time.Millisecond, false)
+	}
+	if l.Limit() != 4 {
+		t.Fatalf("expected limit %d, got %d", 4, l.Limit())
+	}
+	expected := []uint{2, 3, 4}
+	if len(limits) != len(expected) {
+		t.Fatalf("expected limits %v, got %v", expected, limits)
+	}
+	for i := range expected {
+		if limits[i] != expected[i] {
+			t.Fatalf("expected limits %v, got %v", expected, limits)
+		}
+	}
+}
+
+func TestAIMDLimiterNil(t *testing.T) {
+	t.Parallel()
+	var l *aimdLimiter
+	l.Sample(time.Second, true)
+}
+
+// slowReader takes a while before it reads.
+type slowReader struct {
+	io.Reader
+	delay time.Duration
+	err   error
+}
+
+func (r slowReader) Read(b []byte) (int, error) {
+	time.Sleep(r.delay)
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.Reader.Read(b)
+}
+
+func TestLatencyConn(t *testing.T) {
+	t.Parallel()
+	var limits []uint
+	l := &aimdLimiter{
+		Min:     1,
+		Max:     4,
+		Latency: 5 * time.Millisecond,
+		Backoff: 0.5,
+		SetLimit: func(limit uint) {
+			limits = append(limits, limit)
+		},
+	}
+
+	// reading the request, before it is written, doesn't count
+	var server bytes.Buffer
+	c := &latencyConn{Conn: fakeReadWriter{Reader: bytes.NewReader([]byte{1}), Writer: &server}}
+	c.sample(l)
+	time.Sleep(10 * time.Millisecond)
+	if _, err := c.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	c.sample(l)
+	if l.Limit() != 4 || len(limits) != 0 {
+		t.Fatalf("expected limit %d, got %d", 4, l.Limit())
+	}
+
+	// a slow reply cuts the limit
+	c = &latencyConn{Conn: fakeReadWriter{
+		Reader: slowReader{Reader: bytes.NewReader([]byte{1}), delay: 10 * time.Millisecond},
+		Writer: &server,
+	}}
+	c.Write([]byte{1})
+	c.Read(make([]byte, 1))
+	c.sample(l)
+	if l.Limit() != 2 {
+		t.Fatalf("expected limit %d, got %d", 2, l.Limit())
+	}
+
+	// so does a timeout
+	c = &latencyConn{Conn: fakeReadWriter{Reader: slowReader{err: timeoutError{}}, Writer: &server}}
+	c.Write([]byte{1})
+	c.Read(make([]byte, 1))
+	c.sample(l)
+	if l.Limit() != 1 {
+		t.Fatalf("expected limit %d, got %d", 1, l.Limit())
+	}
+
+	var nilConn *latencyConn
+	nilConn.sample(l)
+}
+
+func TestAwaitsServer(t *testing.T) {
+	t.Parallel()
+	body := func(doc bson.D) []MsgSection {
+		return []MsgSection{{Kind: SectionBody, Documents: [][]byte{mustMarshal(doc)}}}
+	}
+	cases := []struct {
+		Name    string
+		Request []byte
+		Awaits  bool
+	}{
+		{
+			Name:    "find",
+			Request: fakeMsg(&opMsg{sections: body(bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}})}),
+		},
+		{
+			Name:    "hello",
+			Request: fakeMsg(&opMsg{sections: body(bson.D{{Name: "hello", Value: 1}, {Name: "$db", Value: "admin"}})}),
+		},
+		{
+			Name: "awaitable hello",
+			Request: fakeMsg(&opMsg{sections: body(bson.D{
+				{Name: "hello", Value: 1},
+				{Name: "topologyVersion", Value: bson.M{"counter": 0}},
+				{Name: "maxAwaitTimeMS", Value: 10000},
+				{Name: "$db", Value: "admin"},
+			})}),
+			Awaits: true,
+		},
+		{
+			Name: "exhaust",
+			Request: fakeMsg(&opMsg{
+				flags:    MsgExhaustAllowed,
+				sections: body(bson.D{{Name: "isMaster", Value: 1}, {Name: "$db", Value: "admin"}}),
+			}),
+			Awaits: true,
+		},
+		{
+			Name:    "getMore",
+			Request: fakeMsg(&opMsg{sections: body(bson.D{{Name: "getMore", Value: int64(1)}, {Name: "$db", Value: "test"}})}),
+		},
+		{
+			Name: "awaitData getMore",
+			Request: fakeMsg(&opMsg{sections: body(bson.D{
+				{Name: "getMore", Value: int64(1)},
+				{Name: "maxTimeMS", Value: 1000},
+				{Name: "$db", Value: "test"},
+			})}),
+			Awaits: true,
+		},
+		{
+			Name: "maxAwaitTimeMS",
+			Request: fakeMsg(&opMsg{sections: body(bson.D{
+				{Name: "aggregate", Value: "foo"},
+				{Name: "maxAwaitTimeMS", Value: 1000},
+				{Name: "$db", Value: "test"},
+			})}),
+			Awaits: true,
+		},
+		{
+			Name:    "query",
+			Request: fakeLegacyQuery(0, "test.foo", 0, 0, bson.M{"a": 1}, nil),
+		},
+		{
+			Name:    "exhaust query",
+			Request: fakeLegacyQuery(queryExhaust, "test.foo", 0, 0, bson.M{"a": 1}, nil),
+			Awaits:  true,
+		},
+		{
+			Name:    "legacy command",
+			Request: fakeCommand("test", "getMore", bson.D{{Name: "getMore", Value: int64(1)}, {Name: "maxTimeMS", Value: 1000}}, bson.M{}),
+			Awaits:  true,
+		},
+	}
+	for _, c := range cases {
+		r := bytes.NewReader(c.Request)
+		h, err := readHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lastError LastError
+		message := NewProxiedMessage(h, fakeReadWriter{Reader: r}, fakeReadWriter{}, &lastError)
+		awaits, err := awaitsServer(&message)
+		if err != nil {
+			t.Fatalf("%s: %s", c.Name, err)
+		}
+		if awaits != c.Awaits {
+			t.Fatalf("%s: expected %v, got %v", c.Name, c.Awaits, awaits)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errUnnamedListenerGroup = errors.New("dvara: ListenerGroups must be named")
+
+// ListenerGroup is a group of proxies, one for each member, with its own port
+// range and server connection pools. Clients connecting through different
+// groups don't share server connections, so a batch job can't take those of
+// the online traffic. Zero fields mean the setting of the ReplicaSet.
+type ListenerGroup struct {
+	// Name is the name of the group, used in logs and stats.
+	Name string
+
+	// PortStart and PortEnd define the port range within which the proxies of
+	// the group will be allocated.
+	PortStart int
+	PortEnd   int
+
+	// MaxConnections, MinIdleConnections and MaxPoolWaiting size the server
+	// connection pool of each proxy of the group.
+	MaxConnections     uint
+	MinIdleConnections uint
+	MaxPoolWaiting     uint
+
+	// MaxPerClientConnections is how many client connections are allowed from a
+	// single client to each proxy of the group.
+	MaxPerClientConnections uint
+
+	// PoolAcquireTimeout, ServerIdleTimeout, ClientIdleTimeout and
+	// MessageTimeout are the timeouts of the group.
+	PoolAcquireTimeout time.Duration
+	ServerIdleTimeout  time.Duration
+	ClientIdleTimeout  time.Duration
+	MessageTimeout     time.Duration
+
+	// ReadOnly only allows read only queries through the group.
+	ReadOnly bool
+}
+
+// listenerGroup returns the group with its zero fields set from the
+// ReplicaSet.
+func (r *ReplicaSet) listenerGroup(g ListenerGroup) ListenerGroup {
+	if g.PortStart == 0 && g.PortEnd == 0 {
+		g.PortStart, g.PortEnd = r.PortStart, r.PortEnd
+	}
+	if g.MaxConnections == 0 {
+		g.MaxConnections = r.MaxConnections
+	}
+	if g.MinIdleConnections == 0 {
+		g.MinIdleConnections = r.MinIdleConnections
+	}
+	if g.MaxPoolWaiting == 0 {
+		g.MaxPoolWaiting = r.MaxPoolWaiting
+	}
+	if g.MaxPerClientConnections == 0 {
+		g.MaxPerClientConnections = r.MaxPerClientConnections
+	}
+	if g.PoolAcquireTimeout == 0 {
+		g.PoolAcquireTimeout = r.PoolAcquireTimeout
+	}
+	if g.ServerIdleTimeout == 0 {
+		g.ServerIdleTimeout = r.ServerIdleTimeout
+	}
+	if g.ClientIdleTimeout == 0 {
+		g.ClientIdleTimeout = r.ClientIdleTimeout
+	}
+	if g.MessageTimeout == 0 {
+		g.MessageTimeout = r.MessageTimeout
+	}
+	return g
+}
+
+// listenerGroups returns the groups proxies are started for. Without any
+// ListenerGroups there is a single unnamed group with the settings of the
+// ReplicaSet.
+func (r *ReplicaSet) listenerGroups() []ListenerGroup {
+	if len(r.ListenerGroups) == 0 {
+		return []ListenerGroup{r.listenerGroup(ListenerGroup{})}
+	}
+	groups := make([]ListenerGroup, len(r.ListenerGroups))
+	for i, g := range r.ListenerGroups {
+		groups[i] = r.listenerGroup(g)
+	}
+	return groups
+}
+
+// checkListenerGroups makes sure every group can be told apart by its name.
+func (r *ReplicaSet) checkListenerGroups() error {
+	names := make(map[string]struct{}, len(r.ListenerGroups))
+	for _, g := range r.ListenerGroups {
+		if g.Name == "" {
+			return errUnnamedListenerGroup
+		}
+		if _, ok := names[g.Name]; ok {
+			return fmt.Errorf("dvara: listener group %s given more than once", g.Name)
+		}
+		names[g.Name] = struct{}{}
+	}
+	return nil
+}
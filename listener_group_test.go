@@ -0,0 +1,127 @@
+package dvara
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestListenerGroupDefaults(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{
+		PortStart:               6000,
+		PortEnd:                 6010,
+		MaxConnections:          100,
+		MinIdleConnections:      5,
+		MaxPerClientConnections: 50,
+		MessageTimeout:          time.Minute,
+		ClientIdleTimeout:       time.Hour,
+	}
+	ensure.DeepEqual(t, r.listenerGroups(), []ListenerGroup{{
+		PortStart:               6000,
+		PortEnd:                 6010,
+		MaxConnections:          100,
+		MinIdleConnections:      5,
+		MaxPerClientConnections: 50,
+		MessageTimeout:          time.Minute,
+		ClientIdleTimeout:       time.Hour,
+	}})
+
+	r.ListenerGroups = []ListenerGroup{
+		{Name: "online"},
+		{Name: "batch", PortStart: 7000, PortEnd: 7010, MaxConnections: 10, MessageTimeout: time.Hour, ReadOnly: true},
+	}
+	groups := r.listenerGroups()
+	ensure.DeepEqual(t, len(groups), 2)
+	ensure.DeepEqual(t, groups[0].Name, "online")
+	ensure.DeepEqual(t, groups[0].PortStart, 6000)
+	ensure.DeepEqual(t, groups[0].MaxConnections, uint(100))
+	ensure.DeepEqual(t, groups[1], ListenerGroup{
+		Name:                    "batch",
+		PortStart:               7000,
+		PortEnd:                 7010,
+		MaxConnections:          10,
+		MinIdleConnections:      5,
+		MaxPerClientConnections: 50,
+		MessageTimeout:          time.Hour,
+		ClientIdleTimeout:       time.Hour,
+		ReadOnly:                true,
+	})
+}
+
+func TestCheckListenerGroups(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{ListenerGroups: []ListenerGroup{{Name: "online"}, {Name: "batch"}}}
+	ensure.Nil(t, r.checkListenerGroups())
+
+	r.ListenerGroups = append(r.ListenerGroups, ListenerGroup{})
+	ensure.DeepEqual(t, r.checkListenerGroups(), errUnnamedListenerGroup)
+
+	r.ListenerGroups = []ListenerGroup{{Name: "online"}, {Name: "online"}}
+	ensure.Err(t, r.checkListenerGroups(), regexp.MustCompile("listener group online given more than once"))
+}
+
+func TestListenerGroupReadOnly(t *testing.T) {
+	t.Parallel()
+
+	// the server counts what it was sent
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	forwarded := make(chan int, 1)
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			forwarded <- 0
+			return
+		}
+		defer c.Close()
+		b, _ := ioutil.ReadAll(c)
+		forwarded <- len(b)
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			MessageTimeout:          time.Second,
+			ClientIdleTimeout:       time.Second,
+			ServerIdleTimeout:       time.Second,
+			ServerClosePoolSize:     1,
+			ProxyQuery:              &ProxyQuery{},
+		},
+		Group:          ListenerGroup{Name: "batch", ReadOnly: true},
+		ClientListener: listener,
+		ProxyAddr:      listener.Addr().String(),
+		MongoAddr:      server.Addr().String(),
+	}
+	ensure.Nil(t, p.Start())
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Write(fakeMsg(&opMsg{
+		sections: []MsgSection{{
+			Kind:      SectionBody,
+			Documents: [][]byte{mustMarshal(bson.D{{Name: "insert", Value: "foo"}, {Name: "$db", Value: "test"}})},
+		}},
+	}))
+	ensure.Nil(t, err)
+	var reply bytes.Buffer
+	ensure.Nil(t, copyMessage(&reply, c))
+	_, _, out := readMsgReply(t, reply.Bytes())
+	ensure.DeepEqual(t, out["code"], 66)
+	ensure.DeepEqual(t, out["errmsg"], "Readonly database")
+
+	ensure.Nil(t, c.Close())
+	ensure.Nil(t, p.Stop())
+	ensure.Nil(t, server.Close())
+	ensure.DeepEqual(t, <-forwarded, 0)
+}
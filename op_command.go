@@ -0,0 +1,37 @@
+package dvara
+
+import (
+	"io"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OP_COMMAND and OP_COMMANDREPLY were used by some MongoDB 3.2 era drivers.
+// They are no longer documented, the layout follows the server implementation
+// in src/mongo/rpc/command_request.cpp and command_reply.cpp:
+//
+//	OP_COMMAND:      database, commandName, commandArgs, metadata, inputDocs
+//	OP_COMMANDREPLY: commandReply, metadata, outputDocs
+
+// emptyDocument is the wire representation of {}.
+var emptyDocument = []byte{5, 0, 0, 0, 0}
+
+// writeCommandReply writes an OpCommandReply with the given reply document and
+// no metadata in response to the given request.
+func writeCommandReply(w io.Writer, responseTo int32, reply interface{}) error {
+	b, err := bson.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	b = append(b, emptyDocument...)
+	h := messageHeader{
+		MessageLength: int32(headerLen + len(b)),
+		RequestID:     responseTo,
+		ResponseTo:    responseTo,
+		OpCode:        OpCommandReply,
+	}
+	if _, err := w.Write(append(h.ToWire(), b...)); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package dvara
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func fakeCommand(db, name string, args, metadata interface{}, inputDocs ...interface{}) []byte {
+	body := addCString(nil, db)
+	body = addCString(body, name)
+	body = append(body, mustMarshal(args)...)
+	body = append(body, mustMarshal(metadata)...)
+	for _, doc := range inputDocs {
+		body = append(body, mustMarshal(doc)...)
+	}
+	h := messageHeader{
+		OpCode:        OpCommand,
+		MessageLength: int32(headerLen + len(body)),
+		RequestID:     11,
+	}
+	return append(h.ToWire(), body...)
+}
+
+func fakeCommandReply(reply, metadata interface{}) []byte {
+	body := append(mustMarshal(reply), mustMarshal(metadata)...)
+	h := messageHeader{
+		OpCode:        OpCommandReply,
+		MessageLength: int32(headerLen + len(body)),
+		ResponseTo:    11,
+	}
+	return append(h.ToWire(), body...)
+}
+
+func TestProxiedMessageCommand(t *testing.T) {
+	t.Parallel()
+	raw := fakeCommand(
+		"test", "insert",
+		bson.D{{Name: "insert", Value: "foo"}},
+		bson.M{"$ssm": bson.M{"$secondaryOk": true}},
+		bson.M{"_id": 1}, bson.M{"_id": 2},
+	)
+	r := bytes.NewReader(raw)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(h, fakeReadWriter{Reader: r}, fakeReadWriter{Writer: &server}, &lastError)
+
+	name, err := message.GetCommandName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "insert" {
+		t.Fatalf("did not get expected command name, got %q", name)
+	}
+	ns, err := message.GetFullCollectionName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ns) != "test.$cmd\000" {
+		t.Fatalf("did not get expected collection name, got %q", ns)
+	}
+	q, err := message.GetQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*q, bson.D{{Name: "insert", Value: "foo"}}) {
+		t.Fatalf("did not get expected arguments, got %v", *q)
+	}
+	metadata, err := message.GetCommandMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m bson.M
+	if err := bson.Unmarshal(metadata, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["$ssm"] == nil {
+		t.Fatalf("did not get expected metadata, got %v", m)
+	}
+
+	// the input documents are still pending and forwarded along with the rest
+	if err := message.forward(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, server.Bytes()) {
+		t.Fatal("did not forward entire message")
+	}
+}
+
+func TestProxyQueryCommandIsMaster(t *testing.T) {
+	t.Parallel()
+	p := &ProxyQuery{
+		IsMasterResponseRewriter: &IsMasterResponseRewriter{
+			ProxyMapper: fakeProxyMapper{m: map[string]string{"a": "1"}},
+			ReplyRW:     &ReplyRW{},
+		},
+	}
+	request := fakeCommand("admin", "isMaster", bson.M{"isMaster": 1}, bson.M{})
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := bson.M{"$gleStats": bson.M{"electionId": "x"}}
+	reply := fakeCommandReply(bson.M{"me": "a", "ok": 1}, metadata)
+
+	var client, server bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(
+		h,
+		fakeReadWriter{Reader: r, Writer: &client},
+		fakeReadWriter{Reader: bytes.NewReader(reply), Writer: &server},
+		&lastError,
+	)
+	if err := p.Proxy(&message); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(request, server.Bytes()) {
+		t.Fatal("did not forward expected request")
+	}
+
+	out := client.Bytes()
+	ch, err := readHeader(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.OpCode != OpCommandReply || int(ch.MessageLength) != len(out) {
+		t.Fatalf("did not get expected header, got %s for %d bytes", ch, len(out))
+	}
+	docs, err := splitDocuments(out[headerLen:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("expected reply and metadata, got %d documents", len(docs))
+	}
+	var actualOut bson.M
+	if err := bson.Unmarshal(docs[0], &actualOut); err != nil {
+		t.Fatal(err)
+	}
+	if actualOut["me"] != "1" {
+		t.Fatalf("did not get expected output, got %v", actualOut)
+	}
+	if !bytes.Equal(docs[1], mustMarshal(metadata)) {
+		t.Fatal("did not keep metadata")
+	}
+}
+
+func TestReadCommandReplyOutputDocs(t *testing.T) {
+	t.Parallel()
+	reply := fakeCommandReply(bson.M{"ok": 1}, bson.M{})
+	reply = append(reply, mustMarshal(bson.M{"_id": 1})...)
+	setInt32(reply, 0, int32(len(reply)))
+	var v bson.M
+	_, _, _, err := (&ReplyRW{}).ReadOne(bytes.NewReader(reply), &v)
+	if err == nil || err.Error() != "readOneReplyDoc: can only handle a reply and metadata, got 3 documents" {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+}
+
+func TestRejectCommand(t *testing.T) {
+	t.Parallel()
+	request := fakeCommand("test", "insert", bson.M{"insert": "foo"}, bson.M{}, bson.M{"_id": 1})
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(h, fakeReadWriter{Reader: r, Writer: &client}, fakeReadWriter{}, &lastError)
+	if _, err := message.GetQuery(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&ProxyQuery{}).rejectCommand(&message, "Readonly database", 66); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 0 {
+		t.Fatal("did not read the entire request")
+	}
+
+	var out bson.M
+	var rw ReplyRW
+	rh, _, _, err := rw.ReadOne(&client, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rh.OpCode != OpCommandReply || rh.ResponseTo != 11 {
+		t.Fatalf("did not get expected header, got %s", rh)
+	}
+	if out["ok"] != 0 || out["code"] != 66 || out["errmsg"] != "Readonly database" {
+		t.Fatalf("did not get expected error, got %v", out)
+	}
+}
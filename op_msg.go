@@ -0,0 +1,317 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Look at https://github.com/mongodb/specifications/blob/master/source/message/OP_MSG.rst
+// for the OP_MSG format.
+
+// The OP_MSG flag bits. Unknown bits in the lower 16 are an error, unknown
+// bits in the upper 16 can be ignored.
+const (
+	MsgChecksumPresent = uint32(1 << 0)
+	MsgMoreToCome      = uint32(1 << 1)
+	MsgExhaustAllowed  = uint32(1 << 16)
+)
+
+// The OP_MSG section kinds.
+const (
+	// SectionBody is a single BSON document, the command itself.
+	SectionBody = byte(0)
+	// SectionDocumentSequence is a named sequence of BSON documents, for
+	// example the documents of an insert command.
+	SectionDocumentSequence = byte(1)
+)
+
+var (
+	errMsgTooShort       = errors.New("dvara: OP_MSG too short")
+	errMsgNoBody         = errors.New("dvara: OP_MSG without a body section")
+	errMsgMultipleBodies = errors.New("dvara: OP_MSG with more than one body section")
+	errMsgChecksum       = errors.New("dvara: OP_MSG checksum mismatch")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// MsgSection is a single section of an OP_MSG.
+type MsgSection struct {
+	// Kind is either SectionBody or SectionDocumentSequence.
+	Kind byte
+
+	// Identifier names a document sequence. It is empty for a body section.
+	Identifier string
+
+	// Documents holds the raw BSON documents in the section. A body section
+	// always has exactly one.
+	Documents [][]byte
+}
+
+// opMsg is a parsed OP_MSG, everything that follows the message header.
+type opMsg struct {
+	flags    uint32
+	sections []MsgSection
+	checksum uint32
+}
+
+// parseMsg parses the body of an OP_MSG, that is everything after the header.
+func parseMsg(b []byte) (*opMsg, error) {
+	if len(b) < 5 {
+		return nil, errMsgTooShort
+	}
+	m := &opMsg{flags: uint32(getInt32(b, 0))}
+	end := len(b)
+	if m.flags&MsgChecksumPresent != 0 {
+		if end < 9 {
+			return nil, errMsgTooShort
+		}
+		end -= 4
+		m.checksum = uint32(getInt32(b, end))
+	}
+
+	var bodies int
+	for pos := 4; pos < end; {
+		kind := b[pos]
+		pos++
+		switch kind {
+		case SectionBody:
+			doc, err := sliceDocument(b[pos:end])
+			if err != nil {
+				return nil, err
+			}
+			pos += len(doc)
+			m.sections = append(m.sections, MsgSection{Kind: kind, Documents: [][]byte{doc}})
+			bodies++
+		case SectionDocumentSequence:
+			if end-pos < 4 {
+				return nil, errMsgTooShort
+			}
+			size := int(getInt32(b, pos))
+			if size < 5 || size > end-pos {
+				return nil, errMsgTooShort
+			}
+			seq := b[pos+4 : pos+size]
+			pos += size
+			i := 0
+			for i < len(seq) && seq[i] != x00 {
+				i++
+			}
+			if i == len(seq) {
+				return nil, errMsgTooShort
+			}
+			docs, err := splitDocuments(seq[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			m.sections = append(m.sections, MsgSection{
+				Kind:       kind,
+				Identifier: string(seq[:i]),
+				Documents:  docs,
+			})
+		default:
+			return nil, fmt.Errorf("dvara: unknown OP_MSG section kind %d", kind)
+		}
+	}
+
+	if bodies == 0 {
+		return nil, errMsgNoBody
+	}
+	if bodies > 1 {
+		return nil, errMsgMultipleBodies
+	}
+	return m, nil
+}
+
+// body returns the raw document of the body section.
+func (m *opMsg) body() []byte {
+	for _, s := range m.sections {
+		if s.Kind == SectionBody {
+			return s.Documents[0]
+		}
+	}
+	return nil
+}
+
+// setBody replaces the raw document of the body section.
+func (m *opMsg) setBody(doc []byte) {
+	for i, s := range m.sections {
+		if s.Kind == SectionBody {
+			m.sections[i].Documents = [][]byte{doc}
+			return
+		}
+	}
+}
+
+// bytes returns the wire representation of the message without the header.
+// The checksum, if any, is carried over as is. Use wire to get a message with
+// a valid checksum.
+func (m *opMsg) bytes() []byte {
+	b := addInt32(nil, int32(m.flags))
+	for _, s := range m.sections {
+		b = append(b, s.Kind)
+		switch s.Kind {
+		case SectionBody:
+			b = append(b, s.Documents[0]...)
+		case SectionDocumentSequence:
+			start := len(b)
+			b = addInt32(b, 0)
+			b = addCString(b, s.Identifier)
+			for _, doc := range s.Documents {
+				b = append(b, doc...)
+			}
+			setInt32(b, start, int32(len(b)-start))
+		}
+	}
+	if m.flags&MsgChecksumPresent != 0 {
+		b = addInt32(b, int32(m.checksum))
+	}
+	return b
+}
+
+// wire returns the wire representation of the message including the header.
+// The message length and op code of the header are set to match, and the
+// checksum is regenerated if the message has one.
+func (m *opMsg) wire(h messageHeader) []byte {
+	body := m.bytes()
+	h.MessageLength = int32(headerLen + len(body))
+	h.OpCode = OpMsg
+	b := append(h.ToWire(), body...)
+	if m.flags&MsgChecksumPresent != 0 {
+		m.checksum = msgChecksum(b[:len(b)-4])
+		setInt32(b, len(b)-4, int32(m.checksum))
+	}
+	return b
+}
+
+// msgChecksum returns the CRC-32C of the given parts of a message.
+func msgChecksum(parts ...[]byte) uint32 {
+	var crc uint32
+	for _, p := range parts {
+		crc = crc32.Update(crc, castagnoli, p)
+	}
+	return crc
+}
+
+// verifyMsgChecksum verifies the checksum of an OpMsg, if it has one, given
+// its header and everything that follows it.
+func verifyMsgChecksum(h *messageHeader, body []byte) error {
+	if len(body) < 4 || uint32(getInt32(body, 0))&MsgChecksumPresent == 0 {
+		return nil
+	}
+	if len(body) < 8 {
+		return errMsgTooShort
+	}
+	end := len(body) - 4
+	if msgChecksum(h.ToWire(), body[:end]) != uint32(getInt32(body, end)) {
+		return errMsgChecksum
+	}
+	return nil
+}
+
+// writeMsg writes an OpMsg with the given request id.
+func writeMsg(w io.Writer, requestID int32, m *opMsg) error {
+	b := m.wire(messageHeader{RequestID: requestID})
+	n, err := w.Write(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return errWrite
+	}
+	return nil
+}
+
+// readMsg reads an entire OpMsg.
+func readMsg(r io.Reader) (*messageHeader, *opMsg, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.OpCode != OpMsg {
+		return nil, nil, fmt.Errorf("dvara: expected op %s, got %s", OpMsg, h.OpCode)
+	}
+	size := h.MessageLength - headerLen
+	if size < 0 {
+		return nil, nil, errMessageLength
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if err := verifyMsgChecksum(h, body); err != nil {
+		return nil, nil, err
+	}
+	m, err := parseMsg(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, m, nil
+}
+
+// flusher is implemented by client connections that buffer replies.
+type flusher interface {
+	Flush() error
+}
+
+// copyMsgReplies copies the replies to an OpMsg request. The server streams
+// replies with the moreToCome flag set in response to requests that allow
+// exhaust, these are all copied until one without the flag. Checksums are
+// verified along the way.
+func copyMsgReplies(w io.Writer, r io.Reader) error {
+	for {
+		h, err := readHeader(r)
+		if err != nil {
+			return err
+		}
+		size := int64(h.MessageLength - headerLen)
+		if h.OpCode != OpMsg {
+			if err := h.WriteTo(w); err != nil {
+				return err
+			}
+			_, err = io.CopyN(w, r, size)
+			return err
+		}
+		if size < 5 {
+			return errMsgTooShort
+		}
+
+		var flagBits [4]byte
+		if _, err := io.ReadFull(r, flagBits[:]); err != nil {
+			return err
+		}
+		flags := uint32(getInt32(flagBits[:], 0))
+		if flags&MsgChecksumPresent != 0 {
+			// the entire message is needed to verify the checksum
+			body := make([]byte, size)
+			copy(body, flagBits[:])
+			if _, err := io.ReadFull(r, body[4:]); err != nil {
+				return err
+			}
+			if err := verifyMsgChecksum(h, body); err != nil {
+				return err
+			}
+			if _, err := w.Write(append(h.ToWire(), body...)); err != nil {
+				return err
+			}
+		} else {
+			if _, err := w.Write(append(h.ToWire(), flagBits[:]...)); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, r, size-4); err != nil {
+				return err
+			}
+		}
+
+		if flags&MsgMoreToCome == 0 {
+			return nil
+		}
+		// send each streamed reply on as it arrives
+		if f, ok := w.(flusher); ok {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package dvara
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func mustMarshal(v interface{}) []byte {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func fakeMsg(m *opMsg) []byte {
+	return m.wire(messageHeader{RequestID: 7})
+}
+
+func TestParseMsgRoundTrip(t *testing.T) {
+	t.Parallel()
+	in := &opMsg{
+		flags: MsgMoreToCome,
+		sections: []MsgSection{
+			{
+				Kind:      SectionBody,
+				Documents: [][]byte{mustMarshal(bson.D{{Name: "insert", Value: "foo"}, {Name: "$db", Value: "test"}})},
+			},
+			{
+				Kind:       SectionDocumentSequence,
+				Identifier: "documents",
+				Documents: [][]byte{
+					mustMarshal(bson.M{"_id": 1}),
+					mustMarshal(bson.M{"_id": 2}),
+				},
+			},
+		},
+	}
+	out, err := parseMsg(in.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("did not get expected message, got %+v", out)
+	}
+	if !bytes.Equal(in.bytes(), out.bytes()) {
+		t.Fatal("did not get the same bytes back")
+	}
+}
+
+func TestParseMsgErrors(t *testing.T) {
+	t.Parallel()
+	body := mustMarshal(bson.M{"ping": 1})
+	cases := []struct {
+		Name  string
+		Data  []byte
+		Error string
+	}{
+		{
+			Name:  "too short",
+			Data:  []byte{0, 0, 0, 0},
+			Error: errMsgTooShort.Error(),
+		},
+		{
+			Name:  "unknown section kind",
+			Data:  append([]byte{0, 0, 0, 0, 2}, body...),
+			Error: "dvara: unknown OP_MSG section kind 2",
+		},
+		{
+			Name:  "truncated body",
+			Data:  append([]byte{0, 0, 0, 0, 0}, body[:len(body)-1]...),
+			Error: errDocument.Error(),
+		},
+		{
+			Name:  "no body",
+			Data:  []byte{0, 0, 0, 0, 1, 6, 0, 0, 0, 'a', 0},
+			Error: errMsgNoBody.Error(),
+		},
+		{
+			Name:  "two bodies",
+			Data:  append(append([]byte{0, 0, 0, 0, 0}, body...), append([]byte{0}, body...)...),
+			Error: errMsgMultipleBodies.Error(),
+		},
+		{
+			Name:  "sequence longer than message",
+			Data:  append(append([]byte{0, 0, 0, 0, 0}, body...), 1, 99, 0, 0, 0, 'a', 0),
+			Error: errMsgTooShort.Error(),
+		},
+	}
+	for _, c := range cases {
+		_, err := parseMsg(c.Data)
+		if err == nil || err.Error() != c.Error {
+			t.Errorf("did not get expected error for case %s, instead got %v", c.Name, err)
+		}
+	}
+}
+
+func TestProxiedMessageMsgSections(t *testing.T) {
+	t.Parallel()
+	raw := fakeMsg(&opMsg{
+		sections: []MsgSection{
+			{
+				Kind:      SectionBody,
+				Documents: [][]byte{mustMarshal(bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}})},
+			},
+		},
+	})
+	r := bytes.NewReader(raw)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(h, fakeReadWriter{Reader: r}, fakeReadWriter{Writer: &server}, &lastError)
+
+	q, err := message.GetQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*q) != 2 || (*q)[0].Name != "find" {
+		t.Fatalf("did not get expected body, got %v", *q)
+	}
+	name, err := message.GetFullCollectionName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(name) != "test.$cmd\000" {
+		t.Fatalf("did not get expected collection name, got %q", name)
+	}
+	sections, err := message.GetSections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != 1 || sections[0].Kind != SectionBody {
+		t.Fatalf("did not get expected sections, got %v", sections)
+	}
+
+	// The body was consumed by the calls above, forwarding must still send the
+	// entire message.
+	if err := message.forward(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, server.Bytes()) {
+		t.Fatalf("did not forward expected bytes %v got %v", raw, server.Bytes())
+	}
+}
+
+func TestVerifyMsgChecksum(t *testing.T) {
+	t.Parallel()
+	raw := fakeMsg(&opMsg{
+		flags: MsgChecksumPresent,
+		sections: []MsgSection{
+			{Kind: SectionBody, Documents: [][]byte{mustMarshal(bson.M{"ping": 1})}},
+		},
+	})
+	h, err := readHeader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyMsgChecksum(h, raw[headerLen:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a bit in the body
+	corrupt := append([]byte(nil), raw...)
+	corrupt[headerLen+10] ^= 1
+	if err := verifyMsgChecksum(h, corrupt[headerLen:]); err != errMsgChecksum {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+	_, _, err = readMsg(bytes.NewReader(corrupt))
+	if err != errMsgChecksum {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+
+	// the checksum covers the header too
+	h.RequestID++
+	if err := verifyMsgChecksum(h, raw[headerLen:]); err != errMsgChecksum {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+}
+
+type flushCounter struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (f *flushCounter) Flush() error {
+	f.flushes++
+	return nil
+}
+
+func TestCopyMsgRepliesExhaust(t *testing.T) {
+	t.Parallel()
+	reply := func(flags uint32, n int) []byte {
+		return fakeMsg(&opMsg{
+			flags: flags,
+			sections: []MsgSection{
+				{Kind: SectionBody, Documents: [][]byte{mustMarshal(bson.M{"n": n})}},
+			},
+		})
+	}
+	var replies []byte
+	replies = append(replies, reply(MsgMoreToCome, 1)...)
+	replies = append(replies, reply(MsgMoreToCome|MsgChecksumPresent, 2)...)
+	replies = append(replies, reply(0, 3)...)
+	trailing := reply(0, 4)
+	server := bytes.NewReader(append(replies, trailing...))
+
+	var client flushCounter
+	if err := copyMsgReplies(&client, server); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(replies, client.Bytes()) {
+		t.Fatal("did not copy the streamed replies")
+	}
+	if client.flushes != 2 {
+		t.Fatalf("expected 2 flushes, got %d", client.flushes)
+	}
+	if server.Len() != len(trailing) {
+		t.Fatal("copied past the last streamed reply")
+	}
+}
+
+func TestCopyMsgRepliesChecksum(t *testing.T) {
+	t.Parallel()
+	raw := fakeMsg(&opMsg{
+		flags: MsgChecksumPresent,
+		sections: []MsgSection{
+			{Kind: SectionBody, Documents: [][]byte{mustMarshal(bson.M{"ok": 1})}},
+		},
+	})
+	raw[len(raw)-1] ^= 1
+	var client bytes.Buffer
+	if err := copyMsgReplies(&client, bytes.NewReader(raw)); err != errMsgChecksum {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+	if client.Len() != 0 {
+		t.Fatal("corrupt reply was copied")
+	}
+}
@@ -0,0 +1,75 @@
+package dvara
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// PriorityClass is a class of clients that gets server connections ahead of
+// the clients of lower classes, and can have a share of them reserved.
+type PriorityClass struct {
+	// Name is the name of the class, used in logs.
+	Name string
+
+	// Share is the share of the server connections to each mongo node that
+	// clients of lower classes can't use, between 0 and 1. It is a share of
+	// MaxConnections, or of the adaptive limit while that is lower.
+	Share float64
+
+	// Networks, TLSSubjects and AppNames are the remote addresses, subjects of
+	// the client certificate and appNames sent by the driver of the clients in
+	// the class. A client is in the class if any of them match.
+	Networks    []*net.IPNet
+	TLSSubjects []string
+	AppNames    []string
+}
+
+// checkPriorityClasses makes sure the shares of the classes are positive and
+// leave at most all server connections reserved.
+func (r *ReplicaSet) checkPriorityClasses() error {
+	total := 0.0
+	for _, class := range r.PriorityClasses {
+		if class.Share < 0 {
+			return errInvalidPriorityShare
+		}
+		total += class.Share
+	}
+	if total > 1 {
+		return errInvalidPriorityShare
+	}
+	return nil
+}
+
+// matches tells us if a client is in the class.
+func (c *PriorityClass) matches(ip net.IP, subject, appName string) bool {
+	for _, n := range c.Networks {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	if subject != "" {
+		for _, s := range c.TLSSubjects {
+			if s == subject {
+				return true
+			}
+		}
+	}
+	if appName != "" {
+		for _, a := range c.AppNames {
+			if a == appName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tlsSubject returns the subject of the client certificate, if there is one.
+func tlsSubject(tlsConn *tls.Conn) string {
+	if tlsConn != nil {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			return certs[0].Subject.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,195 @@
+package dvara
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// tlsServerConn returns the server side of a TLS connection once the client
+// presented a certificate for the given common name.
+func tlsServerConn(t *testing.T, commonName string) *tls.Conn {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	client := tls.Client(c, &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	})
+	server := tls.Server(s, &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		ClientAuth:             tls.RequireAnyClientCert,
+		SessionTicketsDisabled: true,
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.Handshake()
+	}()
+	if err := server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestProxyClientClass(t *testing.T) {
+	t.Parallel()
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	p := &Proxy{ReplicaSet: &ReplicaSet{
+		PriorityClasses: []PriorityClass{
+			{Name: "health", Networks: []*net.IPNet{local}},
+			{Name: "ops", AppNames: []string{"mongo shell"}},
+		},
+	}}
+	cases := []struct {
+		RemoteIP string
+		AppName  string
+		Class    int
+	}{
+		{"127.0.0.1", "", 0},
+		{"127.0.0.1", "mongo shell", 0},
+		{"10.0.0.1", "mongo shell", 1},
+		{"10.0.0.1", "web", 2},
+		{"10.0.0.1", "", 2},
+	}
+	for _, c := range cases {
+		if class := p.clientClass(c.RemoteIP, nil, c.AppName); class != c.Class {
+			t.Fatalf("for %s %q expected %d but got %d", c.RemoteIP, c.AppName, c.Class, class)
+		}
+	}
+	if class := (&Proxy{ReplicaSet: &ReplicaSet{}}).clientClass("10.0.0.1", nil, ""); class != 0 {
+		t.Fatalf("expected class 0 without classes but got %d", class)
+	}
+}
+
+func TestInvalidPriorityShare(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{
+		MaxConnections:          10,
+		MaxPerClientConnections: 10,
+		PriorityClasses:         []PriorityClass{{Share: 0.6}, {Share: 0.6}},
+	}}
+	if err := p.Start(); err != errInvalidPriorityShare {
+		t.Fatalf("expected %s but got %v", errInvalidPriorityShare, err)
+	}
+}
+
+func TestProxyClientIdentity(t *testing.T) {
+	t.Parallel()
+	tlsConn := tlsServerConn(t, "batch")
+	cases := []struct {
+		By       string
+		TLSConn  *tls.Conn
+		AppName  string
+		Identity string
+	}{
+		{"", tlsConn, "web", ""},
+		{fairQueueByIP, tlsConn, "web", "10.0.0.1"},
+		{fairQueueByApp, tlsConn, "web", "web"},
+		{fairQueueByApp, nil, "", "10.0.0.1"},
+		{fairQueueByTLS, tlsConn, "web", "CN=batch"},
+		{fairQueueByTLS, nil, "web", "10.0.0.1"},
+	}
+	for _, c := range cases {
+		p := &Proxy{ReplicaSet: &ReplicaSet{FairQueueBy: c.By}}
+		if identity := p.clientIdentity("10.0.0.1", c.TLSConn, c.AppName); identity != c.Identity {
+			t.Fatalf("for %q expected %q but got %q", c.By, c.Identity, identity)
+		}
+	}
+}
+
+func TestClientOwner(t *testing.T) {
+	t.Parallel()
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	ensure.DeepEqual(t, clientOwner(addr, ""), "10.0.0.1:5000")
+	ensure.DeepEqual(t, clientOwner(addr, "web"), "10.0.0.1:5000 web")
+}
+
+func TestProxySnapshotClient(t *testing.T) {
+	t.Parallel()
+
+	// the server holds on to the request until it is closed
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := server.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			MessageTimeout:          5 * time.Second,
+			ClientIdleTimeout:       5 * time.Second,
+			ServerIdleTimeout:       time.Second,
+			ServerClosePoolSize:     1,
+			ProxyQuery:              &ProxyQuery{},
+		},
+		ClientListener: listener,
+		ProxyAddr:      listener.Addr().String(),
+		MongoAddr:      server.Addr().String(),
+	}
+	ensure.Nil(t, p.Start())
+
+	// without fair queueing the client is still named in the snapshot
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	_, err = c.Write(fakeMsg(&opMsg{
+		sections: []MsgSection{{
+			Kind:      SectionBody,
+			Documents: [][]byte{mustMarshal(bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}})},
+		}},
+	}))
+	ensure.Nil(t, err)
+	sc := <-accepted
+	var acquired []AcquiredSnapshot
+	for deadline := time.Now().Add(5 * time.Second); len(acquired) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("server connection was never acquired")
+		}
+		time.Sleep(time.Millisecond)
+		acquired = p.Snapshot().Pool.Acquired
+	}
+	ensure.DeepEqual(t, acquired[0].Client, c.LocalAddr().String())
+
+	ensure.Nil(t, sc.Close())
+	ensure.Nil(t, c.Close())
+	ensure.Nil(t, p.Stop())
+	ensure.Nil(t, server.Close())
+}
@@ -4,12 +4,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync/atomic"
 
 	"gopkg.in/mgo.v2/bson"
 )
 
 var (
-	errWrite = errors.New("incorrect number of bytes written")
+	errWrite    = errors.New("incorrect number of bytes written")
+	errDocument = errors.New("dvara: malformed BSON document")
+
+	errMessageTooShort  = errors.New("dvara: message too short for its op code")
+	errMessageTooLong   = errors.New("dvara: message longer than the maximum message length")
+	errDocumentTooLarge = errors.New("dvara: BSON document larger than the maximum document size")
+	errCStringTooLong   = errors.New("dvara: cstring longer than the maximum cstring length")
 )
 
 // Look at http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/ for the protocol.
@@ -42,6 +49,14 @@ func (c OpCode) String() string {
 		return "DELETE"
 	case OpKillCursors:
 		return "KILL_CURSORS"
+	case OpCommand:
+		return "COMMAND"
+	case OpCommandReply:
+		return "COMMAND_REPLY"
+	case OpCompressed:
+		return "COMPRESSED"
+	case OpMsg:
+		return "MSG"
 	}
 }
 
@@ -53,21 +68,25 @@ func (c OpCode) IsMutation() bool {
 
 // HasResponse tells us if the operation will have a response from the server.
 func (c OpCode) HasResponse() bool {
-	return c == OpQuery || c == OpGetMore
+	return c == OpQuery || c == OpGetMore || c == OpCommand || c == OpMsg
 }
 
 // The full set of known request op codes:
 // http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/#request-opcodes
 const (
-	OpReply       = OpCode(1)
-	OpMessage     = OpCode(1000)
-	OpUpdate      = OpCode(2001)
-	OpInsert      = OpCode(2002)
-	Reserved      = OpCode(2003)
-	OpQuery       = OpCode(2004)
-	OpGetMore     = OpCode(2005)
-	OpDelete      = OpCode(2006)
-	OpKillCursors = OpCode(2007)
+	OpReply        = OpCode(1)
+	OpMessage      = OpCode(1000)
+	OpUpdate       = OpCode(2001)
+	OpInsert       = OpCode(2002)
+	Reserved       = OpCode(2003)
+	OpQuery        = OpCode(2004)
+	OpGetMore      = OpCode(2005)
+	OpDelete       = OpCode(2006)
+	OpKillCursors  = OpCode(2007)
+	OpCommand      = OpCode(2010)
+	OpCommandReply = OpCode(2011)
+	OpCompressed   = OpCode(2012)
+	OpMsg          = OpCode(2013)
 )
 
 // messageHeader is the mongo MessageHeader
@@ -136,6 +155,127 @@ func readHeader(r io.Reader) (*messageHeader, error) {
 	return &h, nil
 }
 
+// The wire protocol limits. The maximum message length and document size
+// start out at the MongoDB defaults and follow what the backend advertises in
+// its isMaster replies. The maximum message length can be configured instead.
+const (
+	defaultMaxMessageLength = 48000000
+	defaultMaxDocumentSize  = 16 * 1024 * 1024
+
+	// documentSizeSlack allows for the fields the server adds to a document of
+	// the maximum size in command replies.
+	documentSizeSlack = 16 * 1024
+
+	// maxCStringLength bounds namespaces, database and command names.
+	maxCStringLength = 1024
+)
+
+// wireLimits holds the current maximums of a replica set, they are accessed
+// atomically. The zero value, like a nil one, has the MongoDB defaults.
+type wireLimits struct {
+	maxMessageLength int32
+	maxDocumentSize  int32
+	configured       int32
+}
+
+// configure fixes the maximum message length, the backend's value is ignored
+// from here on.
+func (l *wireLimits) configure(maxMessageLength int32) {
+	atomic.StoreInt32(&l.configured, 1)
+	atomic.StoreInt32(&l.maxMessageLength, maxMessageLength)
+}
+
+// learn records the limits the backend advertises. Zero values are ignored.
+func (l *wireLimits) learn(maxMessageLength, maxDocumentSize int32) {
+	if maxMessageLength > 0 && atomic.LoadInt32(&l.configured) == 0 {
+		atomic.StoreInt32(&l.maxMessageLength, maxMessageLength)
+	}
+	if maxDocumentSize > 0 {
+		atomic.StoreInt32(&l.maxDocumentSize, maxDocumentSize)
+	}
+}
+
+func (l *wireLimits) messageLength() int32 {
+	if l == nil {
+		return defaultMaxMessageLength
+	}
+	if n := atomic.LoadInt32(&l.maxMessageLength); n > 0 {
+		return n
+	}
+	return defaultMaxMessageLength
+}
+
+func (l *wireLimits) documentSize() int32 {
+	if l == nil {
+		return defaultMaxDocumentSize + documentSizeSlack
+	}
+	if n := atomic.LoadInt32(&l.maxDocumentSize); n > 0 {
+		return n + documentSizeSlack
+	}
+	return defaultMaxDocumentSize + documentSizeSlack
+}
+
+// minMessageLength returns the length of the smallest valid message with the
+// given op code.
+func minMessageLength(c OpCode) int32 {
+	const (
+		int32Len  = 4
+		int64Len  = 8
+		cstring   = 1
+		document  = 5
+		replyLen  = opReplyPrefixLen
+		sectionID = 1
+	)
+	switch c {
+	case OpReply:
+		return headerLen + replyLen
+	case OpUpdate:
+		return headerLen + int32Len + cstring + int32Len + 2*document
+	case OpInsert:
+		return headerLen + int32Len + cstring + document
+	case OpQuery:
+		return headerLen + int32Len + cstring + 2*int32Len + document
+	case OpGetMore:
+		return headerLen + int32Len + cstring + int32Len + int64Len
+	case OpDelete:
+		return headerLen + int32Len + cstring + int32Len + document
+	case OpKillCursors:
+		return headerLen + 2*int32Len
+	case OpCommand:
+		return headerLen + 2*cstring + 2*document
+	case OpCommandReply:
+		return headerLen + 2*document
+	case OpCompressed:
+		return headerLen + compressedPrefixLen
+	case OpMsg:
+		return headerLen + int32Len + sectionID + document
+	}
+	return headerLen
+}
+
+// checkHeader validates the message length of a header read from a client
+// against the limits of its replica set.
+func checkHeader(h *messageHeader, limits *wireLimits) error {
+	if h.MessageLength < minMessageLength(h.OpCode) {
+		return errMessageTooShort
+	}
+	if h.MessageLength > limits.messageLength() {
+		return errMessageTooLong
+	}
+	return nil
+}
+
+// isLimitError tells us if the error is the result of a message violating the
+// wire protocol limits.
+func isLimitError(err error) bool {
+	switch err {
+	case errMessageTooShort, errMessageTooLong, errDocumentTooLarge,
+		errCStringTooLong, errDocument, errMessageLength:
+		return true
+	}
+	return false
+}
+
 // copyMessage copies reads & writes an entire message.
 func copyMessage(w io.Writer, r io.Reader) error {
 	h, err := readHeader(r)
@@ -149,14 +289,20 @@ func copyMessage(w io.Writer, r io.Reader) error {
 	return err
 }
 
-// readDocument read an entire BSON document. This document can be used with
-// bson.Unmarshal.
-func readDocument(r io.Reader) ([]byte, error) {
+// readDocument read an entire BSON document no larger than the limits allow.
+// This document can be used with bson.Unmarshal.
+func readDocument(r io.Reader, limits *wireLimits) ([]byte, error) {
 	var sizeRaw [4]byte
 	if _, err := io.ReadFull(r, sizeRaw[:]); err != nil {
 		return nil, err
 	}
 	size := getInt32(sizeRaw[:], 0)
+	if size < 5 {
+		return nil, errDocument
+	}
+	if size > limits.documentSize() {
+		return nil, errDocumentTooLarge
+	}
 	doc := make([]byte, size)
 	setInt32(doc, 0, size)
 	if _, err := io.ReadFull(r, doc[4:]); err != nil {
@@ -165,6 +311,34 @@ func readDocument(r io.Reader) ([]byte, error) {
 	return doc, nil
 }
 
+// sliceDocument returns the BSON document at the start of b without copying
+// it.
+func sliceDocument(b []byte) ([]byte, error) {
+	if len(b) < 5 {
+		return nil, errDocument
+	}
+	size := int(getInt32(b, 0))
+	if size < 5 || size > len(b) || b[size-1] != x00 {
+		return nil, errDocument
+	}
+	return b[:size], nil
+}
+
+// splitDocuments splits b, a series of BSON documents, into the individual
+// documents without copying them.
+func splitDocuments(b []byte) ([][]byte, error) {
+	var docs [][]byte
+	for len(b) > 0 {
+		doc, err := sliceDocument(b)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+		b = b[len(doc):]
+	}
+	return docs, nil
+}
+
 const x00 = byte(0)
 
 // readCString reads a null turminated string as defined by BSON from the
@@ -180,6 +354,9 @@ func readCString(r io.Reader) ([]byte, error) {
 		if n[0] == x00 {
 			return b, nil
 		}
+		if len(b) >= maxCStringLength {
+			return nil, errCStringTooLong
+		}
 	}
 }
 
@@ -241,3 +418,8 @@ func getInt64(b []byte, pos int) int64 {
 		(int64(b[pos+6]) << 48) |
 		(int64(b[pos+7]) << 56)
 }
+
+func addInt64(b []byte, i int64) []byte {
+	return append(b, byte(i), byte(i>>8), byte(i>>16), byte(i>>24),
+		byte(i>>32), byte(i>>40), byte(i>>48), byte(i>>56))
+}
@@ -35,6 +35,10 @@ func TestOpStrings(t *testing.T) {
 		{OpGetMore, "GET_MORE"},
 		{OpDelete, "DELETE"},
 		{OpKillCursors, "KILL_CURSORS"},
+		{OpCommand, "COMMAND"},
+		{OpCommandReply, "COMMAND_REPLY"},
+		{OpCompressed, "COMPRESSED"},
+		{OpMsg, "MSG"},
 	}
 	for _, c := range cases {
 		if c.OpCode.String() != c.String {
@@ -115,7 +119,7 @@ func TestCopyMessageFromWriteLengthError(t *testing.T) {
 
 func TestReadDocumentEmpty(t *testing.T) {
 	t.Parallel()
-	doc, err := readDocument(bytes.NewReader([]byte{}))
+	doc, err := readDocument(bytes.NewReader([]byte{}), nil)
 	if err != io.EOF {
 		t.Fatal("did not find expected error")
 	}
@@ -137,7 +141,7 @@ func TestReadDocumentPartial(t *testing.T) {
 			return 0, io.EOF
 		},
 	}
-	doc, err := readDocument(r)
+	doc, err := readDocument(r, nil)
 	if err != io.EOF {
 		t.Fatalf("did not find expected error, instead got %s %v", err, doc)
 	}
@@ -169,3 +173,92 @@ func TestReadCString(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckHeader(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Header messageHeader
+		Error  error
+	}{
+		{messageHeader{OpCode: OpQuery, MessageLength: 0}, errMessageTooShort},
+		{messageHeader{OpCode: OpQuery, MessageLength: headerLen + 17}, errMessageTooShort},
+		{messageHeader{OpCode: OpQuery, MessageLength: headerLen + 18}, nil},
+		{messageHeader{OpCode: OpMsg, MessageLength: headerLen + 9}, errMessageTooShort},
+		{messageHeader{OpCode: OpMsg, MessageLength: -1}, errMessageTooShort},
+		{messageHeader{OpCode: OpCode(42), MessageLength: headerLen}, nil},
+		{messageHeader{OpCode: OpMsg, MessageLength: defaultMaxMessageLength + 1}, errMessageTooLong},
+	}
+	for _, c := range cases {
+		if err := checkHeader(&c.Header, nil); err != c.Error {
+			t.Fatalf("for %s expected %v but got %v", &c.Header, c.Error, err)
+		}
+	}
+}
+
+func TestReadDocumentLimits(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Size  int32
+		Error error
+	}{
+		{-1, errDocument},
+		{4, errDocument},
+		{defaultMaxDocumentSize + documentSizeSlack + 1, errDocumentTooLarge},
+	}
+	for _, c := range cases {
+		var b [4]byte
+		setInt32(b[:], 0, c.Size)
+		if _, err := readDocument(bytes.NewReader(b[:]), nil); err != c.Error {
+			t.Fatalf("for size %d expected %v but got %v", c.Size, c.Error, err)
+		}
+	}
+}
+
+func TestReadCStringTooLong(t *testing.T) {
+	t.Parallel()
+	long := bytes.Repeat([]byte{'a'}, maxCStringLength)
+	if _, err := readCString(bytes.NewReader(long)); err != errCStringTooLong {
+		t.Fatalf("did not find expected error, instead got %v", err)
+	}
+	ok := append(long[:maxCStringLength-1], 0)
+	if _, err := readCString(bytes.NewReader(ok)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWireLimits(t *testing.T) {
+	t.Parallel()
+	l := wireLimits{
+		maxMessageLength: defaultMaxMessageLength,
+		maxDocumentSize:  defaultMaxDocumentSize,
+	}
+	l.learn(1000, 0)
+	if l.messageLength() != 1000 || l.documentSize() != defaultMaxDocumentSize+documentSizeSlack {
+		t.Fatalf("did not learn limits, got %d %d", l.messageLength(), l.documentSize())
+	}
+	l.configure(2000)
+	l.learn(3000, 100)
+	if l.messageLength() != 2000 || l.documentSize() != 100+documentSizeSlack {
+		t.Fatalf("configured limit was not kept, got %d %d", l.messageLength(), l.documentSize())
+	}
+}
+
+func TestForwardLongerThanMessage(t *testing.T) {
+	t.Parallel()
+	// the collection name read runs past the declared message length
+	h := &messageHeader{OpCode: OpQuery, MessageLength: headerLen + 6}
+	body := addInt32(nil, 0)
+	body = addCString(body, "test.foo")
+	var server bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(h, fakeReadWriter{Reader: bytes.NewReader(body)}, fakeReadWriter{Writer: &server}, &lastError)
+	if _, err := message.GetFullCollectionName(); err != nil {
+		t.Fatal(err)
+	}
+	if err := message.forward(); err != errMessageLength {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+	if server.Len() != 0 {
+		t.Fatal("forwarded bytes of a message longer than its header says")
+	}
+}
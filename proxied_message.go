@@ -1,10 +1,19 @@
 package dvara
 
 import (
-	corelog "github.com/intercom/gocore/log"
-	"gopkg.in/mgo.v2/bson"
+	"bytes"
+	"errors"
 	"io"
 	"net"
+
+	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	errMessageLength = errors.New("dvara: invalid message length")
+	errNoReply       = errors.New("dvara: message does not take a reply")
+	errNoQuery       = errors.New("dvara: message does not have a query")
 )
 
 type ProxiedMessage struct {
@@ -12,11 +21,20 @@ type ProxiedMessage struct {
 	client    net.Conn
 	server    net.Conn
 	lastError *LastError
+	cursors   legacyCursors
+	group     string // listener group of the proxy
+	readOnly  bool
+	limits    *wireLimits // of the replica set, nil for the defaults
 
 	parts              [][]byte
 	fullCollectionName []byte
 	queryDoc           []byte
 	query              bson.D
+	msg                *opMsg
+	commandName        []byte
+	metadata           []byte
+	command            *Command
+	replied            bool
 
 	err error
 }
@@ -25,9 +43,10 @@ func NewProxiedMessage(
 	header *messageHeader, client net.Conn,
 	server net.Conn, lastError *LastError) ProxiedMessage {
 	return ProxiedMessage{
-		header, client, server, lastError,
-		nil, nil, nil, nil,
-		nil,
+		header:    header,
+		client:    client,
+		server:    server,
+		lastError: lastError,
 	}
 }
 
@@ -47,15 +66,23 @@ func (message *ProxiedMessage) GetFullCollectionName() ([]byte, error) {
 
 func (message *ProxiedMessage) GetQueryDoc() ([]byte, error) {
 	if message.queryDoc == nil {
-		message.loadQuery()
+		if message.header.OpCode == OpMsg {
+			message.loadMsg()
+		} else {
+			message.loadQuery()
+		}
 	}
 	return message.queryDoc, message.err
 }
 
+// GetQuery returns the query document of an OpQuery, the command arguments of
+// an OpCommand or the body of an OpMsg. It returns nil for other op codes.
 func (message *ProxiedMessage) GetQuery() (*bson.D, error) {
 	if message.query == nil {
 		if message.queryDoc == nil {
-			if message.header.OpCode != OpQuery {
+			switch message.header.OpCode {
+			case OpQuery, OpCommand, OpMsg:
+			default:
 				return nil, nil
 			}
 			if _, err := message.GetQueryDoc(); err != nil {
@@ -67,6 +94,274 @@ func (message *ProxiedMessage) GetQuery() (*bson.D, error) {
 	return &message.query, message.err
 }
 
+// GetCommand returns the parsed command of the message. It returns nil for op
+// codes that don't carry one.
+func (message *ProxiedMessage) GetCommand() (*Command, error) {
+	if message.command == nil {
+		command, err := parseCommand(message)
+		if err != nil {
+			return nil, err
+		}
+		message.command = command
+	}
+	return message.command, nil
+}
+
+// GetCommandName returns the command name of an OpCommand. It returns an empty
+// string for other op codes.
+func (message *ProxiedMessage) GetCommandName() (string, error) {
+	if message.header.OpCode != OpCommand {
+		return "", nil
+	}
+	if err := message.loadParts(); err != nil {
+		return "", err
+	}
+	return string(message.commandName[:len(message.commandName)-1]), nil
+}
+
+// GetCommandMetadata returns the raw metadata document of an OpCommand. It
+// returns nil for other op codes.
+func (message *ProxiedMessage) GetCommandMetadata() ([]byte, error) {
+	if message.header.OpCode != OpCommand {
+		return nil, nil
+	}
+	if err := message.loadQuery(); err != nil {
+		return nil, err
+	}
+	return message.metadata, nil
+}
+
+// GetMsgFlags returns the flag bits of an OpMsg.
+func (message *ProxiedMessage) GetMsgFlags() (uint32, error) {
+	if message.header.OpCode != OpMsg {
+		return 0, nil
+	}
+	if err := message.loadMsg(); err != nil {
+		return 0, err
+	}
+	return message.msg.flags, nil
+}
+
+// GetSections returns the sections of an OpMsg. It returns nil for other op
+// codes.
+func (message *ProxiedMessage) GetSections() ([]MsgSection, error) {
+	if message.header.OpCode != OpMsg {
+		return nil, nil
+	}
+	if err := message.loadMsg(); err != nil {
+		return nil, err
+	}
+	return message.msg.sections, nil
+}
+
+// clearMsgFlags clears flag bits of an OpMsg before it is forwarded. The
+// checksum is regenerated if there is one.
+func (message *ProxiedMessage) clearMsgFlags(flags uint32) error {
+	if err := message.loadMsg(); err != nil {
+		return err
+	}
+	message.msg.flags &^= flags
+	body := message.parts[1]
+	setInt32(body, 0, int32(message.msg.flags))
+	if message.msg.flags&MsgChecksumPresent != 0 {
+		end := len(body) - 4
+		message.msg.checksum = msgChecksum(message.parts[0], body[:end])
+		setInt32(body, end, int32(message.msg.checksum))
+	}
+	return nil
+}
+
+// SetQuery replaces the query document of an OpQuery, the command arguments
+// of an OpCommand or the body of an OpMsg before the message is forwarded. The
+// database the message is for does not change.
+func (message *ProxiedMessage) SetQuery(doc interface{}) error {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	switch message.header.OpCode {
+	case OpMsg:
+		if err := message.loadMsg(); err != nil {
+			return err
+		}
+		message.msg.setBody(b)
+		wire := message.msg.wire(*message.header)
+		message.header.MessageLength = int32(len(wire))
+		message.parts = [][]byte{wire[:headerLen], wire[headerLen:]}
+	case OpQuery, OpCommand:
+		if _, err := message.GetQueryDoc(); err != nil {
+			return err
+		}
+		for i, part := range message.parts {
+			if len(part) > 0 && &part[0] == &message.queryDoc[0] {
+				message.header.MessageLength += int32(len(b) - len(part))
+				message.parts[i] = b
+			}
+		}
+		message.parts[0] = message.header.ToWire()
+	default:
+		return errNoQuery
+	}
+	message.queryDoc = b
+	message.query = nil
+	message.command = nil
+	return nil
+}
+
+// Reply answers the message with the given document, in the reply format of
+// the request, instead of forwarding it to the server. The rest of the message
+// is read from the client.
+func (message *ProxiedMessage) Reply(doc interface{}) error {
+	if err := message.prepareReply(); err != nil {
+		return err
+	}
+	return message.sendReply(0, doc)
+}
+
+// ReplyError answers the message with an error instead of forwarding it to
+// the server. Commands get {ok: 0, errmsg, code, errorLabels}, legacy queries
+// and getMores a query failure.
+func (message *ProxiedMessage) ReplyError(code int, errmsg string, labels ...string) error {
+	if err := message.prepareReply(); err != nil {
+		return err
+	}
+	return message.sendError(code, errmsg, labels)
+}
+
+// expectsReply tells us if the client waits for a reply to the message.
+func (message *ProxiedMessage) expectsReply() (bool, error) {
+	if !message.header.OpCode.HasResponse() {
+		return false, nil
+	}
+	flags, err := message.GetMsgFlags()
+	if err != nil {
+		return false, err
+	}
+	return flags&MsgMoreToCome == 0, nil
+}
+
+// prepareReply makes sure the message takes a reply and reads the rest of it
+// from the client.
+func (message *ProxiedMessage) prepareReply() error {
+	expects, err := message.expectsReply()
+	if err != nil {
+		return err
+	}
+	if !expects {
+		return errNoReply
+	}
+	_, err = message.readRemaining()
+	return err
+}
+
+// sendError writes an error reply to the client. The message must have been
+// read entirely.
+func (message *ProxiedMessage) sendError(code int, errmsg string, labels []string) error {
+	ns, err := message.GetFullCollectionName()
+	if err != nil {
+		return err
+	}
+	op := message.header.OpCode
+	if op == OpGetMore || (op == OpQuery && !bytes.HasSuffix(ns, cmdCollectionSuffix)) {
+		return message.sendReply(replyQueryFailure, bson.D{
+			{Name: "$err", Value: errmsg},
+			{Name: "code", Value: code},
+		})
+	}
+	doc := bson.D{
+		{Name: "ok", Value: 0},
+		{Name: "errmsg", Value: errmsg},
+		{Name: "code", Value: code},
+	}
+	if len(labels) > 0 {
+		doc = append(doc, bson.DocElem{Name: "errorLabels", Value: labels})
+	}
+	return message.sendReply(0, doc)
+}
+
+// sendReply writes a reply to the client in the format of the request. The
+// flags only apply to an OpReply.
+func (message *ProxiedMessage) sendReply(flags int32, doc interface{}) error {
+	var err error
+	switch message.header.OpCode {
+	case OpCommand:
+		err = writeCommandReply(message.client, message.header.RequestID, doc)
+	case OpMsg:
+		var b []byte
+		if b, err = bson.Marshal(doc); err == nil {
+			msg := &opMsg{sections: []MsgSection{{Kind: SectionBody, Documents: [][]byte{b}}}}
+			h := messageHeader{RequestID: message.header.RequestID, ResponseTo: message.header.RequestID}
+			_, err = message.client.Write(msg.wire(h))
+		}
+	default:
+		var b []byte
+		if b, err = bson.Marshal(doc); err == nil {
+			err = writeReply(message, flags, 0, 0, [][]byte{b})
+		}
+	}
+	if err != nil {
+		corelog.LogError("error", err)
+		return err
+	}
+	message.replied = true
+	return nil
+}
+
+// forward writes the message to the server. Parts that were already read from
+// the client are written first, followed by the bytes still pending on the
+// client.
+func (message *ProxiedMessage) forward() error {
+	parts := message.parts
+	if parts == nil {
+		parts = [][]byte{message.header.ToWire()}
+	}
+
+	// The parts read may not exceed the message, or we would forward bytes of
+	// the next one.
+	pending := int64(message.header.MessageLength)
+	for _, b := range parts {
+		pending -= int64(len(b))
+	}
+	if pending < 0 {
+		return errMessageLength
+	}
+
+	for _, b := range parts {
+		if _, err := message.server.Write(b); err != nil {
+			corelog.LogError("error", err)
+			return err
+		}
+	}
+
+	if _, err := io.CopyN(message.server, message.client, pending); err != nil {
+		corelog.LogError("error", err)
+		return err
+	}
+	return nil
+}
+
+// readRemaining reads the bytes of the message still pending on the client,
+// after the parts that were already read.
+func (message *ProxiedMessage) readRemaining() ([]byte, error) {
+	if err := message.loadParts(); err != nil {
+		return nil, err
+	}
+	pending := int(message.header.MessageLength)
+	for _, b := range message.parts {
+		pending -= len(b)
+	}
+	if pending < 0 {
+		return nil, errMessageLength
+	}
+	rest := make([]byte, pending)
+	if _, err := io.ReadFull(message.client, rest); err != nil {
+		corelog.LogError("error", err)
+		return nil, err
+	}
+	message.parts = append(message.parts, rest)
+	return rest, nil
+}
+
 func (message *ProxiedMessage) loadParts() error {
 	if message.parts != nil {
 		return nil
@@ -74,6 +369,12 @@ func (message *ProxiedMessage) loadParts() error {
 	if message.err != nil {
 		return message.err
 	}
+	if message.header.OpCode == OpMsg {
+		return message.loadMsg()
+	}
+	if message.header.OpCode == OpCommand {
+		return message.loadCommand()
+	}
 
 	message.parts = [][]byte{message.header.ToWire()}
 	var err error
@@ -103,15 +404,19 @@ func (message *ProxiedMessage) loadQuery() error {
 	}
 
 	if message.queryDoc == nil {
-		var twoInt32 [8]byte
-		if _, err := io.ReadFull(message.client, twoInt32[:]); err != nil {
-			message.err = err
-			corelog.LogError("error", err)
-			return err
+		// An OpQuery has the number of documents to skip and return before the
+		// query, an OpCommand goes straight to its arguments.
+		if message.header.OpCode == OpQuery {
+			var twoInt32 [8]byte
+			if _, err := io.ReadFull(message.client, twoInt32[:]); err != nil {
+				message.err = err
+				corelog.LogError("error", err)
+				return err
+			}
+			message.parts = append(message.parts, twoInt32[:])
 		}
-		message.parts = append(message.parts, twoInt32[:])
 
-		queryDoc, err := readDocument(message.client)
+		queryDoc, err := readDocument(message.client, message.limits)
 		if err != nil {
 			message.err = err
 			corelog.LogError("error", err)
@@ -119,6 +424,94 @@ func (message *ProxiedMessage) loadQuery() error {
 		}
 		message.queryDoc = queryDoc
 		message.parts = append(message.parts, message.queryDoc)
+
+		if message.header.OpCode == OpCommand {
+			metadata, err := readDocument(message.client, message.limits)
+			if err != nil {
+				message.err = err
+				corelog.LogError("error", err)
+				return err
+			}
+			message.metadata = metadata
+			message.parts = append(message.parts, metadata)
+		}
+	}
+	return nil
+}
+
+// loadCommand reads the database and command name of an OpCommand. The full
+// collection name is set to the $cmd collection of the database.
+func (message *ProxiedMessage) loadCommand() error {
+	message.parts = [][]byte{message.header.ToWire()}
+
+	database, err := readCString(message.client)
+	if err != nil {
+		message.err = err
+		corelog.LogError("error", err)
+		return err
+	}
+	message.parts = append(message.parts, database)
+
+	message.commandName, err = readCString(message.client)
+	if err != nil {
+		message.err = err
+		corelog.LogError("error", err)
+		return err
+	}
+	message.parts = append(message.parts, message.commandName)
+
+	name := append([]byte(nil), database[:len(database)-1]...)
+	message.fullCollectionName = addCString(name, ".$cmd")
+	return nil
+}
+
+// loadMsg reads the entire OpMsg from the client and parses its sections. The
+// full collection name is set to the $cmd collection of the $db the command
+// is for.
+func (message *ProxiedMessage) loadMsg() error {
+	if message.msg != nil {
+		return nil
+	}
+	if message.err != nil {
+		return message.err
+	}
+
+	size := message.header.MessageLength - headerLen
+	if size < 0 {
+		message.err = errMessageLength
+		return message.err
 	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(message.client, body); err != nil {
+		message.err = err
+		corelog.LogError("error", err)
+		return err
+	}
+	message.parts = [][]byte{message.header.ToWire(), body}
+
+	if err := verifyMsgChecksum(message.header, body); err != nil {
+		message.err = err
+		corelog.LogError("error", err)
+		return err
+	}
+	msg, err := parseMsg(body)
+	if err != nil {
+		message.err = err
+		corelog.LogError("error", err)
+		return err
+	}
+
+	var db struct {
+		Name string `bson:"$db"`
+	}
+	if err := bson.Unmarshal(msg.body(), &db); err != nil {
+		message.err = err
+		corelog.LogError("error", err)
+		return err
+	}
+
+	message.msg = msg
+	message.queryDoc = msg.body()
+	message.fullCollectionName = addCString([]byte(db.Name), ".$cmd")
 	return nil
 }
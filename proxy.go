@@ -1,10 +1,13 @@
 package dvara
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
 	"strings"
@@ -13,15 +16,34 @@ import (
 
 	"github.com/facebookgo/stats"
 	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
 )
 
 const headerLen = 16
 
+// What clients waiting for a server connection can be told apart by.
+const (
+	fairQueueByIP  = "ip"
+	fairQueueByTLS = "tls"
+	fairQueueByApp = "app"
+)
+
+// checkFairQueueBy makes sure clients are queued by something we know.
+func (r *ReplicaSet) checkFairQueueBy() error {
+	switch r.FairQueueBy {
+	case "", fairQueueByIP, fairQueueByTLS, fairQueueByApp:
+		return nil
+	}
+	return errInvalidFairQueueBy
+}
+
 var (
 	errZeroMaxConnections          = errors.New("dvara: MaxConnections cannot be 0")
 	errZeroMaxPerClientConnections = errors.New("dvara: MaxPerClientConnections cannot be 0")
 	errNormalClose                 = errors.New("dvara: normal close")
 	errClientReadTimeout           = errors.New("dvara: client read timeout")
+	errInvalidFairQueueBy          = errors.New("dvara: FairQueueBy must be one of ip, tls or app")
+	errInvalidPriorityShare        = errors.New("dvara: PriorityClasses shares must add up to at most 1")
 
 	timeInPast = time.Now()
 )
@@ -29,19 +51,23 @@ var (
 // Proxy sends stuff from clients to mongo servers.
 type Proxy struct {
 	ReplicaSet     *ReplicaSet
-	ClientListener net.Listener // Listener for incoming client connections
+	Group          ListenerGroup // Listener group the proxy is in
+	ClientListener net.Listener  // Listener for incoming client connections
 	Cred           Credential
 	ProxyAddr      string      // Address for incoming client connections
 	MongoAddr      string      // Address for destination Mongo server
 	TLSConfig      *tls.Config // TLS config for backend, nil if no TLS
 
+	mu                      sync.RWMutex // guards Group and serverPool while starting
 	wg                      sync.WaitGroup
 	closed                  chan struct{}
 	serverPool              Pool
+	breaker                 *circuitBreaker
+	limiter                 *aimdLimiter
 	stats                   stats.Client
 	maxPerClientConnections *maxPerClientConnections
 
-	extensions []ProxyExtension
+	extensions *ProxyExtensionStack
 }
 
 // String representation for debugging.
@@ -51,41 +77,135 @@ func (p *Proxy) String() string {
 
 // Start the proxy.
 func (p *Proxy) Start() error {
-	if p.ReplicaSet.MaxConnections == 0 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Group = p.ReplicaSet.listenerGroup(p.Group)
+	if p.Group.MaxConnections == 0 {
 		return errZeroMaxConnections
 	}
-	if p.ReplicaSet.MaxPerClientConnections == 0 {
+	if p.Group.MaxPerClientConnections == 0 {
 		return errZeroMaxPerClientConnections
 	}
+	if err := p.ReplicaSet.checkFairQueueBy(); err != nil {
+		return err
+	}
+	if err := p.ReplicaSet.checkPriorityClasses(); err != nil {
+		return err
+	}
+	reserved := make([]float64, len(p.ReplicaSet.PriorityClasses))
+	for i, class := range p.ReplicaSet.PriorityClasses {
+		reserved[i] = class.Share
+	}
 
 	p.closed = make(chan struct{})
-	p.maxPerClientConnections = newMaxPerClientConnections(p.ReplicaSet.MaxPerClientConnections)
+	p.maxPerClientConnections = newMaxPerClientConnections(p.Group.MaxPerClientConnections)
 	p.serverPool = Pool{
 		New:               p.newServerConn,
 		CloseErrorHandler: p.serverCloseErrorHandler,
-		Max:               p.ReplicaSet.MaxConnections,
-		MinIdle:           p.ReplicaSet.MinIdleConnections,
-		IdleTimeout:       p.ReplicaSet.ServerIdleTimeout,
+		Max:               p.Group.MaxConnections,
+		MaxConcurrentNew:  p.ReplicaSet.MaxConcurrentDials,
+		Reserved:          reserved,
+		ShedAfter:         p.ReplicaSet.PriorityShedAfter,
+		MaxWaiting:        p.Group.MaxPoolWaiting,
+		Weights:           p.ReplicaSet.FairQueueWeights,
+		MinIdle:           p.Group.MinIdleConnections,
+		IdleTimeout:       p.Group.ServerIdleTimeout,
+		WarmInterval:      p.ReplicaSet.ServerWarmInterval,
+		MaxLifetime:       p.ReplicaSet.ServerMaxLifetime,
+		MaxLifetimeJitter: p.ReplicaSet.ServerMaxLifetimeJitter,
+		MaxUses:           p.ReplicaSet.ServerMaxUses,
 		ClosePoolSize:     p.ReplicaSet.ServerClosePoolSize,
 	}
+	if p.ReplicaSet.ServerValidateIdle > 0 {
+		p.serverPool.Validate = p.pingServerConn
+		p.serverPool.ValidateIdle = p.ReplicaSet.ServerValidateIdle
+	}
 
-	// plug stats if we can
+	// plug stats if we can, those of a named group are kept apart
 	if p.ReplicaSet.Stats != nil {
+		prefix := "mongoproxy."
+		if p.Group.Name != "" {
+			prefix += p.Group.Name + "."
+		}
 		p.serverPool.Stats = stats.PrefixClient(
-			[]string{"mongoproxy.server.pool."},
+			[]string{prefix + "server.pool."},
 			p.ReplicaSet.Stats,
 		)
 		p.stats = stats.PrefixClient(
-			[]string{"mongoproxy."},
+			[]string{prefix},
 			p.ReplicaSet.Stats,
 		)
 	}
 
+	p.breaker = &circuitBreaker{
+		Name:             p.MongoAddr,
+		FailureThreshold: p.ReplicaSet.BreakerFailureThreshold,
+		OpenTimeout:      p.ReplicaSet.BreakerOpenTimeout,
+		Stats:            p.stats,
+	}
+
+	if p.ReplicaSet.AdaptiveLimitMin > 0 {
+		p.limiter = &aimdLimiter{
+			Min:      p.ReplicaSet.AdaptiveLimitMin,
+			Max:      p.Group.MaxConnections,
+			Latency:  p.ReplicaSet.AdaptiveLimitLatency,
+			Backoff:  p.ReplicaSet.AdaptiveLimitBackoff,
+			SetLimit: p.setServerLimit,
+		}
+		if p.limiter.Latency == 0 {
+			p.limiter.Latency = 100 * time.Millisecond
+		}
+		if p.limiter.Backoff == 0 {
+			p.limiter.Backoff = 0.9
+		}
+	}
+
+	// dial MinIdleConnections before the first client needs one
+	p.serverPool.WarmUp()
+
 	go p.clientAcceptLoop()
 
 	return nil
 }
 
+// ProxySnapshot is the state of the server connection pool of a proxy.
+type ProxySnapshot struct {
+	Group     string
+	ProxyAddr string
+	MongoAddr string
+	Pool      PoolSnapshot
+}
+
+// Snapshot returns the state of the server connection pool, the clients of an
+// acquired connection or waiting for one are named by their remote address and
+// appName.
+func (p *Proxy) Snapshot() ProxySnapshot {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return ProxySnapshot{
+		Group:     p.Group.Name,
+		ProxyAddr: p.ProxyAddr,
+		MongoAddr: p.MongoAddr,
+		Pool:      p.serverPool.Snapshot(),
+	}
+}
+
+// groupName returns the name of the listener group, which may be read while
+// the proxy is starting.
+func (p *Proxy) groupName() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Group.Name
+}
+
+// invalidate stops the server connections from being reused, it may be called
+// while the proxy is starting.
+func (p *Proxy) invalidate() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	p.serverPool.Invalidate()
+}
+
 // Stop the proxy.
 func (p *Proxy) Stop() error {
 	return p.stop(false)
@@ -114,46 +234,180 @@ func (p *Proxy) AuthConn(conn net.Conn) error {
 	return nil
 }
 
-// Open up a new connection to the server. Retry 7 times, doubling the sleep
-// each time. This means we'll a total of 12.75 seconds with the last wait
-// being 6.4 seconds.
+// Open up a new connection to the server. Retry ServerDialAttempts times,
+// doubling the sleep each time. By default that is 7 times, starting with
+// 50ms, which means we'll a total of 12.75 seconds with the last wait being
+// 6.4 seconds. We give up as soon as the circuit breaker is open.
 func (p *Proxy) newServerConn() (io.Closer, error) {
-	retrySleep := 50 * time.Millisecond
-	for retryCount := 7; retryCount > 0; retryCount-- {
-		dialer := &net.Dialer{Timeout: time.Second}
-		var err error
-		var c net.Conn
-		if p.TLSConfig == nil {
-			c, err = dialer.Dial("tcp", p.MongoAddr)
-		} else {
-			c, err = tls.DialWithDialer(dialer, "tcp", p.MongoAddr, p.TLSConfig)
+	timeout := p.ReplicaSet.ServerDialTimeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	attempts := p.ReplicaSet.ServerDialAttempts
+	if attempts == 0 {
+		attempts = 7
+	}
+	retrySleep := p.ReplicaSet.ServerDialBackoff
+	if retrySleep == 0 {
+		retrySleep = 50 * time.Millisecond
+	}
+	for attempt := uint(1); ; attempt++ {
+		if err := p.breaker.Allow(); err != nil {
+			return nil, err
 		}
+		c, err := p.dialServer(timeout)
 		if err == nil {
-			if len(p.Cred.Username) == 0 {
-				return c, nil
-			}
-			err = p.AuthConn(c)
-			if err == nil {
-				return c, nil
-			}
+			p.breaker.Success()
+			return c, nil
 		}
+		p.breaker.Failure()
 		corelog.LogError("error", err)
+		if attempt == attempts {
+			break
+		}
 
-		time.Sleep(retrySleep)
+		sleep := retrySleep
+		if jitter := p.ReplicaSet.ServerDialBackoffJitter; jitter > 0 {
+			sleep += time.Duration(rand.Int63n(int64(jitter)))
+		}
+		time.Sleep(sleep)
 		retrySleep = retrySleep * 2
 	}
 	return nil, fmt.Errorf("could not connect to %s", p.MongoAddr)
 }
 
-// getServerConn gets a server connection from the pool.
-func (p *Proxy) getServerConn() (net.Conn, error) {
-	c, err := p.serverPool.Acquire()
+// dialServer dials and authenticates a connection to the server.
+func (p *Proxy) dialServer(timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var err error
+	var c net.Conn
+	if p.TLSConfig == nil {
+		c, err = dialer.Dial("tcp", p.MongoAddr)
+	} else {
+		c, err = tls.DialWithDialer(dialer, "tcp", p.MongoAddr, p.TLSConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Cred.Username) == 0 {
+		return c, nil
+	}
+	if err := p.AuthConn(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// pingServerConn checks an idle server connection is still good to use.
+func (p *Proxy) pingServerConn(r io.Closer) error {
+	c := r.(net.Conn)
+	c.SetDeadline(time.Now().Add(time.Second))
+	defer c.SetDeadline(time.Time{})
+
+	body, err := bson.Marshal(bson.D{
+		{Name: "ping", Value: 1},
+		{Name: "$db", Value: "admin"},
+	})
+	if err != nil {
+		return err
+	}
+	msg := &opMsg{sections: []MsgSection{{Kind: SectionBody, Documents: [][]byte{body}}}}
+	if err := writeMsg(c, 0, msg); err != nil {
+		return err
+	}
+	_, reply, err := readMsg(c)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		OK     float64 `bson:"ok"`
+		ErrMsg string  `bson:"errmsg"`
+	}
+	if err := bson.Unmarshal(reply.body(), &res); err != nil {
+		return err
+	}
+	if res.OK != 1 {
+		return fmt.Errorf("ping failed: %s", res.ErrMsg)
+	}
+	return nil
+}
+
+// getServerConn gets a server connection from the pool for the named client,
+// in its priority class. It gives up waiting for one after the
+// PoolAcquireTimeout.
+func (p *Proxy) getServerConn(client, owner string, class int) (net.Conn, error) {
+	// fail right away while the member is known to be down
+	if err := p.breaker.Ready(); err != nil {
+		stats.BumpSum(p.stats, "server.conn.breaker.open", 1)
+		return nil, err
+	}
+	timeout := p.Group.PoolAcquireTimeout
+	if timeout == 0 {
+		timeout = p.Group.MessageTimeout
+	}
+	ctx := WithPoolOwner(WithPoolClient(context.Background(), client), owner)
+	ctx = WithPoolPriority(ctx, class)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	c, err := p.serverPool.AcquireContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return c.(net.Conn), nil
 }
 
+// clientIdentity returns the name of a client waiting for a server connection
+// is queued by.
+func (p *Proxy) clientIdentity(remoteIP string, tlsConn *tls.Conn, appName string) string {
+	switch p.ReplicaSet.FairQueueBy {
+	case "":
+		return ""
+	case fairQueueByTLS:
+		if subject := tlsSubject(tlsConn); subject != "" {
+			return subject
+		}
+	case fairQueueByApp:
+		if appName != "" {
+			return appName
+		}
+	}
+	return remoteIP
+}
+
+// clientOwner returns the name of a client in snapshots of the server
+// connection pool, its remote address followed by its appName once it is
+// known. It doesn't depend on how clients are queued.
+func clientOwner(remoteAddr net.Addr, appName string) string {
+	if appName == "" {
+		return remoteAddr.String()
+	}
+	return remoteAddr.String() + " " + appName
+}
+
+// clientClass returns the priority class of a client, the first class it
+// matches, or the class after the last one if it matches none.
+func (p *Proxy) clientClass(remoteIP string, tlsConn *tls.Conn, appName string) int {
+	classes := p.ReplicaSet.PriorityClasses
+	if len(classes) == 0 {
+		return 0
+	}
+	ip := net.ParseIP(remoteIP)
+	subject := tlsSubject(tlsConn)
+	for i := range classes {
+		if classes[i].matches(ip, subject, appName) {
+			return i
+		}
+	}
+	return len(classes)
+}
+
+// setServerLimit sets the number of server connections used at once.
+func (p *Proxy) setServerLimit(limit uint) {
+	p.serverPool.SetLimit(limit)
+	stats.BumpAvg(p.stats, "server.limit", float64(limit))
+}
+
 func (p *Proxy) serverCloseErrorHandler(err error) {
 	corelog.LogError("error", err)
 }
@@ -163,17 +417,25 @@ func (p *Proxy) serverCloseErrorHandler(err error) {
 func (p *Proxy) proxyMessage(message *ProxiedMessage) error {
 	h := message.header
 
-	deadline := time.Now().Add(p.ReplicaSet.MessageTimeout)
+	deadline := time.Now().Add(p.Group.MessageTimeout)
 	message.server.SetDeadline(deadline)
 	message.client.SetDeadline(deadline)
+	p.setBodyReadDeadline(message.client)
 
-	// OpQuery may need to be transformed and need special handling in order to
-	// make the proxy transparent.
-	if h.OpCode == OpQuery {
+	// OpQuery, OpCommand and OpMsg may need to be transformed and need special
+	// handling in order to make the proxy transparent.
+	if h.OpCode == OpQuery || h.OpCode == OpCommand || h.OpCode == OpMsg {
 		stats.BumpSum(p.stats, "message.with.response", 1)
 		return p.ReplicaSet.ProxyQuery.Proxy(message)
 	}
 
+	// Legacy writes may need to be translated into write commands. Their result
+	// is cached for the getLastError call that usually follows.
+	if *translateLegacyOps && h.OpCode.IsMutation() {
+		stats.BumpSum(p.stats, "message.translated", 1)
+		return p.ReplicaSet.ProxyQuery.LegacyOpTranslator.TranslateWrite(message)
+	}
+
 	// Anything besides a getlasterror call (which requires an OpQuery) resets
 	// the lastError.
 	if message.lastError.Exists() {
@@ -181,14 +443,22 @@ func (p *Proxy) proxyMessage(message *ProxiedMessage) error {
 		message.lastError.Reset()
 	}
 
-	// For other Ops we proxy the header & raw body over.
-	if err := h.WriteTo(message.server); err != nil {
-		corelog.LogError("error", err)
-		return err
+	// Legacy cursor ops belong to translated queries and must be translated as
+	// well.
+	if *translateLegacyOps {
+		switch h.OpCode {
+		case OpGetMore:
+			stats.BumpSum(p.stats, "message.translated", 1)
+			return p.ReplicaSet.ProxyQuery.LegacyOpTranslator.TranslateGetMore(message)
+		case OpKillCursors:
+			stats.BumpSum(p.stats, "message.translated", 1)
+			return p.ReplicaSet.ProxyQuery.LegacyOpTranslator.TranslateKillCursors(message)
+		}
 	}
 
-	if _, err := io.CopyN(message.server, message.client, int64(h.MessageLength-headerLen)); err != nil {
-		corelog.LogError("error", err)
+	// For other Ops we proxy the header & raw body over. Extensions may already
+	// have read some of it, for example the sections of an OpMsg.
+	if err := message.forward(); err != nil {
 		return err
 	}
 
@@ -227,13 +497,12 @@ func (p *Proxy) clientAcceptLoop() {
 func (p *Proxy) clientServeLoop(c net.Conn) {
 	remoteIP := c.RemoteAddr().(*net.TCPAddr).IP.String()
 
-	// TODO: connection set up handler
-
 	// enforce per-client max connection limit
 	if p.maxPerClientConnections.inc(remoteIP) {
-		c.Close()
 		stats.BumpSum(p.stats, "client.rejected.max.connections", 1)
 		corelog.LogErrorMessage(fmt.Sprintf("rejecting client connection due to max connections limit: %s", remoteIP))
+		p.rejectClient(c, errTooManyClientConnections)
+		p.wg.Done()
 		return
 	}
 
@@ -244,6 +513,7 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 		conn.SetKeepAlive(true)
 	}
 
+	tlsConn, _ := c.(*tls.Conn)
 	c = teeIf(fmt.Sprintf("client %s <=> %s", c.RemoteAddr(), p), c)
 	stats.BumpSum(p.stats, "client.connected", 1)
 	defer func() {
@@ -254,8 +524,29 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 		p.maxPerClientConnections.dec(remoteIP)
 	}()
 
+	if err := p.extensions.OnConnection(c); err != nil {
+		stats.BumpSum(p.stats, "client.rejected.extension", 1)
+		corelog.LogErrorMessage(fmt.Sprintf("rejecting client connection by extension: %s: %s", remoteIP, err))
+		p.rejectClient(c, vetoError(err))
+		return
+	}
+	defer p.extensions.OnDisconnect(c)
+
 	var lastError LastError
+	var appName string
+	var stored *storedConn
+	defer func() { stored.discard() }()
+	handshake := true
+	cursors := make(legacyCursors)
+serve:
 	for {
+		// the replies stored for the last message are sent once its server
+		// connection was released
+		if err := stored.Send(); err != nil {
+			corelog.LogError("error", err)
+			return
+		}
+
 		h, err := p.idleClientReadHeader(c)
 		if err != nil {
 			if err != errNormalClose {
@@ -263,50 +554,137 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 			}
 			return
 		}
+		if err := checkHeader(h, &p.ReplicaSet.limits); err != nil {
+			p.rejectInvalidMessage(h, err)
+			return
+		}
 
 		mpt := stats.BumpTime(p.stats, "message.proxy.time")
-		serverConn, err := p.getServerConn()
+
+		// in store-and-forward mode the message is read before a server
+		// connection is acquired
+		if stored, err = p.storeRequest(c, h); err != nil {
+			corelog.LogError("error", err)
+			return
+		}
+		mc := net.Conn(c)
+		if stored != nil {
+			mc = stored
+		}
+
+		serverConn, err := p.getServerConn(
+			p.clientIdentity(remoteIP, tlsConn, appName),
+			clientOwner(c.RemoteAddr(), appName),
+			p.clientClass(remoteIP, tlsConn, appName),
+		)
 		if err != nil {
-			if err != errNormalClose {
+			// breaker transitions are logged already
+			if err != errNormalClose && err != errBreakerOpen {
 				corelog.LogError("error", err)
 			}
-			return
+			if !p.replyServerConnError(mc, h, &lastError, err) {
+				return
+			}
+			continue
 		}
 
 		scht := stats.BumpTime(p.stats, "server.conn.held.time")
 		for {
-			// TODO: message processing handler
-			proxiedMessage := NewProxiedMessage(h, c, serverConn, &lastError)
-			for _, extension := range p.extensions {
-				extension.onHeader(&proxiedMessage)
+			// Compressed messages are inspected and proxied decompressed, the
+			// replies are compressed again on their way back to the client.
+			var cc *compressedConn
+			if h, cc, err = p.readCompressedIf(mc, h); err != nil {
+				p.serverPool.Release(serverConn)
+				return
+			}
+			client := mc
+			if cc != nil {
+				client = cc
+			}
+
+			// Replies go through the extensions before they reach the client.
+			var ec *extensionConn
+			if len(p.extensions.GetExtensions()) > 0 {
+				ec = &extensionConn{Conn: client, extension: p.extensions}
+				client = ec
+			}
+
+			rc := &requestConn{Conn: client}
+			proxiedMessage := NewProxiedMessage(h, rc, serverConn, &lastError)
+			proxiedMessage.cursors = cursors
+			proxiedMessage.group = p.Group.Name
+			proxiedMessage.limits = &p.ReplicaSet.limits
+			proxiedMessage.readOnly = *readOnly || p.Group.ReadOnly
+			if ec != nil {
+				ec.message = &proxiedMessage
+			}
+			if err := p.extensions.OnRequest(&proxiedMessage); err != nil {
+				p.serverPool.Release(serverConn)
+				corelog.LogErrorMessage(fmt.Sprintf("message vetoed by extension %s: %s", h, err))
+				stats.BumpSum(p.stats, "message.vetoed", 1)
+				if !p.replyError(rc, &proxiedMessage, vetoError(err)) {
+					return
+				}
+				continue serve
+			}
+
+			// the driver names the application in its handshake, the first message
+			if handshake {
+				handshake = false
+				if command, err := proxiedMessage.GetCommand(); err == nil && command != nil {
+					appName = command.AppName()
+				}
 			}
 
 			var err error
-			if *readOnly && h.OpCode.IsMutation() {
+			switch {
+			case proxiedMessage.replied:
+				stats.BumpSum(p.stats, "message.extension.reply", 1)
+			case proxiedMessage.readOnly && h.OpCode.IsMutation():
 				err = lastError.NewError("Readonly database", 66)
 				if err == nil {
 					err = p.ReplicaSet.ProxyQuery.GetLastErrorRewriter.Rewrite(&proxiedMessage)
 					lastError.Reset()
 				}
-			} else {
-				err = p.proxyMessage(&proxiedMessage)
+			default:
+				// only the time the server takes to reply counts towards the limit
+				var lc *latencyConn
+				if p.limiter != nil {
+					var awaits bool
+					if awaits, err = awaitsServer(&proxiedMessage); err == nil && !awaits {
+						lc = &latencyConn{Conn: serverConn}
+						proxiedMessage.server = lc
+					}
+				}
+				if err == nil {
+					err = p.proxyMessage(&proxiedMessage)
+				}
+				lc.sample(p.limiter)
+			}
+			if err == nil {
+				err = rc.Flush()
 			}
 
 			if err != nil {
 				p.serverPool.Discard(serverConn)
+				if isLimitError(err) {
+					p.rejectInvalidMessage(h, err)
+					return
+				}
 				corelog.LogErrorMessage(fmt.Sprintf("Proxy message failed %s ", err))
 				stats.BumpSum(p.stats, "message.proxy.error", 1)
 				if ne, ok := err.(net.Error); ok && ne.Timeout() {
 					stats.BumpSum(p.stats, "message.proxy.timeout", 1)
 				}
-				return
+				if !p.replyError(rc, &proxiedMessage, backendError(err)) {
+					return
+				}
+				continue serve
 			}
 
 			// One message was proxied, stop it's timer.
 			mpt.End()
 
-			// TODO: response processing handler
-
 			if !h.OpCode.IsMutation() {
 				break
 			}
@@ -316,6 +694,15 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 			// call which expects this behavior.
 
 			stats.BumpSum(p.stats, "message.with.mutation", 1)
+
+			// the follow up request is streamed, we hold the server connection
+			// while we wait for it anyway
+			if err := stored.Send(); err != nil {
+				p.serverPool.Release(serverConn)
+				corelog.LogError("error", err)
+				return
+			}
+			stored, mc = nil, c
 			h, err = p.gleClientReadHeader(c)
 			if err != nil {
 				// Client did not make _any_ query within the GetLastErrorTimeout.
@@ -333,6 +720,12 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 				return
 			}
 
+			if err := checkHeader(h, &p.ReplicaSet.limits); err != nil {
+				p.serverPool.Release(serverConn)
+				p.rejectInvalidMessage(h, err)
+				return
+			}
+
 			// Successfully read message when waiting for the getLastError call.
 			mpt = stats.BumpTime(p.stats, "message.proxy.time")
 		}
@@ -342,11 +735,144 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 	}
 }
 
+// readCompressedIf decompresses the message with the given header if it is
+// compressed. The replies written to the returned compressedConn are
+// compressed when it is flushed. The client has to be disconnected if it
+// fails.
+func (p *Proxy) readCompressedIf(c net.Conn, h *messageHeader) (*messageHeader, *compressedConn, error) {
+	if h.OpCode != OpCompressed {
+		return h, nil, nil
+	}
+	p.setBodyReadDeadline(c)
+	oh, cc, err := readCompressed(c, h, &p.ReplicaSet.limits)
+	if err != nil {
+		if isLimitError(err) {
+			p.rejectInvalidMessage(h, err)
+			return nil, nil, err
+		}
+		corelog.LogErrorMessage(fmt.Sprintf("Decompressing message failed %s ", err))
+		stats.BumpSum(p.stats, "message.decompress.error", 1)
+		return nil, nil, err
+	}
+	if err := checkHeader(oh, &p.ReplicaSet.limits); err != nil {
+		p.rejectInvalidMessage(oh, err)
+		return nil, nil, err
+	}
+	stats.BumpSum(p.stats, "message.compressed", 1)
+	return oh, cc, nil
+}
+
+// replyServerConnError answers a message that could not be proxied because
+// no server connection could be had. It returns false if the client has to be
+// disconnected instead.
+func (p *Proxy) replyServerConnError(c net.Conn, h *messageHeader, lastError *LastError, err error) bool {
+	h, cc, err2 := p.readCompressedIf(c, h)
+	if err2 != nil {
+		return false
+	}
+	client := net.Conn(c)
+	if cc != nil {
+		client = cc
+	}
+	rc := &requestConn{Conn: client}
+	message := NewProxiedMessage(h, rc, nil, lastError)
+	message.limits = &p.ReplicaSet.limits
+
+	// nothing was forwarded, so the command can still be read for its labels
+	message.GetCommand()
+	return p.replyError(rc, &message, backendError(err))
+}
+
+// replyError answers the message in flight with an error reply, if the client
+// can still take one. Legacy writes don't have a reply, their error is cached
+// for the getLastError call that follows. It returns false if the client has
+// to be disconnected instead.
+func (p *Proxy) replyError(rc *requestConn, m *ProxiedMessage, pe *proxyError) bool {
+	if rc.err != nil || rc.written > 0 {
+		return false
+	}
+	rc.SetDeadline(time.Now().Add(p.Group.MessageTimeout))
+	expects, err := m.expectsReply()
+	if err != nil || (!expects && !m.header.OpCode.IsMutation()) {
+		return false
+	}
+
+	// Parts of the message may have been forwarded already, so what is left of
+	// it is measured on the client connection.
+	pending := int64(m.header.MessageLength-headerLen) - rc.read
+	if pending < 0 {
+		return false
+	}
+
+	// Without a server connection, or before all of it was read, the message
+	// can't have reached the server.
+	forwarded := m.server != nil && pending == 0
+	if _, err := io.CopyN(ioutil.Discard, rc, pending); err != nil {
+		corelog.LogError("error", err)
+		return false
+	}
+
+	if m.header.OpCode.IsMutation() {
+		err = m.lastError.NewError(pe.msg, pe.code)
+	} else {
+		err = m.sendError(pe.code, pe.msg, pe.labels(m.command, forwarded))
+	}
+	if err == nil {
+		err = rc.Flush()
+	}
+	if err != nil {
+		corelog.LogError("error", err)
+		return false
+	}
+	stats.BumpSum(p.stats, "message.error.reply", 1)
+	return true
+}
+
+// rejectClient answers the first message of a client that will not be served
+// with an error reply and disconnects it.
+func (p *Proxy) rejectClient(c net.Conn, pe *proxyError) {
+	defer c.Close()
+	h, err := p.clientReadHeader(c, p.Group.MessageTimeout)
+	if err != nil || checkHeader(h, &p.ReplicaSet.limits) != nil {
+		return
+	}
+	h, cc, err := p.readCompressedIf(c, h)
+	if err != nil {
+		return
+	}
+	client := net.Conn(c)
+	if cc != nil {
+		client = cc
+	}
+	rc := &requestConn{Conn: client}
+	var lastError LastError
+	message := NewProxiedMessage(h, rc, nil, &lastError)
+	message.limits = &p.ReplicaSet.limits
+	p.replyError(rc, &message, pe)
+}
+
+// rejectInvalidMessage logs and counts a message that violates the wire
+// protocol limits. The client is disconnected by the caller.
+func (p *Proxy) rejectInvalidMessage(h *messageHeader, err error) {
+	corelog.LogErrorMessage(fmt.Sprintf("rejecting client for invalid message %s: %s", h, err))
+	stats.BumpSum(p.stats, "client.rejected.invalid.message", 1)
+}
+
+// setBodyReadDeadline bounds the time the client has to send the rest of a
+// message once its header was read. It only ever shortens the deadline set for
+// the message.
+func (p *Proxy) setBodyReadDeadline(c net.Conn) {
+	timeout := p.ReplicaSet.BodyReadTimeout
+	if timeout > 0 && (p.Group.MessageTimeout == 0 || timeout < p.Group.MessageTimeout) {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
 // We wait for upto ClientIdleTimeout in MessageTimeout increments and keep
 // checking if we're waiting to be closed. This ensures that at worse we
 // wait for MessageTimeout when closing even when we're idling.
 func (p *Proxy) idleClientReadHeader(c net.Conn) (*messageHeader, error) {
-	h, err := p.clientReadHeader(c, p.ReplicaSet.ClientIdleTimeout)
+	h, err := p.clientReadHeader(c, p.Group.ClientIdleTimeout)
 	if err == errClientReadTimeout {
 		stats.BumpSum(p.stats, "client.idle.timeout", 1)
 	}
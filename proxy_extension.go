@@ -1,17 +1,44 @@
 package dvara
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"net"
+
 	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
 )
 
+var errReplyDocuments = errors.New("dvara: reply with more than one document")
+
+// ProxyExtension is run by the proxy for every client connection and message.
+// Extensions can veto a connection or message by returning an error, answer a
+// message themselves with ProxiedMessage.Reply, or change the request with
+// ProxiedMessage.SetQuery and the response with Response.SetDocument.
 type ProxyExtension interface {
-	onConnection(*ProxiedMessage) bool
-	onHeader(*ProxiedMessage) bool
-	onMessage(*ProxiedMessage) bool
-	onResponse(*ProxiedMessage) bool
+	// OnConnection is called when a client connects. Returning an error
+	// refuses the connection, the first message of the client is answered with
+	// the error.
+	OnConnection(c net.Conn) error
+
+	// OnRequest is called for every message before it is proxied. Returning an
+	// error vetoes the message and the client gets it as an error reply. If the
+	// extension replied to the message it is not forwarded to the server.
+	OnRequest(m *ProxiedMessage) error
+
+	// OnResponse is called for every reply before it is written to the client.
+	// Returning an error drops the reply and the client is disconnected.
+	OnResponse(m *ProxiedMessage, r *Response) error
+
+	// OnDisconnect is called when a client that was accepted disconnects.
+	OnDisconnect(c net.Conn)
 }
 
+// ProxyExtensionStack runs a list of extensions in order. Connections and
+// requests go through the extensions first to last, and stop at the first one
+// that vetoes or replies. Responses and disconnects go through them last to
+// first. The stack is itself an extension, so stacks can be nested.
 type ProxyExtensionStack struct {
 	extensions []ProxyExtension
 }
@@ -23,44 +50,204 @@ func NewProxyExtensionStack(extensions []ProxyExtension) ProxyExtensionStack {
 }
 
 func (manager *ProxyExtensionStack) GetExtensions() []ProxyExtension {
+	if manager == nil {
+		return nil
+	}
 	return manager.extensions
 }
 
+// OnConnection runs the extensions in order. If one refuses the connection,
+// the ones that accepted it are told it disconnected.
+func (manager *ProxyExtensionStack) OnConnection(c net.Conn) error {
+	extensions := manager.GetExtensions()
+	for i, extension := range extensions {
+		if err := extension.OnConnection(c); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				extensions[j].OnDisconnect(c)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// OnRequest runs the extensions in order until one vetoes or replies.
+func (manager *ProxyExtensionStack) OnRequest(m *ProxiedMessage) error {
+	for _, extension := range manager.GetExtensions() {
+		if err := extension.OnRequest(m); err != nil {
+			return err
+		}
+		if m.replied {
+			return nil
+		}
+	}
+	return nil
+}
+
+// OnResponse runs the extensions in reverse order.
+func (manager *ProxyExtensionStack) OnResponse(m *ProxiedMessage, r *Response) error {
+	extensions := manager.GetExtensions()
+	for i := len(extensions) - 1; i >= 0; i-- {
+		if err := extensions[i].OnResponse(m, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnDisconnect runs the extensions in reverse order.
+func (manager *ProxyExtensionStack) OnDisconnect(c net.Conn) {
+	extensions := manager.GetExtensions()
+	for i := len(extensions) - 1; i >= 0; i-- {
+		extensions[i].OnDisconnect(c)
+	}
+}
+
+// BaseProxyExtension does nothing, it can be embedded by extensions that only
+// need some of the hooks.
 type BaseProxyExtension struct{}
 
-func (extension *BaseProxyExtension) onConnection(*ProxiedMessage) bool {
-	return true
+func (extension *BaseProxyExtension) OnConnection(net.Conn) error {
+	return nil
+}
+
+func (extension *BaseProxyExtension) OnRequest(*ProxiedMessage) error {
+	return nil
+}
+
+func (extension *BaseProxyExtension) OnResponse(*ProxiedMessage, *Response) error {
+	return nil
 }
 
-func (extension *BaseProxyExtension) onHeader(*ProxiedMessage) bool {
-	return true
+func (extension *BaseProxyExtension) OnDisconnect(net.Conn) {}
+
+// Response is a reply from the server, or from a rewriter, on its way to the
+// client.
+type Response struct {
+	header *messageHeader
+	raw    []byte
+}
+
+// OpCode returns the op code of the reply.
+func (r *Response) OpCode() OpCode {
+	return r.header.OpCode
+}
+
+// GetDocument returns the document of a reply: the only document of an
+// OpReply, the body of an OpMsg or the reply of an OpCommandReply. Replies with
+// more than one document, an OpReply with a batch or an OpMsg with a document
+// sequence, are an error.
+func (r *Response) GetDocument() (bson.D, error) {
+	if err := r.checkOneDocument(); err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if _, _, _, err := (&ReplyRW{}).ReadOne(bytes.NewReader(r.raw), &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// SetDocument replaces the document of a reply, which like GetDocument must be
+// its only document.
+func (r *Response) SetDocument(doc interface{}) error {
+	if err := r.checkOneDocument(); err != nil {
+		return err
+	}
+	var rw ReplyRW
+	var old bson.Raw
+	h, prefix, docLen, err := rw.ReadOne(bytes.NewReader(r.raw), &old)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := rw.WriteOne(&b, h, prefix, docLen, doc); err != nil {
+		return err
+	}
+	r.header = h
+	r.raw = b.Bytes()
+	return nil
+}
+
+// checkOneDocument returns errReplyDocuments if the reply carries more than
+// one document, only the first of which would otherwise be read or replaced.
+func (r *Response) checkOneDocument() error {
+	body := r.raw[headerLen:]
+	switch r.header.OpCode {
+	case OpReply:
+		if len(body) >= opReplyPrefixLen && getInt32(body, 16) > 1 {
+			return errReplyDocuments
+		}
+	case OpMsg:
+		msg, err := parseMsg(body)
+		if err != nil {
+			return err
+		}
+		for _, section := range msg.sections {
+			if section.Kind == SectionDocumentSequence {
+				return errReplyDocuments
+			}
+		}
+	}
+	return nil
+}
+
+// extensionConn buffers the replies written to the client, so they go through
+// the extensions before they are written to the client.
+type extensionConn struct {
+	net.Conn
+	extension ProxyExtension
+	message   *ProxiedMessage
+	replies   bytes.Buffer
 }
 
-func (extension *BaseProxyExtension) onMessage(*ProxiedMessage) bool {
-	return true
+func (c *extensionConn) Write(b []byte) (int, error) {
+	return c.replies.Write(b)
 }
 
-func (extension *BaseProxyExtension) onResponse(*ProxiedMessage) bool {
-	return true
+// Flush passes the buffered replies through the extensions and writes them to
+// the client.
+func (c *extensionConn) Flush() error {
+	for c.replies.Len() > 0 {
+		h, err := readHeader(&c.replies)
+		if err != nil {
+			return err
+		}
+		size := int(h.MessageLength - headerLen)
+		if size < 0 || size > c.replies.Len() {
+			return errMessageLength
+		}
+		r := &Response{header: h, raw: append(h.ToWire(), c.replies.Next(size)...)}
+		if err := c.extension.OnResponse(c.message, r); err != nil {
+			return err
+		}
+		if _, err := c.Conn.Write(r.raw); err != nil {
+			return err
+		}
+	}
+	if f, ok := c.Conn.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
 }
 
 type QueryLogger struct {
 	*BaseProxyExtension
 }
 
-func (extension *QueryLogger) onHeader(m *ProxiedMessage) bool {
-	query, err := m.GetQuery()
+func (extension *QueryLogger) OnRequest(m *ProxiedMessage) error {
+	command, err := m.GetCommand()
 	if err == nil {
 		var logMessage string
 
-		collName := m.fullCollectionName
-		if collName != nil && len(collName) > 0 && query != nil {
-			collName = collName[:len(collName)-1]
-			logMessage = fmt.Sprintf("message: op: %v coll: %s {%v}", m.header.OpCode, collName, *query)
+		if command != nil && command.Namespace != "" {
+			logMessage = fmt.Sprintf("message: op: %v cmd: %s coll: %s {%v}", m.header.OpCode, command.Name, command.Namespace, command.Args)
+		} else if command != nil {
+			logMessage = fmt.Sprintf("message: op: %v cmd: %s db: %s {%v}", m.header.OpCode, command.Name, command.Database, command.Args)
 		} else {
 			logMessage = fmt.Sprintf("message: op: %v", m.header.OpCode)
 		}
 		corelog.LogInfo(logMessage)
 	}
-	return true
+	return nil
 }
@@ -0,0 +1,308 @@
+package dvara
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type recordingExtension struct {
+	BaseProxyExtension
+	name    string
+	calls   *[]string
+	refuse  error
+	replyTo interface{}
+}
+
+func (e *recordingExtension) OnConnection(net.Conn) error {
+	*e.calls = append(*e.calls, e.name+".connection")
+	return e.refuse
+}
+
+func (e *recordingExtension) OnRequest(m *ProxiedMessage) error {
+	*e.calls = append(*e.calls, e.name+".request")
+	if e.replyTo != nil {
+		return m.Reply(e.replyTo)
+	}
+	return e.refuse
+}
+
+func (e *recordingExtension) OnResponse(*ProxiedMessage, *Response) error {
+	*e.calls = append(*e.calls, e.name+".response")
+	return nil
+}
+
+func (e *recordingExtension) OnDisconnect(net.Conn) {
+	*e.calls = append(*e.calls, e.name+".disconnect")
+}
+
+func TestProxyExtensionStackOrder(t *testing.T) {
+	t.Parallel()
+	var calls []string
+	inner := NewProxyExtensionStack([]ProxyExtension{
+		&recordingExtension{name: "b", calls: &calls},
+		&recordingExtension{name: "c", calls: &calls},
+	})
+	stack := NewProxyExtensionStack([]ProxyExtension{
+		&recordingExtension{name: "a", calls: &calls},
+		&inner,
+	})
+	var message ProxiedMessage
+	if err := stack.OnConnection(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := stack.OnRequest(&message); err != nil {
+		t.Fatal(err)
+	}
+	if err := stack.OnResponse(&message, nil); err != nil {
+		t.Fatal(err)
+	}
+	stack.OnDisconnect(nil)
+	expected := []string{
+		"a.connection", "b.connection", "c.connection",
+		"a.request", "b.request", "c.request",
+		"c.response", "b.response", "a.response",
+		"c.disconnect", "b.disconnect", "a.disconnect",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("did not get expected calls, got %v", calls)
+	}
+}
+
+func TestProxyExtensionStackRefuse(t *testing.T) {
+	t.Parallel()
+	var calls []string
+	refused := errors.New("refused")
+	stack := NewProxyExtensionStack([]ProxyExtension{
+		&recordingExtension{name: "a", calls: &calls},
+		&recordingExtension{name: "b", calls: &calls, refuse: refused},
+		&recordingExtension{name: "c", calls: &calls},
+	})
+	if err := stack.OnConnection(nil); err != refused {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+	expected := []string{"a.connection", "b.connection", "a.disconnect"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("did not get expected calls, got %v", calls)
+	}
+}
+
+func TestProxyExtensionStackReply(t *testing.T) {
+	t.Parallel()
+	var calls []string
+	stack := NewProxyExtensionStack([]ProxyExtension{
+		&recordingExtension{name: "a", calls: &calls, replyTo: bson.M{"ok": 1, "synthetic": true}},
+		&recordingExtension{name: "b", calls: &calls},
+	})
+	request := fakeCommand("test", "ping", bson.M{"ping": 1}, bson.M{})
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(h, fakeReadWriter{Reader: r, Writer: &client}, fakeReadWriter{}, &lastError)
+	if err := stack.OnRequest(&message); err != nil {
+		t.Fatal(err)
+	}
+	if !message.replied || !reflect.DeepEqual(calls, []string{"a.request"}) {
+		t.Fatalf("did not stop at the reply, got %v", calls)
+	}
+	if r.Len() != 0 {
+		t.Fatal("did not read the entire request")
+	}
+	var out bson.M
+	rh, _, _, err := (&ReplyRW{}).ReadOne(&client, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rh.OpCode != OpCommandReply || rh.ResponseTo != 11 || out["synthetic"] != true {
+		t.Fatalf("did not get expected reply %s %v", rh, out)
+	}
+}
+
+func TestProxiedMessageReplyMsg(t *testing.T) {
+	t.Parallel()
+	request := fakeMsg(&opMsg{sections: []MsgSection{{
+		Kind:      SectionBody,
+		Documents: [][]byte{mustMarshal(bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})},
+	}}})
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(h, fakeReadWriter{Reader: r, Writer: &client}, fakeReadWriter{}, &lastError)
+	if err := message.Reply(bson.M{"ok": 1}); err != nil {
+		t.Fatal(err)
+	}
+	rh, _, out := readMsgReply(t, client.Bytes())
+	if rh.ResponseTo != 7 || out["ok"] != 1 {
+		t.Fatalf("did not get expected reply %s %v", rh, out)
+	}
+}
+
+func TestProxiedMessageSetQuery(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name    string
+		Request []byte
+	}{
+		{"query", fakeLegacyQuery(0, "test.$cmd", 0, -1, bson.D{{Name: "count", Value: "foo"}}, nil)},
+		{"command", fakeCommand("test", "count", bson.D{{Name: "count", Value: "foo"}}, bson.M{})},
+		{"msg", fakeMsg(&opMsg{
+			flags: MsgChecksumPresent,
+			sections: []MsgSection{{
+				Kind:      SectionBody,
+				Documents: [][]byte{mustMarshal(bson.D{{Name: "count", Value: "foo"}, {Name: "$db", Value: "test"}})},
+			}},
+		})},
+	}
+	for _, c := range cases {
+		r := bytes.NewReader(c.Request)
+		h, err := readHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var server bytes.Buffer
+		var lastError LastError
+		message := NewProxiedMessage(h, fakeReadWriter{Reader: r}, fakeReadWriter{Writer: &server}, &lastError)
+		q, err := message.GetQuery()
+		if err != nil {
+			t.Fatal(err)
+		}
+		changed := append(bson.D{{Name: "count", Value: "a much longer collection name"}}, (*q)[1:]...)
+		if err := message.SetQuery(changed); err != nil {
+			t.Fatal(err)
+		}
+		if err := message.forward(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the forwarded message reads back with the new query
+		fr := bytes.NewReader(server.Bytes())
+		fh, err := readHeader(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(fh.MessageLength) != server.Len() {
+			t.Fatalf("for %s the length was not updated, got %d for %d bytes", c.Name, fh.MessageLength, server.Len())
+		}
+		forwarded := NewProxiedMessage(fh, fakeReadWriter{Reader: fr}, fakeReadWriter{}, &lastError)
+		command, err := forwarded.GetCommand()
+		if err != nil {
+			t.Fatalf("for %s got %s", c.Name, err)
+		}
+		if command.Namespace != "test.a much longer collection name" {
+			t.Fatalf("for %s did not get the new query, got %v", c.Name, command.Args)
+		}
+	}
+}
+
+func TestResponseSetDocument(t *testing.T) {
+	t.Parallel()
+	var b bytes.Buffer
+	b.ReadFrom(fakeMsgReply(MsgChecksumPresent, bson.M{"ok": 1}))
+	h, err := readHeader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Response{header: h, raw: b.Bytes()}
+	doc, err := r.GetDocument()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetDocument(append(doc, bson.DocElem{Name: "extra", Value: "value"})); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, out := readMsgReply(t, r.raw)
+	if out["extra"] != "value" || msg.flags != MsgChecksumPresent {
+		t.Fatalf("did not set document, got %v", out)
+	}
+}
+
+func TestResponseMultipleDocuments(t *testing.T) {
+	t.Parallel()
+	batch := append(make([]byte, opReplyPrefixLen), mustMarshal(bson.M{"a": 1})...)
+	batch = append(batch, mustMarshal(bson.M{"b": 2})...)
+	setInt32(batch, 16, 2)
+	cases := []struct {
+		Name string
+		Raw  []byte
+	}{
+		{
+			Name: "OpReply batch",
+			Raw:  append(messageHeader{OpCode: OpReply, MessageLength: int32(headerLen + len(batch))}.ToWire(), batch...),
+		},
+		{
+			Name: "OpMsg document sequence",
+			Raw: fakeMsg(&opMsg{
+				sections: []MsgSection{
+					{Kind: SectionBody, Documents: [][]byte{mustMarshal(bson.M{"ok": 1})}},
+					{
+						Kind:       SectionDocumentSequence,
+						Identifier: "documents",
+						Documents:  [][]byte{mustMarshal(bson.M{"a": 1}), mustMarshal(bson.M{"b": 2})},
+					},
+				},
+			}),
+		},
+	}
+	for _, c := range cases {
+		h, err := readHeader(bytes.NewReader(c.Raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &Response{header: h, raw: c.Raw}
+		if _, err := r.GetDocument(); err != errReplyDocuments {
+			t.Fatalf("for %s expected %s, got %v", c.Name, errReplyDocuments, err)
+		}
+		if err := r.SetDocument(bson.M{"ok": 1}); err != errReplyDocuments {
+			t.Fatalf("for %s expected %s, got %v", c.Name, errReplyDocuments, err)
+		}
+		if !bytes.Equal(r.raw, c.Raw) {
+			t.Fatalf("for %s the reply was changed", c.Name)
+		}
+	}
+}
+
+type mutatingExtension struct {
+	BaseProxyExtension
+}
+
+func (e *mutatingExtension) OnResponse(m *ProxiedMessage, r *Response) error {
+	return r.SetDocument(bson.M{"mutated": true})
+}
+
+func TestExtensionConnFlush(t *testing.T) {
+	t.Parallel()
+	var client bytes.Buffer
+	ec := &extensionConn{
+		Conn:      fakeReadWriter{Writer: &client},
+		extension: &mutatingExtension{},
+	}
+	reply := fakeCommandReply(bson.M{"ok": 1}, bson.M{})
+	if _, err := ec.Write(reply); err != nil {
+		t.Fatal(err)
+	}
+	if client.Len() != 0 {
+		t.Fatal("reply was written before flush")
+	}
+	if err := ec.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var out bson.M
+	if _, _, _, err := (&ReplyRW{}).ReadOne(&client, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["mutated"] != true {
+		t.Fatalf("did not mutate reply, got %v", out)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
 )
 
 var hardRestart = flag.Bool(
@@ -21,6 +22,10 @@ var hardRestart = flag.Bool(
 
 var errNoAddrsGiven = errors.New("dvara: no seed addresses given for ReplicaSet")
 
+// DefaultMaxWireVersion is the highest wire version advertised to clients
+// unless configured otherwise. It is the wire version of MongoDB 6.0.
+const DefaultMaxWireVersion = 17
+
 // ReplicaSet manages the real => proxy address mapping.
 // NewReplicaSet returns the ReplicaSet given the list of seed servers. It is
 // required for the seed servers to be a strict subset of the actual members if
@@ -44,6 +49,14 @@ type ReplicaSet struct {
 	PortStart int
 	PortEnd   int
 
+	// ListenerGroups are groups of proxies, one for each member, with their own
+	// port range and server connection pools, so workloads connecting through
+	// different groups don't share server connections. Settings a group leaves
+	// zero are taken from the ReplicaSet. Empty means a single group with the
+	// settings of the ReplicaSet, otherwise the first group is the one health
+	// checks connect through.
+	ListenerGroups []ListenerGroup
+
 	// Where to listen for clients.
 	// "0.0.0.0" means public service, "127.0.0.1" means localhost only.
 	ListenAddr string
@@ -58,10 +71,109 @@ type ReplicaSet struct {
 	// around.
 	MinIdleConnections uint
 
+	// MaxPoolWaiting is the maximum number of clients waiting for a server
+	// connection once MaxConnections are in use. Further clients get an error
+	// right away. Zero means no limit.
+	MaxPoolWaiting uint
+
+	// FairQueueBy is what clients waiting for a server connection are told
+	// apart by, so one client can't take them all: "ip" for the remote address,
+	// "tls" for the subject of the client certificate or "app" for the appName
+	// sent by the driver. Clients without one are told apart by remote address.
+	// Empty means waiting clients are served first come, first served.
+	FairQueueBy string
+
+	// FairQueueWeights is the share of server connections a client gets while
+	// clients are waiting, relative to the other waiting clients. Clients not
+	// listed have a weight of 1.
+	FairQueueWeights map[string]uint
+
+	// PriorityClasses are the classes of clients that get server connections
+	// ahead of the clients of lower classes, highest first. Each can reserve a
+	// share of MaxConnections to each mongo node. Clients that match none are
+	// in the lowest class.
+	PriorityClasses []PriorityClass
+
+	// PriorityShedAfter is how long clients may wait for a server connection
+	// before the waiting clients of the lowest class get an error, and then
+	// those of the next class up, but never those of the highest class. Zero
+	// means they are never shed.
+	PriorityShedAfter time.Duration
+
+	// PoolAcquireTimeout is how long a client waits for a server connection
+	// before it gets an error. Zero means MessageTimeout.
+	PoolAcquireTimeout time.Duration
+
 	// ServerIdleTimeout is the duration after which a server connection will be
 	// considered idle.
 	ServerIdleTimeout time.Duration
 
+	// AdaptiveLimitMin turns on adapting the number of server connections to
+	// each mongo node used at once to its latency, between AdaptiveLimitMin and
+	// MaxConnections. Zero means MaxConnections are always used.
+	AdaptiveLimitMin uint
+
+	// AdaptiveLimitLatency is how long a message may take before the number of
+	// server connections used at once is cut. Zero means 100ms, the slowms
+	// default of mongod.
+	AdaptiveLimitLatency time.Duration
+
+	// AdaptiveLimitBackoff is the factor the number of server connections used
+	// at once is cut by. Zero means 0.9.
+	AdaptiveLimitBackoff float64
+
+	// MaxConcurrentDials is the maximum number of server connections being
+	// dialed to each mongo node at once, so a node coming back isn't flooded
+	// with handshakes. Further clients wait for a dial to finish or a server
+	// connection to be released. Zero means no limit.
+	MaxConcurrentDials uint
+
+	// ServerDialTimeout is the timeout for dialing a server connection. Zero
+	// means one second.
+	ServerDialTimeout time.Duration
+
+	// ServerDialAttempts is the number of times dialing a server connection is
+	// tried before giving up. Zero means 7.
+	ServerDialAttempts uint
+
+	// ServerDialBackoff is how long we wait before trying to dial a server
+	// connection again, doubled after every failed try. Zero means 50ms.
+	ServerDialBackoff time.Duration
+
+	// ServerDialBackoffJitter is the most every wait before trying to dial
+	// again is randomly lengthened by, so clients don't all dial at once.
+	ServerDialBackoffJitter time.Duration
+
+	// BreakerFailureThreshold is the number of dials to a member failing in a
+	// row after which clients get an error right away instead of waiting for a
+	// dial. Zero means they always wait.
+	BreakerFailureThreshold uint
+
+	// BreakerOpenTimeout is how long clients get an error right away before
+	// dialing the member is tried again.
+	BreakerOpenTimeout time.Duration
+
+	// ServerWarmInterval is how often a server connection is dialed in the
+	// background while there are fewer than MinIdleConnections idle ones. Zero
+	// means server connections are only dialed when a client needs one.
+	ServerWarmInterval time.Duration
+
+	// ServerValidateIdle is the idle time after which a server connection gets
+	// a ping before it is used. Zero means they are never pinged.
+	ServerValidateIdle time.Duration
+
+	// ServerMaxLifetime is the duration after which a server connection is
+	// closed when it is released, instead of being reused. Zero means no limit.
+	ServerMaxLifetime time.Duration
+
+	// ServerMaxLifetimeJitter is the most the lifetime of a server connection
+	// is randomly shortened by, so they don't all expire together.
+	ServerMaxLifetimeJitter time.Duration
+
+	// ServerMaxUses is the number of times a server connection is acquired
+	// after which it is closed, instead of being reused. Zero means no limit.
+	ServerMaxUses uint
+
 	// ServerClosePoolSize is the number of goroutines that will handle closing
 	// server connections.
 	ServerClosePoolSize uint
@@ -82,6 +194,31 @@ type ReplicaSet struct {
 	// proxied.
 	MessageTimeout time.Duration
 
+	// BodyReadTimeout is how long a client has to send the rest of a message
+	// once its header was read. Zero means MessageTimeout.
+	BodyReadTimeout time.Duration
+
+	// MaxMessageLength is the longest message accepted from clients. Zero means
+	// the maxMessageSizeBytes advertised by the backend.
+	MaxMessageLength int
+	limits           wireLimits
+
+	// StoreForward turns on store-and-forward mode. A request is read from the
+	// client before a server connection is acquired, and its replies are sent
+	// to the client once the server connection was released, so slow clients
+	// don't hold server connections. Messages that don't fit the memory caps
+	// are streamed.
+	StoreForward bool
+
+	// StoreForwardMaxMessage is the most memory a request may be stored in, and
+	// separately the most its replies may be stored in. Zero means no limit.
+	StoreForwardMaxMessage int64
+
+	// StoreForwardMaxMemory is the most memory all stored requests and replies
+	// may be stored in. Zero means no limit.
+	StoreForwardMaxMemory int64
+	storeForwardMemory    memoryBudget
+
 	// Name is the name of the replica set to connect to. Nodes that are not part
 	// of this replica set will be ignored. If this is empty, the first replica set
 	// will be used
@@ -90,6 +227,11 @@ type ReplicaSet struct {
 	// Credentials to use to login to the backend server
 	Cred Credential
 
+	// MaxWireVersion is the highest wire version advertised to clients in
+	// handshake replies. Drivers pick protocol features based on it, so it must
+	// not exceed what dvara can proxy. Zero means DefaultMaxWireVersion.
+	MaxWireVersion int
+
 	restarter *sync.Once
 
 	// TLS config to use to dial to the backend server, nil if no TLS
@@ -104,7 +246,32 @@ func (r *ReplicaSet) Start() error {
 		return errNoAddrsGiven
 	}
 
+	if err := r.checkListenerGroups(); err != nil {
+		return err
+	}
+	if err := r.checkFairQueueBy(); err != nil {
+		return err
+	}
+	if err := r.checkPriorityClasses(); err != nil {
+		return err
+	}
+
 	r.restarter = new(sync.Once)
+
+	maxWireVersion := r.MaxWireVersion
+	if maxWireVersion == 0 {
+		maxWireVersion = DefaultMaxWireVersion
+	}
+	if r.ProxyQuery != nil && r.ProxyQuery.IsMasterResponseRewriter != nil {
+		r.ProxyQuery.IsMasterResponseRewriter.MaxWireVersion = maxWireVersion
+		r.ProxyQuery.IsMasterResponseRewriter.Stats = r.Stats
+		r.ProxyQuery.IsMasterResponseRewriter.limits = &r.limits
+	}
+	corelog.LogInfoMessage(fmt.Sprintf("advertising maxWireVersion of at most %d", maxWireVersion))
+
+	if r.MaxMessageLength > 0 {
+		r.limits.configure(int32(r.MaxMessageLength))
+	}
 	return nil
 }
 
@@ -112,8 +279,8 @@ func (r *ReplicaSet) proxyAddr(l net.Listener) string {
 	return l.Addr().String()
 }
 
-func (r *ReplicaSet) newListener() (net.Listener, error) {
-	for i := r.PortStart; i <= r.PortEnd; i++ {
+func (r *ReplicaSet) newListener(g ListenerGroup) (net.Listener, error) {
+	for i := g.PortStart; i <= g.PortEnd; i++ {
 		var listener net.Listener
 		var err error
 		laddr := fmt.Sprintf("%s:%d", r.ListenAddr, i)
@@ -128,8 +295,8 @@ func (r *ReplicaSet) newListener() (net.Listener, error) {
 	}
 	return nil, fmt.Errorf(
 		"could not find a free port in range %d-%d",
-		r.PortStart,
-		r.PortEnd,
+		g.PortStart,
+		g.PortEnd,
 	)
 }
 
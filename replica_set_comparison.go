@@ -1,8 +1,12 @@
 package dvara
 
+// ReplicaSetComparison holds the proxies of every listener group of the
+// members that differ between two states.
 type ReplicaSetComparison struct {
 	// Extra members that are in this state, but not in new state
-	ExtraMembers map[string]*Proxy
+	ExtraMembers map[string][]*Proxy
 	// Missing members that aren't in this state, but are in new
-	MissingMembers map[string]*Proxy
+	MissingMembers map[string][]*Proxy
+	// Changed members are in both states, but their state changed
+	ChangedMembers map[string][]*Proxy
 }
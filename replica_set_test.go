@@ -39,7 +39,7 @@ func DisabledTestStopNodeInReplica(t *testing.T) {
 func TestNewListenerZeroZeroRandomPort(t *testing.T) {
 	t.Parallel()
 	r := &ReplicaSet{}
-	l, err := r.newListener()
+	l, err := r.newListener(r.listenerGroups()[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -49,7 +49,7 @@ func TestNewListenerZeroZeroRandomPort(t *testing.T) {
 func TestNewListenerError(t *testing.T) {
 	t.Parallel()
 	r := &ReplicaSet{PortStart: 1, PortEnd: 0}
-	_, err := r.newListener()
+	_, err := r.newListener(r.listenerGroups()[0])
 	expected := "could not find a free port in range 1-0"
 	if err == nil || err.Error() != expected {
 		t.Fatalf("did not get expected error, got: %s", err)
@@ -64,6 +64,38 @@ func TestNoAddrsGiven(t *testing.T) {
 	}
 }
 
+func TestStartInvalidQueueing(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		ReplicaSet ReplicaSet
+		Error      error
+	}{
+		{
+			ReplicaSet: ReplicaSet{Addrs: "localhost:27017", FairQueueBy: "user"},
+			Error:      errInvalidFairQueueBy,
+		},
+		{
+			ReplicaSet: ReplicaSet{
+				Addrs:           "localhost:27017",
+				PriorityClasses: []PriorityClass{{Share: 0.6}, {Share: 0.6}},
+			},
+			Error: errInvalidPriorityShare,
+		},
+		{
+			ReplicaSet: ReplicaSet{
+				Addrs:           "localhost:27017",
+				PriorityClasses: []PriorityClass{{Share: -0.1}},
+			},
+			Error: errInvalidPriorityShare,
+		},
+	}
+	for _, c := range cases {
+		if err := c.ReplicaSet.Start(); err != c.Error {
+			t.Fatalf("expected %s but got %v", c.Error, err)
+		}
+	}
+}
+
 func setupReplicaSet() *ReplicaSet {
 	return &ReplicaSet{
 		ReplicaSetStateCreator: &ReplicaSetStateCreator{},
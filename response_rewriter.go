@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"strings"
 
+	"github.com/facebookgo/stats"
 	corelog "github.com/intercom/gocore/log"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -24,22 +25,29 @@ var (
 		false,
 		"if true only readonly queries will be allowed",
 	)
+	translateLegacyOps = flag.Bool(
+		"dvara.translate-legacy",
+		false,
+		"if true legacy op codes will be translated into the equivalent commands",
+	)
 
 	adminCollectionName = []byte("admin.$cmd\000")
 	cmdCollectionSuffix = []byte(".$cmd\000")
 )
 
-//https: //github.com/mongodb/mongo/blob/master/src/mongo/base/error_codes.err#L16
+// https: //github.com/mongodb/mongo/blob/master/src/mongo/base/error_codes.err#L16
 const authErrorCode = 13
 
-// ProxyQuery proxies an OpQuery and a corresponding response.
+// ProxyQuery proxies an OpQuery, OpCommand or OpMsg and a corresponding
+// response.
 type ProxyQuery struct {
 	GetLastErrorRewriter             *GetLastErrorRewriter             `inject:""`
 	IsMasterResponseRewriter         *IsMasterResponseRewriter         `inject:""`
 	ReplSetGetStatusResponseRewriter *ReplSetGetStatusResponseRewriter `inject:""`
+	LegacyOpTranslator               *LegacyOpTranslator               `inject:""`
 }
 
-// Proxy proxies an OpQuery and a corresponding response.
+// Proxy proxies an OpQuery, OpCommand or OpMsg and a corresponding response.
 func (p *ProxyQuery) Proxy(message *ProxiedMessage) error {
 
 	// https://github.com/mongodb/mongo/search?q=lastError.disableForCommand
@@ -53,39 +61,57 @@ func (p *ProxyQuery) Proxy(message *ProxiedMessage) error {
 	}
 
 	var rewriter responseRewriter
-	if *proxyAllQueries || *readOnly || bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix) {
-		q, err3 := message.GetQuery()
+	if *proxyAllQueries || message.readOnly || bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix) {
+		command, err3 := message.GetCommand()
 		if err3 != nil {
 			return err3
 		}
 
-		if *readOnly {
-			if hasKey(*q, "insert") || hasKey(*q, "delete") || hasKey(*q, "update") {
+		// The cached getLastError is an OpReply message, it only applies to
+		// legacy clients.
+		legacy := message.header.OpCode == OpQuery
+
+		// The read only error is sent in the reply format of the request.
+		if message.readOnly && command != nil && command.IsWrite() {
+			switch message.header.OpCode {
+			case OpQuery:
 				message.lastError.NewError("Readonly database", 66)
 				err := p.GetLastErrorRewriter.Rewrite(message)
 				message.lastError.Reset()
 				return err
+			case OpCommand:
+				return p.rejectCommand(message, "Readonly database", 66)
+			case OpMsg:
+				return p.rejectMsg(message, "Readonly database", 66)
 			}
 		}
 
-    if q != nil {
-      if hasKey(*q, "getLastError") {
-        return p.GetLastErrorRewriter.Rewrite(message)
-      }
+		if command != nil {
+			if legacy && command.Is("getLastError") {
+				// When translating, the server may not know getLastError anymore. The
+				// cached result of the last write answers it, or if there was none,
+				// there is no error.
+				if *translateLegacyOps && !message.lastError.Exists() {
+					if err := message.lastError.setReply(0, noLastError); err != nil {
+						return err
+					}
+				}
+				return p.GetLastErrorRewriter.Rewrite(message)
+			}
 
-      if hasKey(*q, "isMaster") {
-        rewriter = p.IsMasterResponseRewriter
-      }
+			if command.Is("isMaster") || command.Is("hello") {
+				rewriter = p.IsMasterResponseRewriter.forGroup(message.group)
+			}
 
-      if bytes.Equal(adminCollectionName, fullCollectionName) && hasKey(*q, "replSetGetStatus") {
-        rewriter = p.ReplSetGetStatusResponseRewriter
-      }
-    }
+			if command.Database == "admin" && command.Is("replSetGetStatus") {
+				rewriter = p.ReplSetGetStatusResponseRewriter.forGroup(message.group)
+			}
+		}
 
 		if rewriter != nil {
 			// If forShell is specified, we don't want to reset the last error. See
 			// comment above around resetLastError for details.
-			resetLastError = hasKey(*q, "forShell")
+			resetLastError = hasKey(command.Args, "forShell")
 		}
 	}
 
@@ -94,27 +120,36 @@ func (p *ProxyQuery) Proxy(message *ProxiedMessage) error {
 		message.lastError.Reset()
 	}
 
-	parts, err2 := message.GetParts()
-	if err2 != nil {
+	// Queries and commands other than the handshake are translated, the reply
+	// is converted back into an OpReply.
+	if *translateLegacyOps && message.header.OpCode == OpQuery && rewriter == nil {
+		return p.LegacyOpTranslator.TranslateQuery(message)
+	}
+
+	if _, err2 := message.GetParts(); err2 != nil {
 		return err2
 	}
 
-	var written int
-	for _, b := range parts {
-		n, err := message.server.Write(b)
-		if err != nil {
-			corelog.LogError("error", err)
+	msgFlags, err := message.GetMsgFlags()
+	if err != nil {
+		return err
+	}
+	// Rewriters handle a single reply, don't let the server stream more.
+	if rewriter != nil && msgFlags&MsgExhaustAllowed != 0 {
+		if err := message.clearMsgFlags(MsgExhaustAllowed); err != nil {
 			return err
 		}
-		written += n
 	}
 
-	pending := int64(message.header.MessageLength) - int64(written)
-	if _, err := io.CopyN(message.server, message.client, pending); err != nil {
-		corelog.LogError("error", err)
+	if err := message.forward(); err != nil {
 		return err
 	}
 
+	// The server does not reply to an OpMsg with the moreToCome flag.
+	if msgFlags&MsgMoreToCome != 0 {
+		return nil
+	}
+
 	if rewriter != nil {
 		if err := rewriter.Rewrite(message.client, message.server); err != nil {
 			return err
@@ -122,11 +157,56 @@ func (p *ProxyQuery) Proxy(message *ProxiedMessage) error {
 		return nil
 	}
 
-	if err := copyMessage(message.client, message.server); err != nil {
+	copyReplies := copyMessage
+	if message.header.OpCode == OpMsg {
+		copyReplies = copyMsgReplies
+	}
+	if err := copyReplies(message.client, message.server); err != nil {
+		corelog.LogError("error", err)
+		return err
+	}
+
+	return nil
+}
+
+// rejectCommand replies to an OpCommand with an error instead of proxying it.
+func (p *ProxyQuery) rejectCommand(message *ProxiedMessage, msg string, code int) error {
+	rest, err := message.readRemaining()
+	if err != nil {
+		return err
+	}
+	if _, err := splitDocuments(rest); err != nil {
+		return err
+	}
+	reply := bson.D{
+		{Name: "ok", Value: 0},
+		{Name: "errmsg", Value: msg},
+		{Name: "code", Value: code},
+	}
+	if err := writeCommandReply(message.client, message.header.RequestID, reply); err != nil {
 		corelog.LogError("error", err)
 		return err
 	}
+	return nil
+}
 
+// rejectMsg replies to an OpMsg with an error instead of proxying it. An
+// unacknowledged write doesn't take a reply, it is dropped.
+func (p *ProxyQuery) rejectMsg(message *ProxiedMessage, msg string, code int) error {
+	expects, err := message.expectsReply()
+	if err != nil {
+		return err
+	}
+	if _, err := message.readRemaining(); err != nil {
+		return err
+	}
+	if !expects {
+		return nil
+	}
+	if err := message.sendError(code, msg, nil); err != nil {
+		corelog.LogError("error", err)
+		return err
+	}
 	return nil
 }
 
@@ -149,13 +229,20 @@ func (l *LastError) Reset() {
 
 // Creates an error
 func (l *LastError) NewError(msg string, code int) error {
-	errDoc := bson.M{"$err": msg, "code": code}
-	data, err := bson.Marshal(errDoc)
+	return l.setReply(2, bson.M{"$err": msg, "code": code})
+}
+
+// setReply caches a single document OpReply with the given response flags.
+func (l *LastError) setReply(flags int32, doc interface{}) error {
+	data, err := bson.Marshal(doc)
 	if err != nil {
 		return err
 	}
 	l.rest.Reset()
-	if _, err = l.rest.Write([]byte{2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0}); err != nil {
+	prefix := make([]byte, opReplyPrefixLen)
+	setInt32(prefix, 0, flags)
+	setInt32(prefix, 16, 1)
+	if _, err = l.rest.Write(prefix); err != nil {
 		return err
 	}
 	if _, err = l.rest.Write(data); err != nil {
@@ -189,19 +276,7 @@ func (r *GetLastErrorRewriter) Rewrite(
 	if !lastError.Exists() {
 		// We're going to be performing a real getLastError query and caching the
 		// response.
-		var written int
-		for _, b := range parts {
-			n, err := server.Write(b)
-			if err != nil {
-				corelog.LogError("error", err)
-				return err
-			}
-			written += n
-		}
-
-		pending := int64(h.MessageLength) - int64(written)
-		if _, err := io.CopyN(server, client, pending); err != nil {
-			corelog.LogError("error", err)
+		if err := m.forward(); err != nil {
 			return err
 		}
 
@@ -210,7 +285,7 @@ func (r *GetLastErrorRewriter) Rewrite(
 			corelog.LogError("error", err)
 			return err
 		}
-		pending = int64(lastError.header.MessageLength - headerLen)
+		pending := int64(lastError.header.MessageLength - headerLen)
 		if _, err = io.CopyN(&lastError.rest, server, pending); err != nil {
 			corelog.LogError("error", err)
 			return err
@@ -253,56 +328,149 @@ type ProxyMapper interface {
 	Proxy(h string) (string, error)
 }
 
+// GroupProxyMapper maps real mongo addresses to the proxy addresses of a
+// listener group.
+type GroupProxyMapper interface {
+	GroupProxy(group, h string) (string, error)
+}
+
+// groupProxyMapper maps to the proxy addresses of a single listener group.
+type groupProxyMapper struct {
+	mapper GroupProxyMapper
+	group  string
+}
+
+func (m groupProxyMapper) Proxy(h string) (string, error) {
+	return m.mapper.GroupProxy(m.group, h)
+}
+
+// mapperForGroup returns a ProxyMapper for the proxy addresses of a listener
+// group, if the mapper knows about groups.
+func mapperForGroup(m ProxyMapper, group string) ProxyMapper {
+	if gm, ok := m.(GroupProxyMapper); ok {
+		return groupProxyMapper{mapper: gm, group: group}
+	}
+	return m
+}
+
 type responseRewriter interface {
 	Rewrite(client io.Writer, server io.Reader) error
 }
 
-type replyPrefix [20]byte
+// replyPrefix holds the bytes of a reply besides the header and the document.
+// These are the fixed fields of an OpReply, the flag bits and the section kind
+// of an OpMsg, or the metadata that follows the document of an
+// OpCommandReply.
+type replyPrefix []byte
 
-var emptyPrefix replyPrefix
+// opReplyPrefixLen is the size of the fixed fields of an OpReply.
+const opReplyPrefixLen = 20
 
 // ReplyRW provides common helpers for rewriting replies from the server.
 type ReplyRW struct {
 }
 
 // ReadOne reads a 1 document response, from the server, unmarshals it into v
-// and returns the various parts.
+// and returns the various parts. The response may be an OpReply or an OpMsg.
 func (r *ReplyRW) ReadOne(server io.Reader, v interface{}) (*messageHeader, replyPrefix, int32, error) {
 	h, err := readHeader(server)
 	if err != nil {
 		corelog.LogError("error", err)
-		return nil, emptyPrefix, 0, err
+		return nil, nil, 0, err
 	}
 
-	if h.OpCode != OpReply {
+	var prefix replyPrefix
+	var rawDoc []byte
+	switch h.OpCode {
+	case OpReply:
+		prefix = make(replyPrefix, opReplyPrefixLen)
+		if _, err := io.ReadFull(server, prefix); err != nil {
+			corelog.LogError("error", err)
+			return nil, nil, 0, err
+		}
+
+		numDocs := getInt32(prefix, 16)
+		if numDocs != 1 {
+			err := fmt.Errorf("readOneReplyDoc: can only handle 1 result document, got: %d", numDocs)
+			return nil, nil, 0, err
+		}
+
+		// replies from the server are bounded by the default document size
+		if rawDoc, err = readDocument(server, nil); err != nil {
+			corelog.LogError("error", err)
+			return nil, nil, 0, err
+		}
+	case OpMsg:
+		if prefix, rawDoc, err = r.readMsg(server, h); err != nil {
+			corelog.LogError("error", err)
+			return nil, nil, 0, err
+		}
+	case OpCommandReply:
+		if prefix, rawDoc, err = r.readCommandReply(server, h); err != nil {
+			corelog.LogError("error", err)
+			return nil, nil, 0, err
+		}
+	default:
 		err := fmt.Errorf("readOneReplyDoc: expected op %s, got %s", OpReply, h.OpCode)
-		return nil, emptyPrefix, 0, err
+		return nil, nil, 0, err
 	}
 
-	var prefix replyPrefix
-	if _, err := io.ReadFull(server, prefix[:]); err != nil {
+	if err := bson.Unmarshal(rawDoc, v); err != nil {
 		corelog.LogError("error", err)
-		return nil, emptyPrefix, 0, err
+		return nil, nil, 0, err
 	}
 
-	numDocs := getInt32(prefix[:], 16)
-	if numDocs != 1 {
-		err := fmt.Errorf("readOneReplyDoc: can only handle 1 result document, got: %d", numDocs)
-		return nil, emptyPrefix, 0, err
-	}
+	return h, prefix, int32(len(rawDoc)), nil
+}
 
-	rawDoc, err := readDocument(server)
+// readMsg reads the body of an OpMsg reply which must consist of a single body
+// section. The checksum, if any, is verified and regenerated by WriteOne.
+func (r *ReplyRW) readMsg(server io.Reader, h *messageHeader) (replyPrefix, []byte, error) {
+	size := h.MessageLength - headerLen
+	if size < 0 {
+		return nil, nil, errMessageLength
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(server, body); err != nil {
+		return nil, nil, err
+	}
+	if err := verifyMsgChecksum(h, body); err != nil {
+		return nil, nil, err
+	}
+	msg, err := parseMsg(body)
 	if err != nil {
-		corelog.LogError("error", err)
-		return nil, emptyPrefix, 0, err
+		return nil, nil, err
 	}
-
-	if err := bson.Unmarshal(rawDoc, v); err != nil {
-		corelog.LogError("error", err)
-		return nil, emptyPrefix, 0, err
+	if len(msg.sections) != 1 {
+		err := fmt.Errorf("readOneReplyDoc: can only handle 1 section, got: %d", len(msg.sections))
+		return nil, nil, err
 	}
 
-	return h, prefix, int32(len(rawDoc)), nil
+	prefix := addInt32(nil, int32(msg.flags))
+	prefix = append(prefix, SectionBody)
+	return prefix, msg.body(), nil
+}
+
+// readCommandReply reads the body of an OpCommandReply which must not have any
+// output documents.
+func (r *ReplyRW) readCommandReply(server io.Reader, h *messageHeader) (replyPrefix, []byte, error) {
+	size := h.MessageLength - headerLen
+	if size < 0 {
+		return nil, nil, errMessageLength
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(server, body); err != nil {
+		return nil, nil, err
+	}
+	docs, err := splitDocuments(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(docs) != 2 {
+		err := fmt.Errorf("readOneReplyDoc: can only handle a reply and metadata, got %d documents", len(docs))
+		return nil, nil, err
+	}
+	return replyPrefix(docs[1]), docs[0], nil
 }
 
 // WriteOne writes a rewritten response to the client.
@@ -313,7 +481,17 @@ func (r *ReplyRW) WriteOne(client io.Writer, h *messageHeader, prefix replyPrefi
 	}
 
 	h.MessageLength = h.MessageLength - oldDocLen + int32(len(newDoc))
-	parts := [][]byte{h.ToWire(), prefix[:], newDoc}
+	parts := [][]byte{h.ToWire(), prefix, newDoc}
+	switch h.OpCode {
+	case OpMsg:
+		if uint32(getInt32(prefix, 0))&MsgChecksumPresent != 0 {
+			checksum := addInt32(nil, int32(msgChecksum(parts...)))
+			parts = append(parts, checksum)
+		}
+	case OpCommandReply:
+		// the metadata follows the document
+		parts = [][]byte{h.ToWire(), newDoc, prefix}
+	}
 	for _, p := range parts {
 		if _, err := client.Write(p); err != nil {
 			return err
@@ -331,13 +509,29 @@ type isMasterResponse struct {
 	Extra    bson.M   `bson:",inline"`
 }
 
-// IsMasterResponseRewriter rewrites the response for the "isMaster" query.
+// IsMasterResponseRewriter rewrites the response for the "isMaster" and
+// "hello" queries.
 type IsMasterResponseRewriter struct {
 	ProxyMapper ProxyMapper `inject:""`
 	ReplyRW     *ReplyRW    `inject:""`
+
+	// MaxWireVersion is the highest wire version advertised to clients, zero
+	// means DefaultMaxWireVersion. ReplicaSet sets it along with Stats and the
+	// limits it learns from the backend when it starts.
+	MaxWireVersion int
+	Stats          stats.Client
+	limits         *wireLimits
 }
 
-// Rewrite rewrites the response for the "isMaster" query.
+// forGroup returns a rewriter that hands out the proxy addresses of a listener
+// group.
+func (r *IsMasterResponseRewriter) forGroup(group string) *IsMasterResponseRewriter {
+	g := *r
+	g.ProxyMapper = mapperForGroup(r.ProxyMapper, group)
+	return &g
+}
+
+// Rewrite rewrites the response for the "isMaster" and "hello" queries.
 func (r *IsMasterResponseRewriter) Rewrite(client io.Writer, server io.Reader) error {
 	var err error
 	var q isMasterResponse
@@ -374,6 +568,51 @@ func (r *IsMasterResponseRewriter) Rewrite(client io.Writer, server io.Reader) e
 		q.Extra["passives"] = newPassives
 	}
 
+	// we decompress messages to inspect them, so only advertise the compressors
+	// we support.
+	if compression, ok := q.Extra["compression"].([]interface{}); ok {
+		var supported []string
+		for _, c := range compression {
+			if name, ok := c.(string); ok {
+				if _, ok := supportedCompressor(name); ok {
+					supported = append(supported, name)
+				}
+			}
+		}
+		if len(supported) == 0 {
+			delete(q.Extra, "compression")
+		} else {
+			q.Extra["compression"] = supported
+		}
+	}
+
+	// the backend's limits bound the messages we accept from clients
+	maxMessageLength, _ := intField(q.Extra["maxMessageSizeBytes"])
+	maxDocumentSize, _ := intField(q.Extra["maxBsonObjectSize"])
+	if r.limits != nil {
+		r.limits.learn(int32(maxMessageLength), int32(maxDocumentSize))
+	}
+
+	// drivers enable protocol features based on the wire version, don't let them
+	// pick any we can't proxy.
+	maxWireVersion := r.MaxWireVersion
+	if maxWireVersion == 0 {
+		maxWireVersion = DefaultMaxWireVersion
+	}
+	if v, ok := intField(q.Extra["maxWireVersion"]); ok && v > maxWireVersion {
+		q.Extra["maxWireVersion"] = maxWireVersion
+		stats.BumpSum(r.Stats, "isMaster.maxWireVersion.clamped", 1)
+	}
+	// a backend that needs a newer wire version than we proxy can't be used,
+	// drivers refuse it as minWireVersion is left above maxWireVersion
+	if v, ok := intField(q.Extra["minWireVersion"]); ok && v > maxWireVersion {
+		corelog.LogErrorMessage(fmt.Sprintf(
+			"backend %s needs wire version %d, above the highest proxied %d, clients will refuse it",
+			q.Me, v, maxWireVersion,
+		))
+		stats.BumpSum(r.Stats, "isMaster.minWireVersion.unsupported", 1)
+	}
+
 	if q.Primary != "" {
 		// failure in mapping the primary is fatal
 		if q.Primary, err = r.ProxyMapper.Proxy(q.Primary); err != nil {
@@ -390,12 +629,25 @@ func (r *IsMasterResponseRewriter) Rewrite(client io.Writer, server io.Reader) e
 	return r.ReplyRW.WriteOne(client, h, prefix, docLen, q)
 }
 
+// intField returns the number held in an unmarshalled field.
+func intField(v interface{}) (int, bool) {
+	switch v := v.(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	}
+	return 0, false
+}
+
 type statusMember struct {
-	Name  string       `bson:"name"`
-	State ReplicaState `bson:"stateStr,omitempty"`
-  StateCode int      `bson:"state"`
-	Self  bool         `bson:"self,omitempty"`
-	Extra bson.M       `bson:",inline"`
+	Name      string       `bson:"name"`
+	State     ReplicaState `bson:"stateStr,omitempty"`
+	StateCode int          `bson:"state"`
+	Self      bool         `bson:"self,omitempty"`
+	Extra     bson.M       `bson:",inline"`
 }
 
 type replSetGetStatusResponse struct {
@@ -410,6 +662,14 @@ type ReplSetGetStatusResponseRewriter struct {
 	ReplyRW     *ReplyRW    `inject:""`
 }
 
+// forGroup returns a rewriter that hands out the proxy addresses of a listener
+// group.
+func (r *ReplSetGetStatusResponseRewriter) forGroup(group string) *ReplSetGetStatusResponseRewriter {
+	g := *r
+	g.ProxyMapper = mapperForGroup(r.ProxyMapper, group)
+	return &g
+}
+
 // Rewrite rewrites the "replSetGetStatus" response.
 func (r *ReplSetGetStatusResponseRewriter) Rewrite(client io.Writer, server io.Reader) error {
 	var err error
@@ -15,6 +15,7 @@ import (
 	"github.com/facebookgo/ensure"
 	"github.com/facebookgo/inject"
 	"github.com/facebookgo/startstop"
+	"github.com/facebookgo/stats"
 
 	"gopkg.in/mgo.v2/bson"
 )
@@ -67,6 +68,37 @@ func fakeSingleDocReply(v interface{}) io.Reader {
 	return fakeReader(h, b)
 }
 
+func fakeMsgReply(flags uint32, v interface{}) io.Reader {
+	m := &opMsg{
+		flags: flags,
+		sections: []MsgSection{
+			{Kind: SectionBody, Documents: [][]byte{mustMarshal(v)}},
+		},
+	}
+	return bytes.NewReader(fakeMsg(m))
+}
+
+// readMsgReply reads an OpMsg written to the client and unmarshals its body.
+func readMsgReply(t *testing.T, b []byte) (*messageHeader, *opMsg, bson.M) {
+	r := bytes.NewReader(b)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.OpCode != OpMsg || int(h.MessageLength) != len(b) {
+		t.Fatalf("did not get expected header, got %s for %d bytes", h, len(b))
+	}
+	msg, err := parseMsg(b[headerLen:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := bson.M{}
+	if err := bson.Unmarshal(msg.body(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return h, msg, doc
+}
+
 type fakeReadWriter struct {
 	io.Reader
 	io.Writer
@@ -115,6 +147,16 @@ func TestResponseRWReadOne(t *testing.T) {
 			),
 			Error: "can only handle 1 result document, got: 2",
 		},
+		{
+			Name: "OpMsg with document sequence",
+			Server: bytes.NewReader(fakeMsg(&opMsg{
+				sections: []MsgSection{
+					{Kind: SectionBody, Documents: [][]byte{mustMarshal(bson.M{})}},
+					{Kind: SectionDocumentSequence, Identifier: "a"},
+				},
+			})),
+			Error: "can only handle 1 section, got: 2",
+		},
 		{
 			Name: "EOF before document",
 			Server: fakeReader(
@@ -199,6 +241,41 @@ func TestResponseRWWriteOne(t *testing.T) {
 	}
 }
 
+type fakeGroupProxyMapper map[string]fakeProxyMapper
+
+func (t fakeGroupProxyMapper) Proxy(h string) (string, error) {
+	return t[""].Proxy(h)
+}
+
+func (t fakeGroupProxyMapper) GroupProxy(group, h string) (string, error) {
+	return t[group].Proxy(h)
+}
+
+func TestIsMasterResponseRewriterGroup(t *testing.T) {
+	t.Parallel()
+	r := &IsMasterResponseRewriter{
+		ProxyMapper: fakeGroupProxyMapper{
+			"":      fakeProxyMapper{m: map[string]string{"a": "1"}},
+			"batch": fakeProxyMapper{m: map[string]string{"a": "2"}},
+		},
+		ReplyRW: &ReplyRW{},
+	}
+	var client bytes.Buffer
+	in := bson.M{"hosts": []interface{}{"a"}, "me": "a"}
+	if err := r.forGroup("batch").Rewrite(&client, fakeSingleDocReply(in)); err != nil {
+		t.Fatal(err)
+	}
+	actualOut := bson.M{}
+	doc := client.Bytes()[headerLen+opReplyPrefixLen:]
+	if err := bson.Unmarshal(doc, &actualOut); err != nil {
+		t.Fatal(err)
+	}
+	out := bson.M{"hosts": []interface{}{"2"}, "me": "2"}
+	if !reflect.DeepEqual(out, actualOut) {
+		t.Fatalf("did not get expected output, got %v", actualOut)
+	}
+}
+
 func TestIsMasterResponseRewriterSuccess(t *testing.T) {
 	proxyMapper := fakeProxyMapper{
 		m: map[string]string{
@@ -231,7 +308,7 @@ func TestIsMasterResponseRewriterSuccess(t *testing.T) {
 		t.Fatal(err)
 	}
 	actualOut := bson.M{}
-	doc := client.Bytes()[headerLen+len(emptyPrefix):]
+	doc := client.Bytes()[headerLen+opReplyPrefixLen:]
 	if err := bson.Unmarshal(doc, &actualOut); err != nil {
 		t.Fatal(err)
 	}
@@ -275,7 +352,7 @@ func TestIsMasterResponseRewriterSuccessWithPassives(t *testing.T) {
 		t.Fatal(err)
 	}
 	actualOut := bson.M{}
-	doc := client.Bytes()[headerLen+len(emptyPrefix):]
+	doc := client.Bytes()[headerLen+opReplyPrefixLen:]
 	if err := bson.Unmarshal(doc, &actualOut); err != nil {
 		t.Fatal(err)
 	}
@@ -286,6 +363,419 @@ func TestIsMasterResponseRewriterSuccessWithPassives(t *testing.T) {
 	}
 }
 
+func TestIsMasterResponseRewriterMsg(t *testing.T) {
+	t.Parallel()
+	proxyMapper := fakeProxyMapper{
+		m: map[string]string{
+			"a": "1",
+			"b": "2",
+		},
+	}
+	in := bson.M{
+		"hosts":             []interface{}{"a", "b"},
+		"me":                "a",
+		"primary":           "a",
+		"isWritablePrimary": true,
+	}
+	out := bson.M{
+		"hosts":             []interface{}{"1", "2"},
+		"me":                "1",
+		"primary":           "1",
+		"isWritablePrimary": true,
+	}
+
+	r := &IsMasterResponseRewriter{
+		ProxyMapper: proxyMapper,
+		ReplyRW:     &ReplyRW{},
+	}
+
+	var client bytes.Buffer
+	server := fakeMsgReply(MsgChecksumPresent, in)
+	if err := r.Rewrite(&client, server); err != nil {
+		t.Fatal(err)
+	}
+	h, msg, actualOut := readMsgReply(t, client.Bytes())
+	if msg.flags&MsgChecksumPresent == 0 {
+		t.Fatal("checksum flag was cleared")
+	}
+	if err := verifyMsgChecksum(h, client.Bytes()[headerLen:]); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, actualOut) {
+		spew.Dump(out)
+		spew.Dump(actualOut)
+		t.Fatal("did not get expected output")
+	}
+}
+
+func TestIsMasterResponseRewriterCompression(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		In  []interface{}
+		Out interface{}
+	}{
+		{[]interface{}{"zstd", "lz4", "snappy"}, []interface{}{"zstd", "snappy"}},
+		{[]interface{}{"lz4"}, nil},
+	}
+	r := &IsMasterResponseRewriter{
+		ProxyMapper: fakeProxyMapper{},
+		ReplyRW:     &ReplyRW{},
+	}
+	for _, c := range cases {
+		var client bytes.Buffer
+		if err := r.Rewrite(&client, fakeSingleDocReply(bson.M{"compression": c.In})); err != nil {
+			t.Fatal(err)
+		}
+		actualOut := bson.M{}
+		doc := client.Bytes()[headerLen+opReplyPrefixLen:]
+		if err := bson.Unmarshal(doc, &actualOut); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.Out, actualOut["compression"]) {
+			t.Fatalf("for %v expected %v but got %v", c.In, c.Out, actualOut["compression"])
+		}
+	}
+}
+
+func TestIsMasterResponseRewriterMaxWireVersion(t *testing.T) {
+	t.Parallel()
+	var clamped int
+	r := &IsMasterResponseRewriter{
+		ProxyMapper:    fakeProxyMapper{},
+		ReplyRW:        &ReplyRW{},
+		MaxWireVersion: 13,
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "isMaster.maxWireVersion.clamped" {
+					clamped++
+				}
+			},
+		},
+	}
+	cases := []struct {
+		In      interface{}
+		Out     interface{}
+		Clamped int
+	}{
+		{17, 13, 1},
+		{int64(21), 13, 2},
+		{8, 8, 2},
+		{nil, nil, 2},
+	}
+	for _, c := range cases {
+		in := bson.M{"minWireVersion": 0}
+		if c.In != nil {
+			in["maxWireVersion"] = c.In
+		}
+		var client bytes.Buffer
+		if err := r.Rewrite(&client, fakeSingleDocReply(in)); err != nil {
+			t.Fatal(err)
+		}
+		actualOut := bson.M{}
+		doc := client.Bytes()[headerLen+opReplyPrefixLen:]
+		if err := bson.Unmarshal(doc, &actualOut); err != nil {
+			t.Fatal(err)
+		}
+		if actualOut["maxWireVersion"] != c.Out || actualOut["minWireVersion"] != 0 {
+			t.Fatalf("for %v expected %v but got %v", c.In, c.Out, actualOut)
+		}
+		if clamped != c.Clamped {
+			t.Fatalf("for %v expected %d clamped stats but got %d", c.In, c.Clamped, clamped)
+		}
+	}
+}
+
+func TestIsMasterResponseRewriterMinWireVersion(t *testing.T) {
+	t.Parallel()
+	var unsupported int
+	r := &IsMasterResponseRewriter{
+		ProxyMapper:    fakeProxyMapper{},
+		ReplyRW:        &ReplyRW{},
+		MaxWireVersion: 13,
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "isMaster.minWireVersion.unsupported" {
+					unsupported++
+				}
+			},
+		},
+	}
+	cases := []struct {
+		MinWireVersion int
+		Unsupported    int
+	}{
+		{0, 0},
+		{13, 0},
+		{17, 1},
+	}
+	for _, c := range cases {
+		in := bson.M{"minWireVersion": c.MinWireVersion, "maxWireVersion": 21}
+		var client bytes.Buffer
+		if err := r.Rewrite(&client, fakeSingleDocReply(in)); err != nil {
+			t.Fatal(err)
+		}
+		actualOut := bson.M{}
+		doc := client.Bytes()[headerLen+opReplyPrefixLen:]
+		if err := bson.Unmarshal(doc, &actualOut); err != nil {
+			t.Fatal(err)
+		}
+		if actualOut["minWireVersion"] != c.MinWireVersion || actualOut["maxWireVersion"] != 13 {
+			t.Fatalf("for %d got %v", c.MinWireVersion, actualOut)
+		}
+		if unsupported != c.Unsupported {
+			t.Fatalf("for %d expected %d unsupported stats but got %d", c.MinWireVersion, c.Unsupported, unsupported)
+		}
+	}
+}
+
+func TestIsMasterResponseRewriterLimits(t *testing.T) {
+	t.Parallel()
+	var learning, other ReplicaSet
+	r := &IsMasterResponseRewriter{
+		ProxyMapper: fakeProxyMapper{},
+		ReplyRW:     &ReplyRW{},
+		limits:      &learning.limits,
+	}
+	in := bson.M{"maxMessageSizeBytes": 1000, "maxBsonObjectSize": 500}
+	var client bytes.Buffer
+	if err := r.Rewrite(&client, fakeSingleDocReply(in)); err != nil {
+		t.Fatal(err)
+	}
+	if learning.limits.messageLength() != 1000 || learning.limits.documentSize() != 500+documentSizeSlack {
+		t.Fatalf("did not learn limits, got %d %d", learning.limits.messageLength(), learning.limits.documentSize())
+	}
+	h := &messageHeader{OpCode: OpMsg, MessageLength: 2000}
+	if err := checkHeader(h, &learning.limits); err != errMessageTooLong {
+		t.Fatalf("expected %v but got %v", errMessageTooLong, err)
+	}
+	if err := checkHeader(h, &other.limits); err != nil {
+		t.Fatalf("limits of another replica set were changed: %v", err)
+	}
+}
+
+func TestProxyQueryMsgHello(t *testing.T) {
+	t.Parallel()
+	p := &ProxyQuery{
+		IsMasterResponseRewriter: &IsMasterResponseRewriter{
+			ProxyMapper: fakeProxyMapper{m: map[string]string{"a": "1"}},
+			ReplyRW:     &ReplyRW{},
+		},
+	}
+	request := fakeMsg(&opMsg{
+		sections: []MsgSection{
+			{
+				Kind:      SectionBody,
+				Documents: [][]byte{mustMarshal(bson.D{{Name: "hello", Value: 1}, {Name: "$db", Value: "admin"}})},
+			},
+		},
+	})
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var client, server bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(
+		h,
+		fakeReadWriter{Reader: r, Writer: &client},
+		fakeReadWriter{Reader: fakeMsgReply(0, bson.M{"me": "a"}), Writer: &server},
+		&lastError,
+	)
+	if err := p.Proxy(&message); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(request, server.Bytes()) {
+		t.Fatal("did not forward expected request")
+	}
+	_, _, actualOut := readMsgReply(t, client.Bytes())
+	if actualOut["me"] != "1" {
+		t.Fatalf("did not get expected output, got %v", actualOut)
+	}
+}
+
+func TestProxyQueryMsgReadOnly(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Flags uint32
+		Reply bool
+	}{
+		{0, true},
+		{MsgMoreToCome, false},
+	}
+	for _, c := range cases {
+		request := fakeMsg(&opMsg{
+			flags: c.Flags,
+			sections: []MsgSection{
+				{
+					Kind:      SectionBody,
+					Documents: [][]byte{mustMarshal(bson.D{{Name: "insert", Value: "foo"}, {Name: "$db", Value: "test"}})},
+				},
+				{
+					Kind:       SectionDocumentSequence,
+					Identifier: "documents",
+					Documents:  [][]byte{mustMarshal(bson.M{"_id": 1})},
+				},
+			},
+		})
+		r := bytes.NewReader(request)
+		h, err := readHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var client, server bytes.Buffer
+		var lastError LastError
+		message := NewProxiedMessage(
+			h,
+			fakeReadWriter{Reader: r, Writer: &client},
+			fakeReadWriter{Writer: &server},
+			&lastError,
+		)
+		message.readOnly = true
+		if err := (&ProxyQuery{}).Proxy(&message); err != nil {
+			t.Fatal(err)
+		}
+		if server.Len() != 0 {
+			t.Fatalf("forwarded %d bytes of a write in read only mode", server.Len())
+		}
+		if r.Len() != 0 {
+			t.Fatal("did not read the entire request")
+		}
+		if !c.Reply {
+			if client.Len() != 0 {
+				t.Fatal("replied to an unacknowledged write")
+			}
+			continue
+		}
+		rh, _, out := readMsgReply(t, client.Bytes())
+		if rh.ResponseTo != 7 {
+			t.Fatalf("did not get expected header, got %s", rh)
+		}
+		if out["ok"] != 0 || out["code"] != 66 || out["errmsg"] != "Readonly database" {
+			t.Fatalf("did not get expected error, got %v", out)
+		}
+	}
+}
+
+func TestProxyQueryMsgExhaustHello(t *testing.T) {
+	t.Parallel()
+	p := &ProxyQuery{
+		IsMasterResponseRewriter: &IsMasterResponseRewriter{
+			ProxyMapper: fakeProxyMapper{m: map[string]string{"a": "1"}},
+			ReplyRW:     &ReplyRW{},
+		},
+	}
+	request := fakeMsg(&opMsg{
+		flags: MsgExhaustAllowed | MsgChecksumPresent,
+		sections: []MsgSection{
+			{
+				Kind:      SectionBody,
+				Documents: [][]byte{mustMarshal(bson.D{{Name: "hello", Value: 1}, {Name: "$db", Value: "admin"}})},
+			},
+		},
+	})
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var client, server bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(
+		h,
+		fakeReadWriter{Reader: r, Writer: &client},
+		fakeReadWriter{Reader: fakeMsgReply(0, bson.M{"me": "a"}), Writer: &server},
+		&lastError,
+	)
+	if err := p.Proxy(&message); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rewriter can only handle one reply, so exhaust is not allowed
+	forwarded := server.Bytes()
+	fh, msg, _ := readMsgReply(t, forwarded)
+	if msg.flags != MsgChecksumPresent {
+		t.Fatalf("did not clear exhaust flag, got %x", msg.flags)
+	}
+	if err := verifyMsgChecksum(fh, forwarded[headerLen:]); err != nil {
+		t.Fatal(err)
+	}
+	_, _, actualOut := readMsgReply(t, client.Bytes())
+	if actualOut["me"] != "1" {
+		t.Fatalf("did not get expected output, got %v", actualOut)
+	}
+}
+
+func TestProxyQueryMsgMoreToCome(t *testing.T) {
+	t.Parallel()
+	var p ProxyQuery
+	request := fakeMsg(&opMsg{
+		flags: MsgMoreToCome,
+		sections: []MsgSection{
+			{
+				Kind:      SectionBody,
+				Documents: [][]byte{mustMarshal(bson.D{{Name: "insert", Value: "foo"}, {Name: "$db", Value: "test"}})},
+			},
+		},
+	})
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server does not reply, reading from it would fail
+	var client, server bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(
+		h,
+		fakeReadWriter{Reader: r, Writer: &client},
+		fakeReadWriter{Reader: bytes.NewReader(nil), Writer: &server},
+		&lastError,
+	)
+	if err := p.Proxy(&message); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(request, server.Bytes()) {
+		t.Fatal("did not forward expected request")
+	}
+	if client.Len() != 0 {
+		t.Fatal("unexpected reply to client")
+	}
+}
+
+func TestProxyQueryMsgChecksumMismatch(t *testing.T) {
+	t.Parallel()
+	var p ProxyQuery
+	request := fakeMsg(&opMsg{
+		flags: MsgChecksumPresent,
+		sections: []MsgSection{
+			{
+				Kind:      SectionBody,
+				Documents: [][]byte{mustMarshal(bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}})},
+			},
+		},
+	})
+	request[len(request)-2] ^= 1
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server bytes.Buffer
+	var lastError LastError
+	message := NewProxiedMessage(h, fakeReadWriter{Reader: r}, fakeReadWriter{Writer: &server}, &lastError)
+	if err := p.Proxy(&message); err != errMsgChecksum {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+	if server.Len() != 0 {
+		t.Fatal("corrupt request was forwarded")
+	}
+}
+
 func TestReplSetGetStatusResponseRewriterSuccess(t *testing.T) {
 	proxyMapper := fakeProxyMapper{
 		m: map[string]string{
@@ -334,7 +824,7 @@ func TestReplSetGetStatusResponseRewriterSuccess(t *testing.T) {
 		t.Fatal(err)
 	}
 	actualOut := bson.M{}
-	doc := client.Bytes()[headerLen+len(emptyPrefix):]
+	doc := client.Bytes()[headerLen+opReplyPrefixLen:]
 	if err := bson.Unmarshal(doc, &actualOut); err != nil {
 		t.Fatal(err)
 	}
@@ -2,10 +2,12 @@
 package dvara
 
 import (
-	"container/list"
+	"context"
 	"errors"
 	"io"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/facebookgo/clock"
@@ -13,11 +15,15 @@ import (
 )
 
 var (
-	errPoolClosed  = errors.New("rpool: pool has been closed")
-	errCloseAgain  = errors.New("rpool: Pool.Close called more than once")
-	errWrongPool   = errors.New("rpool: provided resource was not acquired from this pool")
-	closedSentinel = sentinelCloser(1)
-	newSentinel    = sentinelCloser(2)
+	errPoolClosed     = errors.New("rpool: pool has been closed")
+	errPoolExhausted  = errors.New("rpool: too many waiting for a resource")
+	errPoolShed       = errors.New("rpool: shed waiting for a resource")
+	errCloseAgain     = errors.New("rpool: Pool.Close called more than once")
+	errWrongPool      = errors.New("rpool: provided resource was not acquired from this pool")
+	closedSentinel    = sentinelCloser(1)
+	newSentinel       = sentinelCloser(2)
+	exhaustedSentinel = sentinelCloser(3)
+	shedSentinel      = sentinelCloser(4)
 )
 
 // Pool manages the life cycle of resources.
@@ -35,6 +41,33 @@ type Pool struct {
 	// Max defines the maximum number of concurrently allocated resources.
 	Max uint
 
+	// MaxConcurrentNew defines the maximum number of resources being made at
+	// once. Further acquires wait for one to be made or released. Zero means no
+	// limit.
+	MaxConcurrentNew uint
+
+	// Reserved defines, for each priority class, the share of the limit lower
+	// classes can't acquire, between 0 and 1. It follows the limit as it is
+	// set. Class zero is the highest, acquires without a priority are in the
+	// class after the last one listed.
+	Reserved []float64
+
+	// ShedAfter defines how long acquires may wait before they are failed. Only
+	// those of the lowest class with any waiting that long are failed at once,
+	// those of the next class up are failed after another ShedAfter, but never
+	// those of the highest class. Zero means they are never shed.
+	ShedAfter time.Duration
+
+	// MaxWaiting defines the maximum number of acquires waiting for a resource
+	// once Max resources are in use. Further acquires fail right away. Zero
+	// means no limit.
+	MaxWaiting uint
+
+	// Weights defines the share of resources each client gets while acquires
+	// are waiting, relative to the other waiting clients. Clients are named with
+	// WithPoolClient, unnamed clients and those not listed have a weight of 1.
+	Weights map[string]uint
+
 	// MinIdle defines the number of minimum idle resources. These number of
 	// resources are kept around when the idle cleanup kicks in.
 	MinIdle uint
@@ -43,6 +76,34 @@ type Pool struct {
 	// be closed.
 	IdleTimeout time.Duration
 
+	// WarmInterval defines how often a resource is made in the background while
+	// there are fewer than MinIdle idle resources. Only one is made at a time,
+	// so a recovering resource isn't flooded. Zero means resources are only made
+	// when acquired.
+	WarmInterval time.Duration
+
+	// Validate is optional and is used to check an idle resource before it is
+	// handed out. If it fails the resource is discarded and another one is
+	// acquired in its place.
+	Validate func(io.Closer) error
+
+	// ValidateIdle defines the idle time after which a resource is validated
+	// before it is handed out.
+	ValidateIdle time.Duration
+
+	// MaxLifetime defines the duration after which a resource is closed when
+	// it is released, instead of being reused. Zero means no limit.
+	MaxLifetime time.Duration
+
+	// MaxLifetimeJitter defines the most the lifetime of a resource is randomly
+	// shortened by, so resources created together don't all expire together.
+	MaxLifetimeJitter time.Duration
+
+	// MaxUses defines the number of times a resource is acquired after which it
+	// is closed when it is released, instead of being reused. Zero means no
+	// limit.
+	MaxUses uint
+
 	// ClosePoolSize defines the number of concurrent goroutines that will close
 	// resources.
 	ClosePoolSize uint
@@ -51,35 +112,98 @@ type Pool struct {
 	// in production code.
 	Clock clock.Clock
 
+	generation uint64
+	managed    int32
 	manageOnce sync.Once
-	acquire    chan chan io.Closer
-	new        chan io.Closer
+	acquire    chan waiter
+	new        chan entry
 	release    chan returnResource
 	discard    chan returnResource
+	cancel     chan chan io.Closer
+	warm       chan io.Closer
+	limit      chan uint
+	snapshot   chan chan PoolSnapshot
 	close      chan chan error
+	done       chan struct{}
 }
 
 // Acquire will pull a resource from the pool or create a new one if necessary.
 func (p *Pool) Acquire() (io.Closer, error) {
+	return p.AcquireContext(context.Background())
+}
+
+// AcquireContext will pull a resource from the pool or create a new one if
+// necessary. If it has to wait for a resource it gives up when the context is
+// done and returns its error.
+func (p *Pool) AcquireContext(ctx context.Context) (io.Closer, error) {
 	p.manageOnce.Do(p.goManage)
-	r := make(chan io.Closer)
-	p.acquire <- r
-	c := <-r
+
+	// buffered so the manager never blocks handing us a resource we may no
+	// longer be waiting for
+	r := make(chan io.Closer, 1)
+	p.acquire <- waiter{
+		resource: r,
+		client:   poolClient(ctx),
+		owner:    poolOwner(ctx),
+		class:    p.priority(ctx),
+	}
+	var c io.Closer
+	select {
+	case c = <-r:
+	case <-ctx.Done():
+		select {
+		case c = <-r:
+			// handed one just in time
+		case p.cancel <- r:
+			// the manager no longer counts us as waiting, but may have handed us a
+			// resource before it got the cancel
+			select {
+			case c = <-r:
+				p.giveBack(c)
+			default:
+			}
+			stats.BumpSum(p.Stats, "acquire.error.timeout", 1)
+			return nil, ctx.Err()
+		}
+	}
 
 	// sentinel value indicates the pool is closed
 	if c == closedSentinel {
 		return nil, errPoolClosed
 	}
 
+	// sentinel value indicates too many are waiting already
+	if c == exhaustedSentinel {
+		return nil, errPoolExhausted
+	}
+
+	// sentinel value indicates we waited too long while the pool is overloaded
+	if c == shedSentinel {
+		return nil, errPoolShed
+	}
+
+	// an idle resource is validated first, if it fails we try again
+	if s, ok := c.(staleResource); ok {
+		stats.BumpSum(p.Stats, "acquire.validate", 1)
+		if err := p.Validate(s.Closer); err != nil {
+			stats.BumpSum(p.Stats, "acquire.validate.error", 1)
+			p.Discard(s.Closer)
+			return p.AcquireContext(ctx)
+		}
+		return s.Closer, nil
+	}
+
 	// need to allocate a new resource
 	if c == newSentinel {
+		t := stats.BumpTime(p.Stats, "new.time")
 		c, err := p.New()
+		t.End()
 		if err != nil {
 			stats.BumpSum(p.Stats, "acquire.error.new", 1)
 			// discard our assumed checked out resource since we failed to New
 			p.discard <- returnResource{resource: newSentinel}
 		} else {
-			p.new <- c
+			p.new <- entry{resource: c, owner: poolOwner(ctx)}
 		}
 		return c, err
 	}
@@ -88,6 +212,27 @@ func (p *Pool) Acquire() (io.Closer, error) {
 	return c, nil
 }
 
+// giveBack returns what was handed to an acquire that gave up.
+func (p *Pool) giveBack(c io.Closer) {
+	if s, ok := c.(staleResource); ok {
+		c = s.Closer
+	}
+	switch c {
+	case closedSentinel, exhaustedSentinel, shedSentinel:
+	case newSentinel:
+		// we were assumed to make a new resource
+		p.discard <- returnResource{resource: newSentinel}
+	default:
+		p.Release(c)
+	}
+}
+
+// WarmUp starts making resources in the background, instead of waiting for
+// the first Acquire to do so. It does nothing unless WarmInterval is set.
+func (p *Pool) WarmUp() {
+	p.manageOnce.Do(p.goManage)
+}
+
 // Release puts the resource back into the pool. It will panic if you try to
 // release a resource that wasn't acquired from this pool.
 func (p *Pool) Release(c io.Closer) {
@@ -116,6 +261,26 @@ func (p *Pool) Discard(c io.Closer) {
 	}
 }
 
+// Invalidate starts a new generation of resources. Resources from an older
+// generation are closed when they are released, and idle ones are closed
+// instead of being handed out. It is safe to call at any time, even on a
+// closed pool.
+func (p *Pool) Invalidate() {
+	atomic.AddUint64(&p.generation, 1)
+	stats.BumpSum(p.Stats, "invalidate", 1)
+}
+
+// SetLimit lowers the number of resources that may be acquired at once below
+// Max. Further acquires wait, and acquired resources over the limit are kept
+// idle when they are released. Zero, or more than Max, means Max.
+func (p *Pool) SetLimit(limit uint) {
+	p.manageOnce.Do(p.goManage)
+	select {
+	case p.limit <- limit:
+	case <-p.done:
+	}
+}
+
 // Close closes the pool and its resources. It waits until all acquired
 // resources are released or discarded. It is an error to call Acquire after
 // closing the pool.
@@ -139,17 +304,58 @@ func (p *Pool) goManage() {
 		panic("no close pool size configured")
 	}
 
-	p.acquire = make(chan chan io.Closer)
-	p.new = make(chan io.Closer)
+	p.acquire = make(chan waiter)
+	p.new = make(chan entry)
 	p.release = make(chan returnResource)
 	p.discard = make(chan returnResource)
+	p.cancel = make(chan chan io.Closer)
+	p.warm = make(chan io.Closer)
+	p.limit = make(chan uint)
+	p.snapshot = make(chan chan PoolSnapshot)
 	p.close = make(chan chan error)
+	p.done = make(chan struct{})
+	atomic.StoreInt32(&p.managed, 1)
 	go p.manage()
 }
 
 type entry struct {
-	resource io.Closer
-	use      time.Time
+	resource   io.Closer
+	use        time.Time
+	expires    time.Time
+	uses       uint
+	generation uint64
+	owner      string
+	acquired   time.Time
+}
+
+// expiry returns when a resource created now expires, or the zero time if
+// resources don't expire.
+func (p *Pool) expiry(now time.Time) time.Time {
+	if p.MaxLifetime == 0 {
+		return time.Time{}
+	}
+	lifetime := p.MaxLifetime
+	if p.MaxLifetimeJitter > 0 {
+		lifetime -= time.Duration(rand.Int63n(int64(p.MaxLifetimeJitter)))
+	}
+	return now.Add(lifetime)
+}
+
+// expired tells us if a resource being released must not be reused.
+func (p *Pool) expired(e entry, now time.Time) bool {
+	if e.generation != atomic.LoadUint64(&p.generation) {
+		stats.BumpSum(p.Stats, "discard.generation", 1)
+		return true
+	}
+	if !e.expires.IsZero() && !now.Before(e.expires) {
+		stats.BumpSum(p.Stats, "release.expired.lifetime", 1)
+		return true
+	}
+	if p.MaxUses != 0 && e.uses >= p.MaxUses {
+		stats.BumpSum(p.Stats, "release.expired.uses", 1)
+		return true
+	}
+	return false
 }
 
 func (p *Pool) manage() {
@@ -185,17 +391,187 @@ func (p *Pool) manage() {
 	}
 
 	resources := []entry{}
-	outResources := map[io.Closer]struct{}{}
+	outResources := map[io.Closer]entry{}
 	out := uint(0)
-	waiting := list.New()
+	limit := p.Max
+	waiting := newPriorityQueue(len(p.Reserved)+1, p.Weights)
 	idleTicker := klock.Ticker(p.IdleTimeout)
 	closed := false
+	generation := atomic.LoadUint64(&p.generation)
 	var closeResponse chan error
+
+	// idle resources from an older generation are closed
+	sweep := func() {
+		g := atomic.LoadUint64(&p.generation)
+		if g == generation {
+			return
+		}
+		generation = g
+		current := resources[:0]
+		for _, e := range resources {
+			if e.generation == g {
+				current = append(current, e)
+				continue
+			}
+			closers <- e.resource
+			stats.BumpSum(p.Stats, "discard.generation", 1)
+		}
+		resources = current
+	}
+
+	// setup a ticker to make resources in the background. if we don't have a
+	// WarmInterval, we Stop it so it never ticks.
+	warmInterval := p.WarmInterval
+	if warmInterval == 0 {
+		warmInterval = time.Minute
+	}
+	warmTicker := klock.Ticker(warmInterval)
+	if p.WarmInterval == 0 {
+		warmTicker.Stop()
+	}
+
+	// count the resources being made, so no more than MaxConcurrentNew are
+	// made at once
+	making := uint(0)
+	canMake := func() bool {
+		return p.MaxConcurrentNew == 0 || making < p.MaxConcurrentNew
+	}
+	startMaking := func() {
+		making++
+		stats.BumpHistogram(p.Stats, "new.concurrent", float64(making))
+	}
+
+	// hand out the last idle resource, validating it first if it was idle for
+	// too long
+	handIdle := func(w waiter) {
+		cl := len(resources)
+		c := resources[cl-1]
+		c.uses++
+		c.owner = w.owner
+		c.acquired = klock.Now()
+		outResources[c.resource] = c
+		if p.Validate != nil && klock.Now().Sub(c.use) >= p.ValidateIdle {
+			w.resource <- staleResource{c.resource}
+		} else {
+			w.resource <- c.resource
+		}
+		resources = resources[:cl-1]
+		out++
+		stats.BumpSum(p.Stats, "acquire.pool", 1)
+	}
+
+	// the limit of a priority class leaves out the resources reserved for
+	// higher classes
+	classLimit := func(class int) uint {
+		l := limit
+		for _, share := range p.Reserved[:class] {
+			r := uint(share * float64(limit))
+			if r >= l {
+				return 0
+			}
+			l -= r
+		}
+		return l
+	}
+
+	// a class can be handed one more resource, or one being released
+	handOut := func(class int) bool {
+		return out < classLimit(class)
+	}
+	handOver := func(class int) bool {
+		return out <= classLimit(class)
+	}
+
+	// someone who's waiting gets an idle resource, or can make a new one, if
+	// we're under their limit and MaxConcurrentNew. we assume a new one is
+	// checked out. Acquire will discard if creating a new resource fails.
+	serveWaiting := func() {
+		sweep()
+		for {
+			if len(resources) == 0 && !canMake() {
+				return
+			}
+			w, ok := waiting.Pop(handOut)
+			if !ok {
+				return
+			}
+			w.queued.End()
+			if len(resources) > 0 {
+				handIdle(w)
+				continue
+			}
+			out++
+			startMaking()
+			w.resource <- newSentinel
+		}
+	}
+
+	// once acquires waited too long, those of the lowest class that has any are
+	// failed, those of higher classes wait for the next tick, and those of the
+	// highest class are never failed
+	shedInterval := p.ShedAfter
+	if shedInterval == 0 {
+		shedInterval = time.Minute
+	}
+	shedTicker := klock.Ticker(shedInterval)
+	if p.ShedAfter == 0 {
+		shedTicker.Stop()
+	}
+	stale := func(now time.Time) func(waiter) bool {
+		return func(w waiter) bool {
+			return now.Sub(w.since) > p.ShedAfter
+		}
+	}
+	shed := func(now time.Time) {
+		for class := len(p.Reserved); class > 0; class-- {
+			shed := waiting.Shed(class, stale(now))
+			for _, w := range shed {
+				w.queued.End()
+				w.resource <- shedSentinel
+				stats.BumpSum(p.Stats, "acquire.error.shed", 1)
+			}
+			if len(shed) > 0 {
+				return
+			}
+		}
+	}
+
+	// make one resource in the background if we're short of idle ones. it is
+	// counted as out until it is made, so we never go past Max.
+	warming := false
+	warm := func() {
+		sweep()
+		if closed || warming || !canMake() || uint(len(resources)) >= p.MinIdle || uint(len(resources))+out >= p.Max {
+			return
+		}
+		warming = true
+		out++
+		startMaking()
+		go func() {
+			t := stats.BumpTime(p.Stats, "new.time")
+			c, err := p.New()
+			t.End()
+			if err != nil {
+				c = nil
+			}
+			p.warm <- c
+		}()
+	}
+	if p.WarmInterval != 0 {
+		warm()
+	}
+
 	for {
 		if closed && out == 0 && waiting.Len() == 0 {
 			if p.Stats != nil {
 				statsTicker.Stop()
 			}
+			if p.WarmInterval != 0 {
+				warmTicker.Stop()
+			}
+			if p.ShedAfter != 0 {
+				shedTicker.Stop()
+			}
 
 			// all waiting acquires are done, all resources have been released.
 			// now just wait for all resources to close.
@@ -208,6 +584,7 @@ func (p *Pool) manage() {
 			close(p.release)
 			close(p.discard)
 			close(p.close)
+			close(p.done)
 
 			// return a response to the original close.
 			closeResponse <- nil
@@ -216,7 +593,8 @@ func (p *Pool) manage() {
 		}
 
 		select {
-		case r := <-p.acquire:
+		case w := <-p.acquire:
+			r := w.resource
 			// if closed, new acquire calls are rejected
 			if closed {
 				r <- closedSentinel
@@ -224,20 +602,25 @@ func (p *Pool) manage() {
 				continue
 			}
 
+			sweep()
+
 			// acquire from pool
-			if cl := len(resources); cl > 0 {
-				c := resources[cl-1]
-				outResources[c.resource] = struct{}{}
-				r <- c.resource
-				resources = resources[:cl-1]
-				out++
-				stats.BumpSum(p.Stats, "acquire.pool", 1)
+			if len(resources) > 0 && handOut(w.class) {
+				handIdle(w)
 				continue
 			}
 
-			// max resources already in use, need to block & wait
-			if out == p.Max {
-				waiting.PushBack(r)
+			// max resources already in use, or being made, need to block & wait
+			// unless too many are waiting already
+			if !handOut(w.class) || !canMake() {
+				if p.MaxWaiting != 0 && uint(waiting.Len()) >= p.MaxWaiting {
+					r <- exhaustedSentinel
+					stats.BumpSum(p.Stats, "acquire.error.exhausted", 1)
+					continue
+				}
+				w.queued = stats.BumpTime(p.Stats, "acquire.wait.time")
+				w.since = klock.Now()
+				waiting.Push(w)
 				stats.BumpSum(p.Stats, "acquire.waiting", 1)
 				continue
 			}
@@ -246,21 +629,44 @@ func (p *Pool) manage() {
 			// newSentinel. We assume it's checked out. Acquire will discard if
 			// creating a new resource fails.
 			out++
+			startMaking()
 			r <- newSentinel
 		case c := <-p.new:
-			outResources[c] = struct{}{}
+			making--
+			serveWaiting()
+			now := klock.Now()
+			c.expires = p.expiry(now)
+			c.uses = 1
+			c.generation = atomic.LoadUint64(&p.generation)
+			c.acquired = now
+			outResources[c.resource] = c
 		case rr := <-p.release:
 			// ensure we're dealing with a resource acquired thru us
-			if _, found := outResources[rr.resource]; !found {
+			c, found := outResources[rr.resource]
+			if !found {
 				rr.response <- errWrongPool
 				return
 			}
 			close(rr.response)
 
-			// pass it to someone who's waiting
-			if e := waiting.Front(); e != nil {
-				r := waiting.Remove(e).(chan io.Closer)
-				r <- rr.resource
+			// an expired resource is closed, someone who's waiting can make a new
+			// one in its place
+			if p.expired(c, klock.Now()) {
+				delete(outResources, rr.resource)
+				closers <- rr.resource
+				out--
+				serveWaiting()
+				continue
+			}
+
+			// pass it to someone who's waiting, unless we're over their limit
+			if w, ok := waiting.Pop(handOver); ok {
+				w.queued.End()
+				c.uses++
+				c.owner = w.owner
+				c.acquired = klock.Now()
+				outResources[rr.resource] = c
+				w.resource <- rr.resource
 				continue
 			}
 
@@ -275,10 +681,13 @@ func (p *Pool) manage() {
 			}
 
 			// put it back in our pool
-			resources = append(resources, entry{resource: rr.resource, use: klock.Now()})
+			c.use = klock.Now()
+			resources = append(resources, c)
 		case rr := <-p.discard:
 			// ensure we're dealing with a resource acquired thru us
-			if rr.resource != newSentinel { // this happens when new fails
+			if rr.resource == newSentinel { // this happens when new fails
+				making--
+			} else {
 				if _, found := outResources[rr.resource]; !found {
 					rr.response <- errWrongPool
 					return
@@ -288,17 +697,90 @@ func (p *Pool) manage() {
 				closers <- rr.resource
 			}
 
-			// we can make a new one if someone is waiting. no need to decrement out
-			// in this case since we assume this new one is checked out. Acquire will
-			// discard if creating a new resource fails.
-			if e := waiting.Front(); e != nil {
-				r := waiting.Remove(e).(chan io.Closer)
-				r <- newSentinel
+			// we lost a resource, someone who's waiting can make a new one
+			out--
+			serveWaiting()
+		case c := <-p.warm:
+			warming = false
+			making--
+
+			// failed to make one, someone who's waiting can try in its place
+			if c == nil {
+				stats.BumpSum(p.Stats, "warm.error", 1)
+				out--
+				serveWaiting()
+				continue
+			}
+			stats.BumpSum(p.Stats, "warm", 1)
+			now := klock.Now()
+			made := entry{
+				resource:   c,
+				use:        now,
+				expires:    p.expiry(now),
+				generation: atomic.LoadUint64(&p.generation),
+			}
+
+			// pass it to someone who's waiting, unless we're over their limit
+			if w, ok := waiting.Pop(handOver); ok {
+				w.queued.End()
+				made.uses = 1
+				made.owner = w.owner
+				made.acquired = now
+				outResources[c] = made
+				w.resource <- c
+				serveWaiting()
 				continue
 			}
 
-			// otherwise we lost a resource and dont need a new one right away
 			out--
+			if closed {
+				closers <- c
+				continue
+			}
+			resources = append(resources, made)
+		case <-warmTicker.C:
+			warm()
+		case now := <-shedTicker.C:
+			shed(now)
+		case l := <-p.limit:
+			if l == 0 || l > p.Max {
+				l = p.Max
+			}
+			limit = l
+			serveWaiting()
+		case r := <-p.snapshot:
+			now := klock.Now()
+			s := PoolSnapshot{
+				Max:     p.Max,
+				Limit:   limit,
+				Idle:    len(resources),
+				Out:     out,
+				Making:  making,
+				Waiting: waiting.Len(),
+				Closed:  closed,
+			}
+			for _, e := range resources {
+				if idle := now.Sub(e.use); idle > s.OldestIdle {
+					s.OldestIdle = idle
+				}
+			}
+			for _, e := range outResources {
+				s.Acquired = append(s.Acquired, AcquiredSnapshot{
+					Client: e.owner,
+					Held:   now.Sub(e.acquired),
+					Uses:   e.uses,
+				})
+			}
+			waiting.Each(func(w waiter) {
+				s.Waiters = append(s.Waiters, WaiterSnapshot{
+					Client: w.owner,
+					Waited: now.Sub(w.since),
+				})
+			})
+			r <- s
+		case r := <-p.cancel:
+			// the acquire gave up, if it is still waiting it is forgotten
+			waiting.Remove(r)
 		case now := <-idleTicker.C:
 			eligibleOffset := len(resources) - int(p.MinIdle)
 
@@ -329,6 +811,8 @@ func (p *Pool) manage() {
 			p.Stats.BumpAvg("idle", float64(len(resources)))
 			p.Stats.BumpAvg("out", float64(out))
 			p.Stats.BumpAvg("alive", float64(uint(len(resources))+out))
+			p.Stats.BumpAvg("making", float64(making))
+			p.Stats.BumpAvg("limit", float64(limit))
 		case r := <-p.close:
 			// cant call close if already closing
 			if closed {
@@ -339,16 +823,23 @@ func (p *Pool) manage() {
 			closed = true
 			idleTicker.Stop() // stop idle processing
 
-			// close idle since if we have idle, implicitly no one is waiting
+			// close idle, anyone still waiting gets a released one
 			for _, e := range resources {
 				closers <- e.resource
 			}
+			resources = nil
 
 			closeResponse = r
 		}
 	}
 }
 
+// staleResource is handed to an acquire for a resource that has to be
+// validated first.
+type staleResource struct {
+	io.Closer
+}
+
 type returnResource struct {
 	resource io.Closer
 	response chan error
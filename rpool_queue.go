@@ -0,0 +1,247 @@
+package dvara
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"time"
+)
+
+type poolClientKey struct{}
+
+type poolPriorityKey struct{}
+
+type poolOwnerKey struct{}
+
+// WithPoolClient names the client acquiring a resource, so waiting acquires
+// are queued fairly between clients.
+func WithPoolClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, poolClientKey{}, client)
+}
+
+func poolClient(ctx context.Context) string {
+	client, _ := ctx.Value(poolClientKey{}).(string)
+	return client
+}
+
+// WithPoolOwner names who acquires a resource in snapshots of the pool, apart
+// from the client it is queued by. Without one it is named by its client.
+func WithPoolOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, poolOwnerKey{}, owner)
+}
+
+func poolOwner(ctx context.Context) string {
+	if owner, ok := ctx.Value(poolOwnerKey{}).(string); ok {
+		return owner
+	}
+	return poolClient(ctx)
+}
+
+// WithPoolPriority sets the priority class of the acquire, zero being the
+// highest. Acquires without one are in the class after the last one the pool
+// reserves resources for.
+func WithPoolPriority(ctx context.Context, class int) context.Context {
+	return context.WithValue(ctx, poolPriorityKey{}, class)
+}
+
+// priority returns the priority class of an acquire.
+func (p *Pool) priority(ctx context.Context) int {
+	class, ok := ctx.Value(poolPriorityKey{}).(int)
+	if !ok || class < 0 || class > len(p.Reserved) {
+		return len(p.Reserved)
+	}
+	return class
+}
+
+type waiter struct {
+	resource chan io.Closer
+	client   string
+	owner    string
+	class    int
+	since    time.Time
+	queued   interface {
+		End()
+	}
+}
+
+type queuedWaiter struct {
+	waiter
+	tag float64
+	seq uint64
+}
+
+// waitQueue holds the acquires waiting for a resource. The waiters of a client
+// are served in order, and clients are served in proportion to their weight,
+// so a client with many waiters can't starve the others. Each waiter is tagged
+// with the virtual time it is due at, which advances by the inverse of the
+// weight of its client, and the waiter with the earliest tag is served first.
+// With a single client it is a plain FIFO.
+type waitQueue struct {
+	weights map[string]uint
+	clients map[string]*list.List
+	vtime   float64
+	seq     uint64
+	len     int
+}
+
+func newWaitQueue(weights map[string]uint) *waitQueue {
+	return &waitQueue{
+		weights: weights,
+		clients: make(map[string]*list.List),
+	}
+}
+
+func (q *waitQueue) weight(client string) float64 {
+	if w := q.weights[client]; w > 0 {
+		return float64(w)
+	}
+	return 1
+}
+
+// Len returns the number of waiters.
+func (q *waitQueue) Len() int {
+	return q.len
+}
+
+// Push queues a waiter behind the other waiters of its client.
+func (q *waitQueue) Push(w waiter) {
+	l := q.clients[w.client]
+	if l == nil {
+		l = list.New()
+		q.clients[w.client] = l
+	}
+	start := q.vtime
+	if b := l.Back(); b != nil {
+		if tag := b.Value.(*queuedWaiter).tag; tag > start {
+			start = tag
+		}
+	}
+	q.seq++
+	l.PushBack(&queuedWaiter{
+		waiter: w,
+		tag:    start + 1/q.weight(w.client),
+		seq:    q.seq,
+	})
+	q.len++
+}
+
+// Pop removes and returns the waiter to serve next.
+func (q *waitQueue) Pop() (waiter, bool) {
+	var next *queuedWaiter
+	for _, l := range q.clients {
+		qw := l.Front().Value.(*queuedWaiter)
+		if next == nil || qw.tag < next.tag || (qw.tag == next.tag && qw.seq < next.seq) {
+			next = qw
+		}
+	}
+	if next == nil {
+		return waiter{}, false
+	}
+	q.remove(next.client, q.clients[next.client].Front())
+	q.vtime = next.tag
+	if q.len == 0 {
+		q.vtime = 0
+	}
+	return next.waiter, true
+}
+
+// Each calls f for every waiter, in no particular order.
+func (q *waitQueue) Each(f func(waiter)) {
+	for _, l := range q.clients {
+		for e := l.Front(); e != nil; e = e.Next() {
+			f(e.Value.(*queuedWaiter).waiter)
+		}
+	}
+}
+
+// Remove forgets the waiter for the given resource channel, and tells us if it
+// was queued.
+func (q *waitQueue) Remove(r chan io.Closer) bool {
+	for client, l := range q.clients {
+		for e := l.Front(); e != nil; e = e.Next() {
+			if e.Value.(*queuedWaiter).resource == r {
+				q.remove(client, e)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (q *waitQueue) remove(client string, e *list.Element) {
+	l := q.clients[client]
+	l.Remove(e)
+	if l.Len() == 0 {
+		delete(q.clients, client)
+	}
+	q.len--
+}
+
+// priorityQueue holds a waitQueue for every priority class, the waiters of a
+// higher class are served before those of a lower one.
+type priorityQueue struct {
+	classes []*waitQueue
+}
+
+func newPriorityQueue(classes int, weights map[string]uint) *priorityQueue {
+	q := &priorityQueue{classes: make([]*waitQueue, classes)}
+	for i := range q.classes {
+		q.classes[i] = newWaitQueue(weights)
+	}
+	return q
+}
+
+// Len returns the number of waiters.
+func (q *priorityQueue) Len() int {
+	n := 0
+	for _, c := range q.classes {
+		n += c.Len()
+	}
+	return n
+}
+
+// Push queues a waiter in its class.
+func (q *priorityQueue) Push(w waiter) {
+	q.classes[w.class].Push(w)
+}
+
+// Pop removes and returns the waiter to serve next, from the highest class
+// that is allowed to be served.
+func (q *priorityQueue) Pop(allowed func(class int) bool) (waiter, bool) {
+	for class, c := range q.classes {
+		if c.Len() > 0 && allowed(class) {
+			return c.Pop()
+		}
+	}
+	return waiter{}, false
+}
+
+// Shed removes and returns the waiters of a class that are stale.
+func (q *priorityQueue) Shed(class int, stale func(waiter) bool) []waiter {
+	var shed []waiter
+	q.classes[class].Each(func(w waiter) {
+		if stale(w) {
+			shed = append(shed, w)
+		}
+	})
+	for _, w := range shed {
+		q.classes[class].Remove(w.resource)
+	}
+	return shed
+}
+
+// Each calls f for every waiter, in no particular order.
+func (q *priorityQueue) Each(f func(waiter)) {
+	for _, c := range q.classes {
+		c.Each(f)
+	}
+}
+
+// Remove forgets the waiter for the given resource channel, if it is queued.
+func (q *priorityQueue) Remove(r chan io.Closer) {
+	for _, c := range q.classes {
+		if c.Remove(r) {
+			return
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package dvara
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func popClients(q *waitQueue) []string {
+	var clients []string
+	for {
+		w, ok := q.Pop()
+		if !ok {
+			return clients
+		}
+		clients = append(clients, w.client)
+	}
+}
+
+func TestWaitQueueFIFO(t *testing.T) {
+	t.Parallel()
+	q := newWaitQueue(nil)
+	var rs []chan io.Closer
+	for i := 0; i < 3; i++ {
+		r := make(chan io.Closer)
+		rs = append(rs, r)
+		q.Push(waiter{resource: r})
+	}
+	ensure.DeepEqual(t, q.Len(), 3)
+	for _, r := range rs {
+		w, ok := q.Pop()
+		ensure.True(t, ok)
+		ensure.True(t, w.resource == r)
+	}
+	_, ok := q.Pop()
+	ensure.False(t, ok)
+}
+
+func TestWaitQueueFair(t *testing.T) {
+	t.Parallel()
+	q := newWaitQueue(nil)
+
+	// a noisy client queues up first, the quiet one still gets every other turn
+	for i := 0; i < 4; i++ {
+		q.Push(waiter{client: "batch"})
+	}
+	q.Push(waiter{client: "web"})
+	q.Push(waiter{client: "web"})
+	ensure.DeepEqual(t, popClients(q), []string{"batch", "web", "batch", "web", "batch", "batch"})
+}
+
+func TestWaitQueueWeights(t *testing.T) {
+	t.Parallel()
+	q := newWaitQueue(map[string]uint{"web": 2})
+	for i := 0; i < 4; i++ {
+		q.Push(waiter{client: "batch"})
+		q.Push(waiter{client: "web"})
+	}
+	ensure.DeepEqual(t, popClients(q), []string{"web", "batch", "web", "web", "batch", "web", "batch", "batch"})
+}
+
+func TestWaitQueueRemove(t *testing.T) {
+	t.Parallel()
+	q := newWaitQueue(nil)
+	r := make(chan io.Closer)
+	q.Push(waiter{client: "a", resource: r})
+	q.Push(waiter{client: "b"})
+	q.Remove(r)
+	q.Remove(make(chan io.Closer))
+	ensure.DeepEqual(t, q.Len(), 1)
+	ensure.DeepEqual(t, popClients(q), []string{"b"})
+}
+
+func TestPoolClient(t *testing.T) {
+	t.Parallel()
+	ensure.DeepEqual(t, poolClient(context.Background()), "")
+	ensure.DeepEqual(t, poolClient(WithPoolClient(context.Background(), "a")), "a")
+}
+
+func TestPoolOwner(t *testing.T) {
+	t.Parallel()
+	ensure.DeepEqual(t, poolOwner(context.Background()), "")
+	ensure.DeepEqual(t, poolOwner(WithPoolClient(context.Background(), "a")), "a")
+	ctx := WithPoolOwner(WithPoolClient(context.Background(), ""), "10.0.0.1:5000")
+	ensure.DeepEqual(t, poolClient(ctx), "")
+	ensure.DeepEqual(t, poolOwner(ctx), "10.0.0.1:5000")
+}
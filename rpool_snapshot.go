@@ -0,0 +1,77 @@
+package dvara
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PoolSnapshot is the state of a pool at a point in time.
+type PoolSnapshot struct {
+	// Max is the maximum number of resources of the pool.
+	Max uint
+
+	// Limit is the number of resources that may be acquired at once.
+	Limit uint
+
+	// Idle is the number of idle resources.
+	Idle int
+
+	// Out is the number of resources acquired, including those being made.
+	Out uint
+
+	// Making is the number of resources being made.
+	Making uint
+
+	// Waiting is the number of acquires waiting for a resource.
+	Waiting int
+
+	// OldestIdle is how long the resource idle the longest has been idle.
+	OldestIdle time.Duration
+
+	// Acquired describes the acquired resources, in no particular order.
+	Acquired []AcquiredSnapshot
+
+	// Waiters describes the waiting acquires, in no particular order.
+	Waiters []WaiterSnapshot
+
+	// Closed tells us if the pool was closed.
+	Closed bool
+}
+
+// AcquiredSnapshot describes an acquired resource.
+type AcquiredSnapshot struct {
+	// Client is the client that acquired the resource, if it was named with
+	// WithPoolOwner or WithPoolClient.
+	Client string
+
+	// Held is how long the resource has been held by the client.
+	Held time.Duration
+
+	// Uses is the number of times the resource was acquired.
+	Uses uint
+}
+
+// WaiterSnapshot describes an acquire waiting for a resource.
+type WaiterSnapshot struct {
+	// Client is the client waiting, if it was named with WithPoolOwner or
+	// WithPoolClient.
+	Client string
+
+	// Waited is how long the client has been waiting.
+	Waited time.Duration
+}
+
+// Snapshot returns the state of the pool. A pool that was never used has no
+// state yet, and one that is done closing has none left.
+func (p *Pool) Snapshot() PoolSnapshot {
+	if atomic.LoadInt32(&p.managed) == 0 {
+		return PoolSnapshot{Max: p.Max, Limit: p.Max}
+	}
+	r := make(chan PoolSnapshot, 1)
+	select {
+	case p.snapshot <- r:
+		return <-r
+	case <-p.done:
+		return PoolSnapshot{Max: p.Max, Limit: p.Max, Closed: true}
+	}
+}
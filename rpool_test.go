@@ -1,6 +1,7 @@
 package dvara
 
 import (
+	"context"
 	"errors"
 	"io"
 	"regexp"
@@ -108,6 +109,102 @@ func TestMax(t *testing.T) {
 	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(1))
 }
 
+func TestAcquireContextTimeout(t *testing.T) {
+	t.Parallel()
+	var timeouts int32
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "acquire.error.timeout" {
+				atomic.AddInt32(&timeouts, 1)
+			}
+		},
+	}
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           1,
+		MinIdle:       1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+
+	// acquire and hold max
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	// waiting for another gives up at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = p.AcquireContext(ctx)
+	ensure.DeepEqual(t, err, context.DeadlineExceeded)
+	ensure.DeepEqual(t, atomic.LoadInt32(&timeouts), int32(1))
+
+	// the one that gave up is no longer waiting, so the released resource goes
+	// back to the pool
+	p.Release(r)
+	r, err = p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r)
+
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(1))
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(1))
+}
+
+func TestMaxWaiting(t *testing.T) {
+	t.Parallel()
+
+	// we going to wait until stats shows we have 1 waiting acquire
+	statsDone := make(chan struct{})
+	var exhausted int32
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			switch key {
+			case "acquire.waiting":
+				close(statsDone)
+			case "acquire.error.exhausted":
+				atomic.AddInt32(&exhausted, 1)
+			}
+		},
+	}
+
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           1,
+		MaxWaiting:    1,
+		MinIdle:       1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+
+	// acquire and hold max
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	// one may wait
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		p.Release(r)
+	}()
+	<-statsDone
+
+	// but not another
+	_, err = p.Acquire()
+	ensure.DeepEqual(t, err, errPoolExhausted)
+	ensure.DeepEqual(t, atomic.LoadInt32(&exhausted), int32(1))
+
+	p.Release(r)
+	<-done
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(1))
+}
+
 func TestUseIdle(t *testing.T) {
 	t.Parallel()
 
@@ -420,6 +517,745 @@ func TestIdleClose(t *testing.T) {
 	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(max))
 }
 
+func TestMaxLifetime(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           1,
+		MinIdle:       1,
+		IdleTimeout:   time.Hour,
+		MaxLifetime:   time.Minute,
+		ClosePoolSize: 1,
+		Clock:         klock,
+	}
+
+	// released before it expires, so it is reused
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r)
+	r, err = p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(1))
+
+	// released after it expired, so a new one is made
+	klock.Add(p.MaxLifetime)
+	p.Release(r)
+	r, err = p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+	p.Release(r)
+
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(2))
+}
+
+func TestMaxLifetimeJitter(t *testing.T) {
+	t.Parallel()
+	p := Pool{MaxLifetime: time.Minute, MaxLifetimeJitter: time.Second}
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		lifetime := p.expiry(now).Sub(now)
+		if lifetime > p.MaxLifetime || lifetime <= p.MaxLifetime-p.MaxLifetimeJitter {
+			t.Fatalf("lifetime %s not within jitter", lifetime)
+		}
+	}
+	ensure.True(t, (&Pool{}).expiry(now).IsZero())
+}
+
+func TestMaxUses(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           1,
+		MinIdle:       1,
+		IdleTimeout:   time.Hour,
+		MaxUses:       2,
+		ClosePoolSize: 1,
+	}
+	for i := 0; i < 3; i++ {
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		p.Release(r)
+	}
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(2))
+}
+
+func TestMaxUsesWaiting(t *testing.T) {
+	t.Parallel()
+	statsDone := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "acquire.waiting" {
+				close(statsDone)
+			}
+		},
+	}
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           1,
+		MinIdle:       1,
+		IdleTimeout:   time.Hour,
+		MaxUses:       1,
+		ClosePoolSize: 1,
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	// the one waiting gets to make a new resource in place of the expired one
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		p.Release(r)
+	}()
+	<-statsDone
+	p.Release(r)
+	<-done
+
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(2))
+}
+
+func TestValidateIdle(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	var cm resourceMaker
+	var validated int32
+	p := Pool{
+		New:           cm.New,
+		Max:           1,
+		MinIdle:       1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		Clock:         klock,
+		Validate: func(io.Closer) error {
+			atomic.AddInt32(&validated, 1)
+			return nil
+		},
+		ValidateIdle: time.Minute,
+	}
+
+	// not idle long enough to be validated
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r)
+	r, err = p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&validated), int32(0))
+	p.Release(r)
+
+	// idle long enough, validated and reused
+	klock.Add(p.ValidateIdle)
+	r, err = p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&validated), int32(1))
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(1))
+	p.Release(r)
+
+	ensure.Nil(t, p.Close())
+}
+
+func TestValidateIdleError(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           1,
+		MinIdle:       1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		Clock:         klock,
+		Validate: func(io.Closer) error {
+			return errors.New("validate error")
+		},
+		ValidateIdle: time.Minute,
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r)
+
+	// the idle one fails validation, so a new one is made in its place
+	klock.Add(p.ValidateIdle)
+	r, err = p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+	p.Release(r)
+
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(2))
+}
+
+func TestInvalidate(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           2,
+		MinIdle:       2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+
+	// one idle and one out when invalidated
+	idle, err := p.Acquire()
+	ensure.Nil(t, err)
+	out, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(idle)
+	p.Invalidate()
+
+	// the idle one is closed instead of handed out
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(3))
+
+	// the one that was out is closed when released
+	p.Release(out)
+	p.Release(r)
+	r, err = p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(3))
+	p.Release(r)
+
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(3))
+}
+
+func TestInvalidateWaiting(t *testing.T) {
+	t.Parallel()
+	waiting := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "acquire.waiting" {
+				close(waiting)
+			}
+		},
+	}
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+
+	// one idle and one out, the limit keeps a waiter from the idle one
+	idle, err := p.Acquire()
+	ensure.Nil(t, err)
+	out, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(idle)
+	p.SetLimit(1)
+	acquired := make(chan io.Closer)
+	go func() {
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		acquired <- r
+	}()
+	<-waiting
+
+	// once invalidated the waiter gets a new one instead of the idle one
+	p.Invalidate()
+	p.SetLimit(2)
+	r := <-acquired
+	ensure.True(t, r != idle)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(3))
+
+	p.Release(out)
+	p.Release(r)
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(3))
+}
+
+func TestWarmUp(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	warmed := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "warm" {
+				warmed <- struct{}{}
+			}
+		},
+	}
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           3,
+		MinIdle:       2,
+		IdleTimeout:   time.Hour,
+		WarmInterval:  10 * time.Second,
+		ClosePoolSize: 1,
+		Clock:         klock,
+	}
+
+	// one is made right away, the next one a tick later
+	p.WarmUp()
+	<-warmed
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(1))
+	klock.Add(p.WarmInterval)
+	<-warmed
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+
+	// both are handed out without making new ones
+	r1, err := p.Acquire()
+	ensure.Nil(t, err)
+	r2, err := p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+
+	// replenished after they were discarded
+	p.Discard(r1)
+	p.Discard(r2)
+	klock.Add(p.WarmInterval)
+	<-warmed
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(3))
+
+	ensure.Nil(t, p.Close())
+}
+
+func TestWarmUpError(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	failed := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "warm.error" {
+				failed <- struct{}{}
+			}
+		},
+	}
+	p := Pool{
+		New: func() (io.Closer, error) {
+			return nil, errors.New("new error")
+		},
+		Stats:         hc,
+		Max:           1,
+		MinIdle:       1,
+		IdleTimeout:   time.Hour,
+		WarmInterval:  10 * time.Second,
+		ClosePoolSize: 1,
+		Clock:         klock,
+	}
+
+	// the failure frees up its place, so trying again a tick later is allowed
+	p.WarmUp()
+	<-failed
+	klock.Add(p.WarmInterval)
+	<-failed
+
+	ensure.Nil(t, p.Close())
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	waiting := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "acquire.waiting" {
+				close(waiting)
+			}
+		},
+	}
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           2,
+		MinIdle:       2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		Clock:         klock,
+	}
+	ensure.DeepEqual(t, p.Snapshot(), PoolSnapshot{Max: 2, Limit: 2})
+
+	// one idle for 2 minutes, one held by a for a minute, b waiting since
+	idle, err := p.Acquire()
+	ensure.Nil(t, err)
+	held, err := p.AcquireContext(WithPoolClient(context.Background(), "a"))
+	ensure.Nil(t, err)
+	p.Release(idle)
+	klock.Add(time.Minute)
+	idle, err = p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(idle)
+	klock.Add(2 * time.Minute)
+	other, err := p.AcquireContext(WithPoolClient(context.Background(), "b"))
+	ensure.Nil(t, err)
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		r, err := p.AcquireContext(WithPoolClient(context.Background(), "c"))
+		ensure.Nil(t, err)
+		p.Release(r)
+	}()
+	<-waiting
+	klock.Add(time.Second)
+
+	s := p.Snapshot()
+	ensure.DeepEqual(t, s.Out, uint(2))
+	ensure.DeepEqual(t, s.Idle, 0)
+	ensure.DeepEqual(t, s.Waiting, 1)
+	ensure.DeepEqual(t, s.Waiters, []WaiterSnapshot{{Client: "c", Waited: time.Second}})
+	acquired := map[string]AcquiredSnapshot{}
+	for _, a := range s.Acquired {
+		acquired[a.Client] = a
+	}
+	ensure.DeepEqual(t, acquired, map[string]AcquiredSnapshot{
+		"a": {Client: "a", Held: 3*time.Minute + time.Second, Uses: 1},
+		"b": {Client: "b", Held: time.Second, Uses: 3},
+	})
+
+	// the connection held by a goes to c, which releases it
+	p.Release(held)
+	<-released
+	klock.Add(time.Minute)
+	s = p.Snapshot()
+	ensure.DeepEqual(t, s.Idle, 1)
+	ensure.DeepEqual(t, s.OldestIdle, time.Minute)
+
+	p.Release(other)
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, p.Snapshot(), PoolSnapshot{Max: 2, Limit: 2, Closed: true})
+}
+
+func TestMaxConcurrentNew(t *testing.T) {
+	t.Parallel()
+	waiting := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "acquire.waiting" {
+				waiting <- struct{}{}
+			}
+		},
+	}
+	made := make(chan struct{})
+	var cm resourceMaker
+	p := Pool{
+		New: func() (io.Closer, error) {
+			<-made
+			return cm.New()
+		},
+		Stats:            hc,
+		Max:              3,
+		MaxConcurrentNew: 1,
+		MinIdle:          3,
+		IdleTimeout:      time.Hour,
+		ClosePoolSize:    1,
+	}
+
+	// the first acquire makes one, the next ones wait for it even though we're
+	// under Max
+	acquired := make(chan io.Closer, 3)
+	acquire := func() {
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		acquired <- r
+	}
+	go acquire()
+	go acquire()
+	<-waiting
+	go acquire()
+	<-waiting
+	s := p.Snapshot()
+	ensure.DeepEqual(t, s.Making, uint(1))
+	ensure.DeepEqual(t, s.Waiting, 2)
+
+	// once made the next waiter can make one
+	made <- struct{}{}
+	r1 := <-acquired
+
+	// a released one goes to the last waiter, it doesn't wait for the one being
+	// made
+	p.Release(r1)
+	r2 := <-acquired
+	ensure.True(t, r2 == r1)
+
+	made <- struct{}{}
+	r3 := <-acquired
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+
+	p.Release(r2)
+	p.Release(r3)
+	ensure.Nil(t, p.Close())
+}
+
+func TestSetLimit(t *testing.T) {
+	t.Parallel()
+	waiting := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "acquire.waiting" {
+				close(waiting)
+			}
+		},
+	}
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           3,
+		MinIdle:       3,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	r1, err := p.Acquire()
+	ensure.Nil(t, err)
+	r2, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	// over the limit, so the next acquire waits
+	p.SetLimit(1)
+	ensure.DeepEqual(t, p.Snapshot().Limit, uint(1))
+	acquired := make(chan io.Closer)
+	go func() {
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		acquired <- r
+	}()
+	<-waiting
+
+	// the first one released is kept idle, the next one is handed out
+	p.Release(r1)
+	p.Release(r2)
+	r3 := <-acquired
+	ensure.True(t, r3 == r2)
+
+	// no limit, so the idle one is handed out
+	p.SetLimit(0)
+	ensure.DeepEqual(t, p.Snapshot().Limit, uint(3))
+	r4, err := p.Acquire()
+	ensure.Nil(t, err)
+	ensure.True(t, r4 == r1)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+
+	p.Release(r3)
+	p.Release(r4)
+	ensure.Nil(t, p.Close())
+}
+
+func TestReserved(t *testing.T) {
+	t.Parallel()
+	waiting := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "acquire.waiting" {
+				close(waiting)
+			}
+		},
+	}
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           2,
+		Reserved:      []float64{0.5},
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	low1, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	// the other one is reserved, so the next low priority acquire waits
+	acquired := make(chan io.Closer)
+	go func() {
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		acquired <- r
+	}()
+	<-waiting
+
+	// while a high priority acquire gets it
+	high, err := p.AcquireContext(WithPoolPriority(context.Background(), 0))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+
+	// it stays reserved once released, the waiter gets the low priority one
+	p.Release(high)
+	p.Release(low1)
+	low2 := <-acquired
+	ensure.True(t, low2 == low1)
+
+	p.Release(low2)
+	ensure.Nil(t, p.Close())
+}
+
+func TestReservedSetLimit(t *testing.T) {
+	t.Parallel()
+	waiting := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "acquire.waiting" {
+				close(waiting)
+			}
+		},
+	}
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           4,
+		Reserved:      []float64{0.5},
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+
+	// the reservation is cut along with the limit, so lower classes still get
+	// their share
+	p.SetLimit(2)
+	low1, err := p.Acquire()
+	ensure.Nil(t, err)
+	acquired := make(chan io.Closer)
+	go func() {
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		acquired <- r
+	}()
+	<-waiting
+	high, err := p.AcquireContext(WithPoolPriority(context.Background(), 0))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+
+	// and it grows back with the limit, the released high priority one goes to
+	// the waiter
+	p.SetLimit(4)
+	p.Release(high)
+	low2 := <-acquired
+	ensure.True(t, low2 == high)
+
+	p.Release(low1)
+	p.Release(low2)
+	ensure.Nil(t, p.Close())
+}
+
+func TestShed(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	waiting := make(chan struct{}, 2)
+	var shed int32
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			switch key {
+			case "acquire.waiting":
+				waiting <- struct{}{}
+			case "acquire.error.shed":
+				atomic.AddInt32(&shed, 1)
+			}
+		},
+	}
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           1,
+		Reserved:      []float64{0},
+		ShedAfter:     time.Second,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		Clock:         klock,
+	}
+	held, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	lowErr := make(chan error)
+	go func() {
+		_, err := p.Acquire()
+		lowErr <- err
+	}()
+	<-waiting
+	highAcquired := make(chan io.Closer)
+	go func() {
+		r, err := p.AcquireContext(WithPoolPriority(context.Background(), 0))
+		ensure.Nil(t, err)
+		highAcquired <- r
+	}()
+	<-waiting
+
+	// the low priority acquire is shed once it waited too long, the high
+	// priority one keeps waiting
+	klock.Add(2 * time.Second)
+	ensure.DeepEqual(t, <-lowErr, errPoolShed)
+	ensure.DeepEqual(t, atomic.LoadInt32(&shed), int32(1))
+
+	p.Release(held)
+	high := <-highAcquired
+	ensure.True(t, high == held)
+
+	p.Release(high)
+	ensure.Nil(t, p.Close())
+}
+
+func TestShedLowestStale(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	waiting := make(chan struct{}, 2)
+	var shed int32
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			switch key {
+			case "acquire.waiting":
+				waiting <- struct{}{}
+			case "acquire.error.shed":
+				atomic.AddInt32(&shed, 1)
+			}
+		},
+	}
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           1,
+		Reserved:      []float64{0, 0},
+		ShedAfter:     time.Second,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		Clock:         klock,
+	}
+	held, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	// class 1 waits long enough to be shed, class 2 came later and is fresh
+	midErr := make(chan error)
+	go func() {
+		_, err := p.AcquireContext(WithPoolPriority(context.Background(), 1))
+		midErr <- err
+	}()
+	<-waiting
+	klock.Add(1500 * time.Millisecond)
+	lowAcquired := make(chan io.Closer)
+	go func() {
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		lowAcquired <- r
+	}()
+	<-waiting
+
+	// only the stale class 1 acquire is shed, even though class 2 is lower
+	klock.Add(500 * time.Millisecond)
+	ensure.DeepEqual(t, <-midErr, errPoolShed)
+	ensure.DeepEqual(t, atomic.LoadInt32(&shed), int32(1))
+
+	p.Release(held)
+	low := <-lowAcquired
+	ensure.True(t, low == held)
+
+	p.Release(low)
+	ensure.Nil(t, p.Close())
+}
+
 func TestReleaseInvalid(t *testing.T) {
 	t.Parallel()
 	defer ensure.PanicDeepEqual(t, errWrongPool)
@@ -1,8 +1,11 @@
 package dvara
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"sort"
 	"strings"
 	"sync"
 
@@ -19,7 +22,7 @@ type StateManager struct {
 	syncTryChan            chan struct{}
 
 	proxyToReal map[string]string
-	realToProxy map[string]string
+	realToProxy map[string]map[string]string // by listener group
 	proxies     map[string]*Proxy
 	refreshTime time.Time
 
@@ -32,7 +35,7 @@ func NewStateManager(replicaSet *ReplicaSet) *StateManager {
 		replicaSet:  replicaSet,
 		baseAddrs:   replicaSet.Addrs,
 		proxyToReal: make(map[string]string),
-		realToProxy: make(map[string]string),
+		realToProxy: make(map[string]map[string]string),
 		proxies:     make(map[string]*Proxy),
 	}
 	return manager
@@ -108,6 +111,7 @@ func (manager *StateManager) Synchronize() {
 	}
 
 	manager.stopStartProxies(comparison)
+	manager.invalidateProxies(comparison)
 	manager.currentReplicaSetState = newState
 
 	// Add discovered nodes to seed address list. Over time if the original seed
@@ -128,11 +132,72 @@ func (manager *StateManager) ProxyMembers() []string {
 	return members
 }
 
-// implement ProxyMapper interface
+// MemberSnapshot is the state of the server connection pools to a member,
+// totalled over its listener groups.
+type MemberSnapshot struct {
+	MongoAddr string
+	Max       uint
+	Limit     uint
+	Idle      int
+	Out       uint
+	Making    uint
+	Waiting   int
+	Proxies   []ProxySnapshot // by listener group
+}
+
+// Snapshot returns the state of the server connection pools of every member,
+// ordered by member.
+func (manager *StateManager) Snapshot() []MemberSnapshot {
+	manager.RLock()
+	defer manager.RUnlock()
+	members := make(map[string]*MemberSnapshot)
+	for _, proxy := range manager.proxies {
+		snapshot := proxy.Snapshot()
+		member, ok := members[snapshot.MongoAddr]
+		if !ok {
+			member = &MemberSnapshot{MongoAddr: snapshot.MongoAddr}
+			members[snapshot.MongoAddr] = member
+		}
+		member.Max += snapshot.Pool.Max
+		member.Limit += snapshot.Pool.Limit
+		member.Idle += snapshot.Pool.Idle
+		member.Out += snapshot.Pool.Out
+		member.Making += snapshot.Pool.Making
+		member.Waiting += snapshot.Pool.Waiting
+		member.Proxies = append(member.Proxies, snapshot)
+	}
+	snapshots := make([]MemberSnapshot, 0, len(members))
+	for _, member := range members {
+		sort.Slice(member.Proxies, func(i, j int) bool {
+			return member.Proxies[i].Group < member.Proxies[j].Group
+		})
+		snapshots = append(snapshots, *member)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].MongoAddr < snapshots[j].MongoAddr
+	})
+	return snapshots
+}
+
+// ServeHTTP writes the state of the server connection pools of every member as
+// JSON, so operators can see why a pool is saturated.
+func (manager *StateManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(manager.Snapshot()); err != nil {
+		corelog.LogErrorMessage(fmt.Sprintf("failed to write snapshot: %s", err))
+	}
+}
+
+// implement ProxyMapper interface, mapping to the first listener group
 func (manager *StateManager) Proxy(h string) (string, error) {
+	return manager.GroupProxy(manager.replicaSet.listenerGroups()[0].Name, h)
+}
+
+// implement GroupProxyMapper interface
+func (manager *StateManager) GroupProxy(group, h string) (string, error) {
 	manager.RLock()
 	defer manager.RUnlock()
-	p, ok := manager.realToProxy[h]
+	p, ok := manager.realToProxy[group][h]
 	if !ok {
 		return "", fmt.Errorf("mongo %s is not in ReplicaSet", h)
 	}
@@ -160,25 +225,30 @@ func (manager *StateManager) removeProxies(proxies ...*Proxy) error {
 	return nil
 }
 
+// generateProxies creates a proxy for every listener group of every address.
 func (manager *StateManager) generateProxies(addresses ...string) ([]*Proxy, error) {
 	proxies := []*Proxy{}
+	groups := manager.replicaSet.listenerGroups()
 	for _, address := range addresses {
-		listener, err := manager.replicaSet.newListener()
-		if err != nil {
-			return nil, err
+		for _, group := range groups {
+			listener, err := manager.replicaSet.newListener(group)
+			if err != nil {
+				return nil, err
+			}
+
+			p := &Proxy{
+				ReplicaSet:     manager.replicaSet,
+				Group:          group,
+				ClientListener: listener,
+				ProxyAddr:      manager.replicaSet.proxyAddr(listener),
+				Cred:           manager.replicaSet.Cred,
+				MongoAddr:      address,
+				extensions:     manager.ExtensionStack,
+				TLSConfig:      manager.replicaSet.BackendTLSConfig,
+			}
+
+			proxies = append(proxies, p)
 		}
-
-		p := &Proxy{
-			ReplicaSet:     manager.replicaSet,
-			ClientListener: listener,
-			ProxyAddr:      manager.replicaSet.proxyAddr(listener),
-			Cred:           manager.replicaSet.Cred,
-			MongoAddr:      address,
-			extensions:     manager.ExtensionStack.GetExtensions(),
-			TLSConfig:      manager.replicaSet.BackendTLSConfig,
-		}
-
-		proxies = append(proxies, p)
 	}
 	return proxies, nil
 }
@@ -191,8 +261,9 @@ func (manager *StateManager) generateReplicaSetState() (*ReplicaSetState, error)
 
 func (manager *StateManager) getComparison(oldResp, newResp *replSetGetStatusResponse) (*ReplicaSetComparison, error) {
 	comparison := &ReplicaSetComparison{
-		ExtraMembers:   make(map[string]*Proxy),
-		MissingMembers: make(map[string]*Proxy),
+		ExtraMembers:   make(map[string][]*Proxy),
+		MissingMembers: make(map[string][]*Proxy),
+		ChangedMembers: make(map[string][]*Proxy),
 	}
 
 	if (oldResp == nil || len(oldResp.Members) == 0) && (newResp == nil || len(newResp.Members) == 0) {
@@ -202,16 +273,21 @@ func (manager *StateManager) getComparison(oldResp, newResp *replSetGetStatusRes
 		return nil, errors.New("No members found")
 	}
 
+	oldStates := make(map[string]ReplicaState)
 	for _, m := range oldResp.Members {
-		if proxy, ok := manager.findProxyForMember(m); ok {
-			comparison.ExtraMembers[m.Name] = proxy
+		if proxies := manager.findProxiesForMember(m); len(proxies) > 0 {
+			comparison.ExtraMembers[m.Name] = proxies
+			oldStates[m.Name] = m.State
 		}
 	}
 
 	for _, m := range newResp.Members {
-		if _, ok := comparison.ExtraMembers[m.Name]; ok {
+		if proxies, ok := comparison.ExtraMembers[m.Name]; ok {
 			// if we've got the same thing in new then it's not extra
 			delete(comparison.ExtraMembers, m.Name)
+			if oldStates[m.Name] != m.State {
+				comparison.ChangedMembers[m.Name] = proxies
+			}
 		} else {
 			// otherwise it's missing
 			comparison.MissingMembers[m.Name] = nil // we don't have a proxy to add just yet
@@ -221,8 +297,8 @@ func (manager *StateManager) getComparison(oldResp, newResp *replSetGetStatusRes
 }
 
 func (manager *StateManager) addRemoveProxies(comparison *ReplicaSetComparison) error {
-	for _, proxy := range comparison.ExtraMembers {
-		manager.removeProxy(proxy)
+	for _, proxies := range comparison.ExtraMembers {
+		manager.removeProxies(proxies...)
 	}
 
 	for name, _ := range comparison.MissingMembers {
@@ -230,51 +306,74 @@ func (manager *StateManager) addRemoveProxies(comparison *ReplicaSetComparison)
 		if err != nil {
 			return err
 		}
-		p, err := manager.addProxy(proxies[0])
-		if err != nil {
-			return err
+		for _, proxy := range proxies {
+			p, err := manager.addProxy(proxy)
+			if err != nil {
+				return err
+			}
+			comparison.MissingMembers[name] = append(comparison.MissingMembers[name], p)
 		}
-		comparison.MissingMembers[name] = p
 	}
 	return nil
 }
 
 func (manager *StateManager) addProxy(proxy *Proxy) (*Proxy, error) {
+	group := proxy.groupName()
 	if _, ok := manager.proxyToReal[proxy.ProxyAddr]; ok {
 		return nil, fmt.Errorf("proxy %s already used in ReplicaSet", proxy.ProxyAddr)
 	}
-	if _, ok := manager.realToProxy[proxy.MongoAddr]; ok {
+	if _, ok := manager.realToProxy[group][proxy.MongoAddr]; ok {
 		return nil, fmt.Errorf("mongo %s already exists in ReplicaSet", proxy.MongoAddr)
 	}
 	corelog.LogInfoMessage(fmt.Sprintf("added %s", proxy))
+	if manager.realToProxy[group] == nil {
+		manager.realToProxy[group] = make(map[string]string)
+	}
 	manager.proxyToReal[proxy.ProxyAddr] = proxy.MongoAddr
-	manager.realToProxy[proxy.MongoAddr] = proxy.ProxyAddr
+	manager.realToProxy[group][proxy.MongoAddr] = proxy.ProxyAddr
 	manager.proxies[proxy.ProxyAddr] = proxy
 	return proxy, nil
 }
 
 func (manager *StateManager) removeProxy(proxy *Proxy) {
+	group := proxy.groupName()
 	if _, ok := manager.proxyToReal[proxy.ProxyAddr]; !ok {
 		corelog.LogErrorMessage(fmt.Sprintf("proxy %s does not exist in ReplicaSet", proxy.ProxyAddr))
 	}
-	if _, ok := manager.realToProxy[proxy.MongoAddr]; !ok {
+	if _, ok := manager.realToProxy[group][proxy.MongoAddr]; !ok {
 		corelog.LogErrorMessage(fmt.Sprintf("mongo %s does not exist in ReplicaSet", proxy.ProxyAddr))
 	}
 	corelog.LogInfoMessage(fmt.Sprintf("removed %s", proxy))
 	delete(manager.proxyToReal, proxy.ProxyAddr)
-	delete(manager.realToProxy, proxy.MongoAddr)
+	delete(manager.realToProxy[group], proxy.MongoAddr)
 	delete(manager.proxies, proxy.ProxyAddr)
 }
 
 func (manager *StateManager) stopStartProxies(comparison *ReplicaSetComparison) {
 	t := manager.replicaSet.Stats.BumpTime("replica.manager.start_stop_proxies.time")
 	defer t.End()
-	for _, proxy := range comparison.ExtraMembers {
-		go manager.stopProxy(proxy)
+	for _, proxies := range comparison.ExtraMembers {
+		for _, proxy := range proxies {
+			go manager.stopProxy(proxy)
+		}
 	}
 
-	for _, proxy := range comparison.MissingMembers {
-		go manager.startProxy(proxy)
+	for _, proxies := range comparison.MissingMembers {
+		for _, proxy := range proxies {
+			go manager.startProxy(proxy)
+		}
+	}
+}
+
+// invalidateProxies stops the server connections of members that changed state
+// from being reused, they may point at a primary that stepped down.
+func (manager *StateManager) invalidateProxies(comparison *ReplicaSetComparison) {
+	for name, proxies := range comparison.ChangedMembers {
+		for _, proxy := range proxies {
+			corelog.LogInfoMessage(fmt.Sprintf("member %s changed state, invalidating %s", name, proxy))
+			proxy.invalidate()
+			manager.replicaSet.Stats.BumpSum("replica.manager.invalidated_proxy", 1)
+		}
 	}
 }
 
@@ -290,11 +389,18 @@ func (manager *StateManager) stopProxy(proxy *Proxy) {
 	}
 }
 
-func (manager *StateManager) findProxyForMember(member statusMember) (*Proxy, bool) {
-	proxyName, ok := manager.realToProxy[member.Name]
-	if !ok {
-		return nil, false
+// findProxiesForMember returns the proxies of every listener group for the
+// member.
+func (manager *StateManager) findProxiesForMember(member statusMember) []*Proxy {
+	var proxies []*Proxy
+	for _, realToProxy := range manager.realToProxy {
+		proxyName, ok := realToProxy[member.Name]
+		if !ok {
+			continue
+		}
+		if proxy, ok := manager.proxies[proxyName]; ok {
+			proxies = append(proxies, proxy)
+		}
 	}
-	proxy, ok := manager.proxies[proxyName]
-	return proxy, ok
+	return proxies
 }
@@ -1,9 +1,14 @@
 package dvara
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http/httptest"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/facebookgo/stats"
 )
 
 func TestManagerFindsMissingExtraMembers(t *testing.T) {
@@ -25,18 +30,34 @@ func TestManagerFindsMissingExtraMembers(t *testing.T) {
 	}
 }
 
+func TestManagerFindsChangedMembers(t *testing.T) {
+	manager := newManager()
+	manager.addProxies("a", "b")
+
+	oldResp := getStatusResponse("a", "b")
+	newResp := getStatusResponse("a", "b")
+	newResp.Members[1].State = ReplicaStatePrimary
+	comparison, _ := manager.getComparison(oldResp, newResp)
+	if len(comparison.ChangedMembers) != 1 {
+		t.Fatalf("expecting %d changed member, got %d", 1, len(comparison.ChangedMembers))
+	}
+	if _, ok := comparison.ChangedMembers["b"]; !ok {
+		t.Fatal("Changed member b not found")
+	}
+}
+
 func TestManagerAddsAndRemovesProxies(t *testing.T) {
 	manager := newManager()
 	manager.addProxies("mongoA", "mongoB")
 	comparison, _ := manager.getComparison(getStatusResponse("mongoA", "mongoB"), getStatusResponse("mongoA", "mongoC"))
 	manager.addRemoveProxies(comparison)
-	if _, ok := manager.proxies[manager.realToProxy["mongoA"]]; !ok {
+	if _, ok := manager.proxies[manager.realToProxy[""]["mongoA"]]; !ok {
 		t.Fatal("proxyA was removed")
 	}
-	if _, ok := manager.proxies[manager.realToProxy["mongoB"]]; ok {
+	if _, ok := manager.proxies[manager.realToProxy[""]["mongoB"]]; ok {
 		t.Fatal("proxyB was not removed")
 	}
-	if _, ok := manager.proxies[manager.realToProxy["mongoC"]]; !ok {
+	if _, ok := manager.proxies[manager.realToProxy[""]["mongoC"]]; !ok {
 		t.Fatal("proxyC was not added")
 	}
 }
@@ -152,7 +173,7 @@ func newManagerWithReplicaSet(replicaSet *ReplicaSet) *StateManager {
 		replicaSet:     replicaSet,
 		baseAddrs:      replicaSet.Addrs,
 		proxyToReal:    make(map[string]string),
-		realToProxy:    make(map[string]string),
+		realToProxy:    make(map[string]map[string]string),
 		proxies:        make(map[string]*Proxy),
 		ExtensionStack: &extensionStack,
 	}
@@ -167,3 +188,124 @@ func getStatusResponse(memberNames ...string) *replSetGetStatusResponse {
 		Members: members,
 	}
 }
+
+func TestManagerSnapshot(t *testing.T) {
+	t.Parallel()
+	replicaSet := setupReplicaSet()
+	replicaSet.ListenerGroups = []ListenerGroup{{Name: "online"}, {Name: "batch"}}
+	manager := newManagerWithReplicaSet(replicaSet)
+	if err := manager.addProxies("mongoB", "mongoA"); err != nil {
+		t.Fatal(err)
+	}
+	snapshots := manager.Snapshot()
+	if len(snapshots) != 2 {
+		t.Fatalf("expecting %d snapshots, got %d", 2, len(snapshots))
+	}
+	if snapshots[0].MongoAddr != "mongoA" || snapshots[1].MongoAddr != "mongoB" {
+		t.Fatalf("snapshots not ordered by member: %+v", snapshots)
+	}
+	for _, member := range snapshots {
+		if len(member.Proxies) != 2 {
+			t.Fatalf("expecting %d proxies, got %d", 2, len(member.Proxies))
+		}
+		if member.Proxies[0].Group != "batch" || member.Proxies[1].Group != "online" {
+			t.Fatalf("proxies not ordered by listener group: %+v", member.Proxies)
+		}
+		for _, proxy := range member.Proxies {
+			if proxy.MongoAddr != member.MongoAddr {
+				t.Fatalf("expecting proxy to %s, got %s", member.MongoAddr, proxy.MongoAddr)
+			}
+		}
+	}
+}
+
+func TestManagerSnapshotStarting(t *testing.T) {
+	t.Parallel()
+	replicaSet := setupReplicaSet()
+	replicaSet.MaxConnections = 1
+	replicaSet.MaxPerClientConnections = 1
+	replicaSet.ServerClosePoolSize = 1
+	replicaSet.ServerIdleTimeout = time.Minute
+	replicaSet.Stats = &stats.HookClient{}
+	manager := newManagerWithReplicaSet(replicaSet)
+	if err := manager.addProxies("mongoA", "mongoB"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for _, proxy := range manager.proxies {
+		wg.Add(1)
+		go func(proxy *Proxy) {
+			defer wg.Done()
+			manager.startProxy(proxy)
+		}(proxy)
+	}
+	manager.Snapshot()
+	manager.invalidateProxies(&ReplicaSetComparison{
+		ChangedMembers: map[string][]*Proxy{"mongoA": manager.findProxiesForMember(statusMember{Name: "mongoA"})},
+	})
+	wg.Wait()
+	for _, member := range manager.Snapshot() {
+		if member.Max != 1 {
+			t.Fatalf("expecting max %d, got %d", 1, member.Max)
+		}
+	}
+	for _, proxy := range manager.proxies {
+		manager.stopProxy(proxy)
+	}
+}
+
+func TestManagerServeHTTP(t *testing.T) {
+	t.Parallel()
+	manager := newManager()
+	if err := manager.addProxies("mongoA"); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	manager.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var snapshots []MemberSnapshot
+	if err := json.NewDecoder(w.Body).Decode(&snapshots); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].MongoAddr != "mongoA" {
+		t.Fatalf("unexpected snapshots: %+v", snapshots)
+	}
+}
+
+func TestManagerListenerGroups(t *testing.T) {
+	t.Parallel()
+	replicaSet := setupReplicaSet()
+	replicaSet.ListenerGroups = []ListenerGroup{{Name: "online"}, {Name: "batch"}}
+	manager := newManagerWithReplicaSet(replicaSet)
+	if err := manager.addProxies("mongoA", "mongoB"); err != nil {
+		t.Fatal(err)
+	}
+	if len(manager.proxies) != 4 {
+		t.Fatalf("expecting %d proxies, got %d", 4, len(manager.proxies))
+	}
+	online, err := manager.GroupProxy("online", "mongoA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := manager.GroupProxy("batch", "mongoA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if online == batch {
+		t.Fatalf("groups share proxy %s", online)
+	}
+	if p, _ := manager.Proxy("mongoA"); p != online {
+		t.Fatalf("expecting the first group's proxy %s, got %s", online, p)
+	}
+
+	comparison, _ := manager.getComparison(getStatusResponse("mongoA", "mongoB"), getStatusResponse("mongoA"))
+	if len(comparison.ExtraMembers["mongoB"]) != 2 {
+		t.Fatalf("expecting the proxies of both groups to be extra: %v", comparison.ExtraMembers)
+	}
+	manager.addRemoveProxies(comparison)
+	if len(manager.proxies) != 2 {
+		t.Fatalf("expecting %d proxies, got %d", 2, len(manager.proxies))
+	}
+	if _, err := manager.GroupProxy("batch", "mongoB"); err == nil {
+		t.Fatal("proxy of mongoB was not removed")
+	}
+}
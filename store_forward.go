@@ -0,0 +1,154 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/facebookgo/stats"
+)
+
+// memoryBudget counts the memory held by store-and-forward buffers, so they
+// stay within a cap across all clients.
+type memoryBudget struct {
+	used int64
+}
+
+// reserve takes n bytes from the budget, unless that goes over max. Zero
+// means no cap.
+func (b *memoryBudget) reserve(n, max int64) bool {
+	for {
+		used := atomic.LoadInt64(&b.used)
+		if max > 0 && used+n > max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+n) {
+			return true
+		}
+	}
+}
+
+// release gives n bytes back to the budget.
+func (b *memoryBudget) release(n int64) {
+	atomic.AddInt64(&b.used, -n)
+}
+
+// storedConn wraps a client connection for the duration of a single message
+// in store-and-forward mode. Reads return the request body, which was read
+// before a server connection was acquired, and writes are stored until Send
+// sends them to the client once the server connection was released. The
+// request and its replies are each capped at maxMessage. Once the replies
+// don't fit the memory caps, those stored are sent and the rest are written
+// through.
+type storedConn struct {
+	net.Conn
+	budget     *memoryBudget
+	maxMessage int64
+	maxMemory  int64
+	timeout    time.Duration
+	stats      stats.Client
+
+	request         *bytes.Reader
+	replies         bytes.Buffer
+	requestReserved int64
+	repliesReserved int64
+	through         bool
+}
+
+// reserve takes n more bytes from the budget for the request or the replies,
+// whichever reserved points at, unless that or the budget would go over its
+// cap.
+func (c *storedConn) reserve(reserved *int64, n int64) bool {
+	if c.maxMessage > 0 && *reserved+n > c.maxMessage {
+		return false
+	}
+	if !c.budget.reserve(n, c.maxMemory) {
+		return false
+	}
+	*reserved += n
+	return true
+}
+
+func (c *storedConn) Read(b []byte) (int, error) {
+	return c.request.Read(b)
+}
+
+func (c *storedConn) Write(b []byte) (int, error) {
+	if !c.through && !c.reserve(&c.repliesReserved, int64(len(b))) {
+		stats.BumpSum(c.stats, "message.store.through", 1)
+		c.through = true
+		if err := c.Send(); err != nil {
+			return 0, err
+		}
+	}
+	if c.through {
+		return c.Conn.Write(b)
+	}
+	return c.replies.Write(b)
+}
+
+// Send sends the stored replies to the client and gives the memory they, and
+// the request, held back to the budget. It does nothing on a nil storedConn,
+// so callers don't need to care if the message was stored.
+func (c *storedConn) Send() error {
+	if c == nil {
+		return nil
+	}
+	defer c.discard()
+	if c.replies.Len() == 0 {
+		return nil
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.replies.WriteTo(c.Conn)
+	return err
+}
+
+// discard forgets the stored request and replies.
+func (c *storedConn) discard() {
+	if c == nil {
+		return
+	}
+	c.request = bytes.NewReader(nil)
+	c.replies.Reset()
+	c.budget.release(c.requestReserved + c.repliesReserved)
+	c.requestReserved = 0
+	c.repliesReserved = 0
+}
+
+// storeRequest reads the body of a message in store-and-forward mode, so a slow
+// client doesn't hold a server connection while it sends it. It returns nil if
+// the mode is off or the message doesn't fit the memory caps, the message is
+// then streamed from the client.
+func (p *Proxy) storeRequest(c net.Conn, h *messageHeader) (*storedConn, error) {
+	if !p.ReplicaSet.StoreForward {
+		return nil, nil
+	}
+	sc := &storedConn{
+		Conn:       c,
+		budget:     &p.ReplicaSet.storeForwardMemory,
+		maxMessage: p.ReplicaSet.StoreForwardMaxMessage,
+		maxMemory:  p.ReplicaSet.StoreForwardMaxMemory,
+		timeout:    p.Group.MessageTimeout,
+		stats:      p.stats,
+	}
+	size := int64(h.MessageLength - headerLen)
+	if size < 0 {
+		return nil, errMessageLength
+	}
+	if !sc.reserve(&sc.requestReserved, size) {
+		stats.BumpSum(p.stats, "message.store.skipped", 1)
+		return nil, nil
+	}
+	body := make([]byte, size)
+	c.SetReadDeadline(time.Now().Add(p.Group.MessageTimeout))
+	p.setBodyReadDeadline(c)
+	if _, err := io.ReadFull(c, body); err != nil {
+		sc.discard()
+		return nil, err
+	}
+	sc.request = bytes.NewReader(body)
+	stats.BumpSum(p.stats, "message.stored", 1)
+	return sc, nil
+}
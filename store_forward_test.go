@@ -0,0 +1,125 @@
+package dvara
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	t.Parallel()
+	var b memoryBudget
+	ensure.True(t, b.reserve(6, 10))
+	ensure.False(t, b.reserve(5, 10))
+	ensure.True(t, b.reserve(4, 10))
+	b.release(6)
+	ensure.True(t, b.reserve(5, 10))
+	ensure.True(t, b.reserve(100, 0))
+}
+
+func TestStoreRequest(t *testing.T) {
+	t.Parallel()
+	request := fakeCommand("test", "ping", map[string]int{"ping": 1}, map[string]int{})
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	ensure.Nil(t, err)
+	var client bytes.Buffer
+	p := &Proxy{ReplicaSet: &ReplicaSet{StoreForward: true}}
+	sc, err := p.storeRequest(fakeReadWriter{Reader: r, Writer: &client}, h)
+	ensure.Nil(t, err)
+
+	// the whole request was read from the client
+	ensure.DeepEqual(t, r.Len(), 0)
+	body, err := ioutil.ReadAll(sc)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, body, request[headerLen:])
+
+	// replies are stored until they are sent
+	_, err = sc.Write([]byte("reply"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, client.Len(), 0)
+	ensure.True(t, p.ReplicaSet.storeForwardMemory.used > 0)
+	ensure.Nil(t, sc.Send())
+	ensure.DeepEqual(t, client.String(), "reply")
+	ensure.DeepEqual(t, p.ReplicaSet.storeForwardMemory.used, int64(0))
+}
+
+func TestStoreRequestOverCap(t *testing.T) {
+	t.Parallel()
+	request := fakeCommand("test", "ping", map[string]int{"ping": 1}, map[string]int{})
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	ensure.Nil(t, err)
+	p := &Proxy{ReplicaSet: &ReplicaSet{StoreForward: true, StoreForwardMaxMemory: 10}}
+
+	// too large to store, so it is streamed
+	sc, err := p.storeRequest(fakeReadWriter{Reader: r}, h)
+	ensure.Nil(t, err)
+	ensure.True(t, sc == nil)
+	ensure.DeepEqual(t, r.Len(), len(request)-headerLen)
+	ensure.DeepEqual(t, p.ReplicaSet.storeForwardMemory.used, int64(0))
+}
+
+func TestStoredConnThrough(t *testing.T) {
+	t.Parallel()
+	var budget memoryBudget
+	var client bytes.Buffer
+	sc := &storedConn{
+		Conn:       fakeReadWriter{Writer: &client},
+		budget:     &budget,
+		maxMessage: 8,
+	}
+
+	// once the replies don't fit, those stored are sent and the rest written
+	// through
+	_, err := sc.Write([]byte("first"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, client.Len(), 0)
+	_, err = sc.Write([]byte("second"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, client.String(), "firstsecond")
+	ensure.DeepEqual(t, budget.used, int64(0))
+	_, err = sc.Write([]byte("third"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, client.String(), "firstsecondthird")
+	ensure.Nil(t, sc.Send())
+	ensure.DeepEqual(t, client.String(), "firstsecondthird")
+
+	// a nil storedConn was never stored
+	var none *storedConn
+	ensure.Nil(t, none.Send())
+}
+
+func TestStoredRepliesThrough(t *testing.T) {
+	t.Parallel()
+	request := fakeCommand("test", "ping", map[string]int{"ping": 1}, map[string]int{})
+	r := bytes.NewReader(request)
+	h, err := readHeader(r)
+	ensure.Nil(t, err)
+	var client bytes.Buffer
+	size := int64(len(request) - headerLen)
+	p := &Proxy{ReplicaSet: &ReplicaSet{StoreForward: true, StoreForwardMaxMessage: size}}
+	sc, err := p.storeRequest(fakeReadWriter{Reader: r, Writer: &client}, h)
+	ensure.Nil(t, err)
+	ensure.True(t, sc != nil)
+
+	// the request takes all of the cap, the replies have one of their own
+	_, err = sc.Write(make([]byte, size-1))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, client.Len(), 0)
+	ensure.DeepEqual(t, p.ReplicaSet.storeForwardMemory.used, 2*size-1)
+
+	// halfway through the replies they no longer fit, those stored are sent
+	// and the rest written through
+	_, err = sc.Write([]byte("more"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, client.Len(), int(size+3))
+	ensure.DeepEqual(t, p.ReplicaSet.storeForwardMemory.used, int64(0))
+	_, err = sc.Write([]byte("last"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, client.Len(), int(size+7))
+	ensure.Nil(t, sc.Send())
+	ensure.DeepEqual(t, client.Len(), int(size+7))
+}